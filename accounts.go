@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/stephenoveson/chirpy/database"
+)
+
+const defaultAccountDeletionGrace = 30 * 24 * time.Hour
+
+// handleDeleteUser schedules the caller's account for deletion. Nothing is
+// removed until the grace period ends, and logging in before then cancels
+// it. The password, and a second factor when enabled, must be confirmed so
+// a stolen access token can't be used to delete an account. Wrong guesses
+// count towards the same lockouts as logging in.
+func (api *apiConfig) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	type response struct {
+		DeleteAfter time.Time `json:"delete_after"`
+	}
+	userId := principalFromContext(r.Context()).UserId
+
+	params := parameters{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	user, err := api.db.GetUserById(userId)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Unable to find user")
+		return
+	}
+
+	emailKey := emailThrottleKey(user.Email)
+	ipKey := ipThrottleKey(r)
+	if !api.checkLoginLockout(w, emailKey, ipKey) {
+		return
+	}
+
+	_, err = api.passwords.CheckPasswordHash(params.Password, user.Password)
+	if err != nil {
+		api.recordLoginFailure(r, user.Id, emailKey, ipKey)
+		respondWithError(w, http.StatusUnauthorized, "Incorrect password")
+		return
+	}
+
+	if user.TOTPEnabled {
+		err = api.verifySecondFactor(user, params.Code, params.RecoveryCode)
+		if err != nil {
+			logSecurityEvent("totp_failed", user.Id, r)
+			api.recordLoginFailure(r, user.Id, emailKey, ipKey)
+			respondWithError(w, http.StatusUnauthorized, errInvalidTOTPResponse)
+			return
+		}
+	}
+
+	err = api.db.ClearLoginFailures(emailKey)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to update login attempts")
+		return
+	}
+
+	user, err = api.db.ScheduleUserDeletion(userId, time.Now().Add(api.accountDeletionGrace).UTC())
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't schedule account deletion")
+		return
+	}
+
+	logSecurityEvent("account_deletion_requested", userId, r)
+
+	respondWithJson(w, http.StatusAccepted, response{
+		DeleteAfter: user.DeleteAfter,
+	})
+}
+
+// purgeDeletedAccounts removes accounts whose deletion grace period has
+// ended, checking once at startup and then every interval.
+func purgeDeletedAccounts(db *database.DB, interval time.Duration) {
+	for ; ; time.Sleep(interval) {
+		users, err := db.GetUsersDueForDeletion(time.Now())
+		if err != nil {
+			log.Printf("Unable to find accounts due for deletion: %s", err)
+			continue
+		}
+
+		for _, user := range users {
+			err = db.PurgeUser(user.Id, []string{emailThrottleKey(user.Email)})
+			if err != nil {
+				log.Printf("Unable to delete account %d: %s", user.Id, err)
+				continue
+			}
+
+			err = db.RecordAudit(database.AuditEntry{
+				Action:     "user.purge",
+				TargetType: "user",
+				TargetId:   user.Id,
+			})
+			if err != nil {
+				log.Printf("Unable to record audit entry user.purge: %s", err)
+			}
+			log.Printf("Deleted account %d", user.Id)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/stephenoveson/chirpy/auth"
+	"github.com/stephenoveson/chirpy/database"
+)
+
+const auditLogLimit = 100
+
+func (api *apiConfig) handleGetUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := api.db.GetUsers()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to read users from database.")
+		return
+	}
+
+	response := make([]userSuccess, 0, len(users))
+	for _, u := range users {
+		response = append(response, newUserSuccess(u))
+	}
+
+	respondWithJson(w, http.StatusOK, response)
+}
+
+func (api *apiConfig) handleSetUserRole(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Role string `json:"role"`
+	}
+
+	userId, err := strconv.Atoi(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to convert parameter to integer.")
+		return
+	}
+
+	params := parameters{}
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	if !database.IsValidRole(params.Role) {
+		respondWithError(w, http.StatusBadRequest, "Unknown role")
+		return
+	}
+
+	if userId == principalFromContext(r.Context()).UserId && params.Role != database.RoleAdmin {
+		respondWithError(w, http.StatusBadRequest, "Admins can't demote themselves")
+		return
+	}
+
+	user, err := api.db.SetUserRole(userId, params.Role)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Unable to find user")
+		return
+	}
+
+	api.audit(r, "user.role_changed", "user", user.Id, "role="+user.Role)
+
+	respondWithJson(w, http.StatusOK, newUserSuccess(user))
+}
+
+func (api *apiConfig) handleGetAuditLog(w http.ResponseWriter, r *http.Request) {
+	entries, err := api.db.GetAuditLog(auditLogLimit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to read audit log.")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, entries)
+}
+
+// audit records an action taken by the authenticated principal. A failure to
+// write the trail is logged rather than failing an action that already
+// happened.
+func (api *apiConfig) audit(r *http.Request, action, targetType string, targetId int, detail string) {
+	err := api.db.RecordAudit(database.AuditEntry{
+		ActorId:    principalFromContext(r.Context()).UserId,
+		Action:     action,
+		TargetType: targetType,
+		TargetId:   targetId,
+		Detail:     detail,
+		RemoteAddr: r.RemoteAddr,
+	})
+	if err != nil {
+		log.Printf("Unable to record audit entry %s: %s", action, err)
+	}
+}
+
+// bootstrapAdmin backs the -bootstrap-admin flag. It promotes an existing
+// account or creates a new one, and refuses to run once any admin exists so
+// it can't be used to take over a live server.
+func bootstrapAdmin(db *database.DB, passwords auth.PasswordHasher, policy auth.PasswordPolicy, email, password string) error {
+	hasAdmin, err := db.HasAdmin()
+	if err != nil {
+		return err
+	}
+	if hasAdmin {
+		return errors.New("an admin account already exists")
+	}
+
+	user, err := db.GetUserByEmail(email)
+	if err == nil {
+		user, err = db.SetUserRole(user.Id, database.RoleAdmin)
+		if err != nil {
+			return err
+		}
+	} else {
+		if password == "" {
+			return errors.New("ADMIN_PASSWORD must be set to create a new admin account")
+		}
+
+		err = policy.Validate(password)
+		if err != nil {
+			return err
+		}
+
+		hash, err := passwords.HashPassword(password)
+		if err != nil {
+			return err
+		}
+
+		user, err = db.CreateUserWithRole(email, hash, database.RoleAdmin)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = db.RecordAudit(database.AuditEntry{
+		Action:     "admin.bootstrapped",
+		TargetType: "user",
+		TargetId:   user.Id,
+		Detail:     fmt.Sprintf("email=%s", user.Email),
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("User %d (%s) is now an admin", user.Id, user.Email)
+	return nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stephenoveson/chirpy/auth"
+	"github.com/stephenoveson/chirpy/database"
+)
+
+// apiKeyScopes are the scopes a personal API key may be granted. Keys can
+// never carry the admin scope, and routes that change credentials require a
+// first-party token whatever the key's scopes.
+var apiKeyScopes = []string{auth.ScopeChirpsWrite, auth.ScopeUsersWrite}
+
+type apiKeyResponse struct {
+	Id         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+func newAPIKeyResponse(key database.APIKey) apiKeyResponse {
+	return apiKeyResponse{
+		Id:         key.Id,
+		Name:       key.Name,
+		Prefix:     key.Prefix,
+		Scopes:     key.Scopes,
+		CreatedAt:  key.CreatedAt,
+		ExpiresAt:  optionalTime(key.ExpiresAt),
+		LastUsedAt: optionalTime(key.LastUsedAt),
+		RevokedAt:  optionalTime(key.RevokedAt),
+	}
+}
+
+// apiKeyUsage remembers when API keys were last used until they are
+// flushed to the database, so authenticating with a key doesn't rewrite the
+// whole database file.
+type apiKeyUsage struct {
+	mu       sync.Mutex
+	lastUsed map[int]time.Time
+}
+
+func newAPIKeyUsage() *apiKeyUsage {
+	return &apiKeyUsage{lastUsed: map[int]time.Time{}}
+}
+
+func (u *apiKeyUsage) record(keyId int, at time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if at.After(u.lastUsed[keyId]) {
+		u.lastUsed[keyId] = at
+	}
+}
+
+// get returns when keyId was last used since the last flush, if it was.
+func (u *apiKeyUsage) get(keyId int) (time.Time, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	at, ok := u.lastUsed[keyId]
+	return at, ok
+}
+
+// take returns the uses recorded since the last flush and forgets them.
+func (u *apiKeyUsage) take() map[int]time.Time {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	used := u.lastUsed
+	u.lastUsed = map[int]time.Time{}
+	return used
+}
+
+// flushAPIKeyUsage saves the last use of every API key used since the
+// previous flush, every interval.
+func (api *apiConfig) flushAPIKeyUsage(interval time.Duration) {
+	for ; ; time.Sleep(interval) {
+		used := api.apiKeyUsage.take()
+		if len(used) == 0 {
+			continue
+		}
+
+		err := api.db.TouchAPIKeys(used)
+		if err != nil {
+			log.Printf("Unable to record use of api keys: %s", err)
+			for keyId, at := range used {
+				api.apiKeyUsage.record(keyId, at)
+			}
+		}
+	}
+}
+
+func (api *apiConfig) handleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Name      string     `json:"name"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	type response struct {
+		apiKeyResponse
+		Key string `json:"key"`
+	}
+	p := principalFromContext(r.Context())
+
+	params := parameters{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	params.Name = strings.TrimSpace(params.Name)
+	if params.Name == "" || len(params.Name) > 64 {
+		respondWithError(w, http.StatusBadRequest, "Name must be between 1 and 64 characters")
+		return
+	}
+
+	if len(params.Scopes) == 0 {
+		respondWithError(w, http.StatusBadRequest, "At least one scope is required")
+		return
+	}
+	for _, scope := range params.Scopes {
+		if !containsString(apiKeyScopes, scope) {
+			respondWithError(w, http.StatusBadRequest, "Scope "+scope+" can't be granted to an API key")
+			return
+		}
+	}
+
+	key := database.APIKey{
+		UserId: p.UserId,
+		Name:   params.Name,
+		Scopes: params.Scopes,
+	}
+	if params.ExpiresAt != nil {
+		if !params.ExpiresAt.After(time.Now()) {
+			respondWithError(w, http.StatusBadRequest, "expires_at must be in the future")
+			return
+		}
+		key.ExpiresAt = params.ExpiresAt.UTC()
+	}
+
+	plaintext, prefix, err := auth.GenerateAPIKey()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create API key")
+		return
+	}
+	key.Prefix = prefix
+	key.KeyHash = auth.HashToken(plaintext)
+
+	saved, err := api.db.CreateAPIKey(key)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create API key")
+		return
+	}
+
+	respondWithJson(w, http.StatusCreated, response{
+		apiKeyResponse: newAPIKeyResponse(saved),
+		Key:            plaintext,
+	})
+}
+
+func (api *apiConfig) handleGetAPIKeys(w http.ResponseWriter, r *http.Request) {
+	p := principalFromContext(r.Context())
+
+	keys, err := api.db.GetAPIKeysForUser(p.UserId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to read API keys from database.")
+		return
+	}
+
+	response := make([]apiKeyResponse, 0, len(keys))
+	for _, key := range keys {
+		if usedAt, ok := api.apiKeyUsage.get(key.Id); ok && usedAt.After(key.LastUsedAt) {
+			key.LastUsedAt = usedAt
+		}
+		response = append(response, newAPIKeyResponse(key))
+	}
+
+	respondWithJson(w, http.StatusOK, response)
+}
+
+func (api *apiConfig) handleRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	type response struct{}
+	p := principalFromContext(r.Context())
+
+	keyId, err := strconv.Atoi(r.PathValue("keyID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to convert parameter to integer.")
+		return
+	}
+
+	_, err = api.db.RevokeAPIKey(p.UserId, keyId)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Unable to find API key")
+		return
+	}
+
+	respondWithJson(w, http.StatusNoContent, response{})
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
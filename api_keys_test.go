@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stephenoveson/chirpy/auth"
+	"github.com/stephenoveson/chirpy/database"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newTestAPI returns an apiConfig backed by a fresh database and signing key
+// in a temporary directory, with a cheap password hasher.
+func newTestAPI(t *testing.T) *apiConfig {
+	t.Helper()
+	dir := t.TempDir()
+
+	db, err := database.NewDB(filepath.Join(dir, "db.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := auth.LoadKeySet(filepath.Join(dir, "keys"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &apiConfig{
+		db:          db,
+		keys:        keys,
+		passwords:   auth.PasswordHasher{Algorithm: auth.HashBcrypt, BcryptCost: bcrypt.MinCost},
+		apiKeyUsage: newAPIKeyUsage(),
+	}
+}
+
+func TestCredentialRoutesRefuseAPIKeysAndApps(t *testing.T) {
+	api := newTestAPI(t)
+	routes := api.routes()
+
+	user, err := api.db.CreateUser("owner@example.com", "unused")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext, prefix, err := auth.GenerateAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = api.db.CreateAPIKey(database.APIKey{
+		UserId:    user.Id,
+		Name:      "bot",
+		Prefix:    prefix,
+		KeyHash:   auth.HashToken(plaintext),
+		Scopes:    []string{auth.ScopeChirpsWrite, auth.ScopeUsersWrite},
+		CreatedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loginJWT, err := auth.MakeJWT(user.Id, []string{auth.ScopeChirpsWrite, auth.ScopeUsersWrite}, api.keys, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appJWT, err := auth.MakeClientJWT(user.Id, "partner-app", oauthScopes, api.keys, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		method        string
+		path          string
+		authorization string
+		want          int
+	}{
+		{"API key changing email", http.MethodPut, "/api/users", "ApiKey " + plaintext, http.StatusForbidden},
+		{"app changing email", http.MethodPut, "/api/users", "Bearer " + appJWT, http.StatusForbidden},
+		{"API key deleting account", http.MethodDelete, "/api/users", "ApiKey " + plaintext, http.StatusForbidden},
+		{"API key creating a key", http.MethodPost, "/api/keys", "ApiKey " + plaintext, http.StatusForbidden},
+		{"API key listing keys", http.MethodGet, "/api/keys", "ApiKey " + plaintext, http.StatusForbidden},
+		{"API key revoking a key", http.MethodDelete, "/api/keys/1", "ApiKey " + plaintext, http.StatusForbidden},
+		{"API key enrolling TOTP", http.MethodPost, "/api/users/totp", "ApiKey " + plaintext, http.StatusForbidden},
+		{"login changing email", http.MethodPut, "/api/users", "Bearer " + loginJWT, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"email": "attacker@example.com", "password": "correct horse battery staple"}`
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(body))
+			req.Header.Set("Authorization", tt.authorization)
+			rec := httptest.NewRecorder()
+
+			routes.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Errorf("%s %s = %d, want %d: %s", tt.method, tt.path, rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+
+	changed, err := api.db.GetUserById(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed.Email != "attacker@example.com" {
+		t.Errorf("email = %s, want the change made by logging in", changed.Email)
+	}
+}
@@ -2,68 +2,216 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
-	"golang.org/x/crypto/bcrypt"
 )
 
-func HashPassword(password string) (string, error) {
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+const (
+	ScopeChirpsWrite = "chirps:write"
+	ScopeUsersWrite  = "users:write"
+	ScopeAdmin       = "admin"
+
+	AudienceAPI   = "chirpy-api"
+	AudienceMFA   = "chirpy-mfa"
+	AudienceMagic = "chirpy-magic-link"
+
+	issuer = "chirpy"
+)
+
+// DefaultUserScopes are granted to a user who logs in with their password.
+var DefaultUserScopes = []string{ScopeChirpsWrite, ScopeUsersWrite}
+
+// Claims are the JWT claims Chirpy issues. Scope is a space separated list
+// in the style of OAuth 2.0 so other services can read it without Chirpy
+// specific parsing.
+type Claims struct {
+	Scope    string `json:"scope,omitempty"`
+	ClientId string `json:"client_id,omitempty"`
+	Nonce    string `json:"nonce,omitempty"`
+	jwt.RegisteredClaims
+}
+
+func (c Claims) Scopes() []string {
+	return strings.Fields(c.Scope)
+}
+
+func (c Claims) HasScope(scope string) bool {
+	for _, s := range c.Scopes() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Claims) UserId() (int, error) {
+	return strconv.Atoi(c.Subject)
+}
+
+func MakeJWT(userId int, scopes []string, keys *KeySet, expiresIn time.Duration) (string, error) {
+	return MakeClientJWT(userId, "", scopes, keys, expiresIn)
+}
+
+// MakeClientJWT issues an access token to an OAuth client acting on behalf
+// of userId. An empty clientId makes a first-party token.
+func MakeClientJWT(userId int, clientId string, scopes []string, keys *KeySet, expiresIn time.Duration) (string, error) {
+	tokenId, err := randomHex(16)
 	if err != nil {
 		return "", err
 	}
 
-	return string(hash), nil
+	now := time.Now().UTC()
+	return signClaims(keys, Claims{
+		Scope:    strings.Join(scopes, " "),
+		ClientId: clientId,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer,
+			Audience:  jwt.ClaimStrings{AudienceAPI},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(expiresIn)),
+			Subject:   fmt.Sprintf("%d", userId),
+			ID:        tokenId,
+		},
+	})
 }
 
-func CheckPasswordHash(password, hash string) error {
-	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+func ValidateJWT(tokenString string, keys *KeySet) (Claims, error) {
+	return parseClaims(tokenString, keys, AudienceAPI)
 }
 
-func MakeJWT(userId int, tokenSecret string, expiresIn time.Duration) (string, error) {
-	signingKey := []byte(tokenSecret)
+// AccountChecker reports whether the account a token was issued to may
+// still use it, returning an error describing why not.
+type AccountChecker interface {
+	CheckAccount(userId int) error
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    "chirpy",
-		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().Add(expiresIn).UTC()),
-		Subject:   fmt.Sprintf("%d", userId),
-	})
+// ValidateAccessJWT is ValidateJWT for tokens presented to access the API.
+// Once the token itself checks out, accounts is asked about its subject so
+// a suspension takes effect even for tokens that haven't expired. The
+// checker's error is returned unwrapped so callers can inspect it.
+func ValidateAccessJWT(tokenString string, keys *KeySet, accounts AccountChecker) (Claims, error) {
+	claims, err := ValidateJWT(tokenString, keys)
+	if err != nil {
+		return Claims{}, err
+	}
 
-	return token.SignedString(signingKey)
+	userId, err := claims.UserId()
+	if err != nil {
+		return Claims{}, err
+	}
+
+	err = accounts.CheckAccount(userId)
+	if err != nil {
+		return Claims{}, err
+	}
+
+	return claims, nil
 }
 
-func ValidateJWT(tokenString, tokenSecret string) (string, error) {
-	claimsStruct := jwt.RegisteredClaims{}
-	token, err := jwt.ParseWithClaims(tokenString, &claimsStruct, func(t *jwt.Token) (interface{}, error) {
-		return []byte(tokenSecret), nil
+// MakeChallengeJWT issues the token returned by the password step of a two
+// factor login. It is only accepted by ValidateChallengeJWT, never as an
+// access token.
+func MakeChallengeJWT(userId int, keys *KeySet, expiresIn time.Duration) (string, error) {
+	tokenId, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().UTC()
+	return signClaims(keys, Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer,
+			Audience:  jwt.ClaimStrings{AudienceMFA},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(expiresIn)),
+			Subject:   fmt.Sprintf("%d", userId),
+			ID:        tokenId,
+		},
 	})
+}
+
+func ValidateChallengeJWT(tokenString string, keys *KeySet) (Claims, error) {
+	return parseClaims(tokenString, keys, AudienceMFA)
+}
 
+// MakeMagicLinkJWT signs the token embedded in a login link. nonceHash binds
+// it to the browser that asked for the link.
+func MakeMagicLinkJWT(userId int, nonceHash string, keys *KeySet, expiresIn time.Duration) (Claims, string, error) {
+	tokenId, err := randomHex(16)
 	if err != nil {
-		return "", err
+		return Claims{}, "", err
+	}
+
+	now := time.Now().UTC()
+	claims := Claims{
+		Nonce: nonceHash,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer,
+			Audience:  jwt.ClaimStrings{AudienceMagic},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(expiresIn)),
+			Subject:   fmt.Sprintf("%d", userId),
+			ID:        tokenId,
+		},
 	}
 
-	userIdString, err := token.Claims.GetSubject()
+	token, err := signClaims(keys, claims)
+	return claims, token, err
+}
+
+func ValidateMagicLinkJWT(tokenString string, keys *KeySet) (Claims, error) {
+	return parseClaims(tokenString, keys, AudienceMagic)
+}
+
+// GenerateNonce returns a random value for binding a flow to one browser.
+func GenerateNonce() (string, error) {
+	return randomHex(32)
+}
+
+func signClaims(keys *KeySet, claims Claims) (string, error) {
+	signingKey, err := keys.signingKey()
 	if err != nil {
 		return "", err
 	}
 
-	issuer, err := token.Claims.GetIssuer()
+	token := jwt.NewWithClaims(signingKey.Method, claims)
+	token.Header["kid"] = signingKey.Id
+
+	return token.SignedString(signingKey.Private)
+}
+
+func parseClaims(tokenString string, keys *KeySet, audience string) (Claims, error) {
+	claims := Claims{}
+	_, err := jwt.ParseWithClaims(
+		tokenString,
+		&claims,
+		keys.verificationKey,
+		jwt.WithValidMethods([]string{AlgorithmEdDSA, AlgorithmRS256}),
+		jwt.WithIssuer(issuer),
+		jwt.WithAudience(audience),
+		jwt.WithExpirationRequired(),
+	)
 	if err != nil {
-		return "", err
+		return Claims{}, err
+	}
+
+	if claims.ID == "" {
+		return Claims{}, errors.New("token is missing a jti")
 	}
 
-	if issuer != string("chirpy") {
-		return "", errors.New("invalid issuer")
+	if _, err := claims.UserId(); err != nil {
+		return Claims{}, errors.New("token has an invalid subject")
 	}
 
-	return userIdString, nil
+	return claims, nil
 }
 
 func GetBearerToken(headers http.Header) (string, error) {
@@ -94,14 +242,38 @@ func GetApiKey(headers http.Header) (string, error) {
 	return apiKey, nil
 }
 
+const apiKeyPrefix = "chirpy_"
+
+// GenerateAPIKey returns a new personal API key and the short prefix that
+// identifies it in listings without revealing the secret part.
+func GenerateAPIKey() (string, string, error) {
+	secret, err := randomHex(24)
+	if err != nil {
+		return "", "", err
+	}
+
+	key := apiKeyPrefix + secret
+	return key, key[:len(apiKeyPrefix)+8], nil
+}
+
 func GetRefreshToken() (string, error) {
-	byteLength := 32
+	return randomHex(32)
+}
+
+func randomHex(byteLength int) (string, error) {
 	byteSlice := make([]byte, byteLength)
 	_, err := rand.Read(byteSlice)
 	if err != nil {
 		return "", err
 	}
-	refreshToken := hex.EncodeToString(byteSlice)
 
-	return refreshToken, nil
+	return hex.EncodeToString(byteSlice), nil
+}
+
+// HashToken returns the value high-entropy secrets such as refresh tokens
+// are stored and looked up by, so a leaked database doesn't hand out usable
+// credentials.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
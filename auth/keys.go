@@ -0,0 +1,336 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	AlgorithmEdDSA = "EdDSA"
+	AlgorithmRS256 = "RS256"
+
+	pemCreatedHeader = "Created"
+)
+
+// SigningKey is one private key from the key directory. Its Id is the file
+// name without the .pem extension and is published as the JWT `kid`.
+type SigningKey struct {
+	Id        string
+	CreatedAt time.Time
+	Private   crypto.Signer
+	Method    jwt.SigningMethod
+}
+
+// KeySet holds every key in a directory. The newest key signs new tokens;
+// older keys stay around so tokens they signed can still be verified until
+// the rotation command prunes them.
+type KeySet struct {
+	dir  string
+	mux  *sync.RWMutex
+	keys []SigningKey
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// LoadKeySet reads every .pem file in dir, generating a first key with
+// algorithm when the directory is empty.
+func LoadKeySet(dir, algorithm string) (*KeySet, error) {
+	ks := &KeySet{
+		dir: dir,
+		mux: &sync.RWMutex{},
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ks.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ks.keys) == 0 {
+		_, err = ks.Rotate(algorithm)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ks, nil
+}
+
+// Reload re-reads the key directory so keys added or pruned by another
+// process are picked up without a restart.
+func (ks *KeySet) Reload() error {
+	paths, err := filepath.Glob(filepath.Join(ks.dir, "*.pem"))
+	if err != nil {
+		return err
+	}
+
+	keys := make([]SigningKey, 0, len(paths))
+	for _, path := range paths {
+		key, err := readSigningKey(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		keys = append(keys, key)
+	}
+
+	sortSigningKeys(keys)
+
+	ks.mux.Lock()
+	defer ks.mux.Unlock()
+	ks.keys = keys
+
+	return nil
+}
+
+// Rotate generates a new key that immediately becomes the signing key.
+func (ks *KeySet) Rotate(algorithm string) (SigningKey, error) {
+	key, err := generateSigningKey(algorithm)
+	if err != nil {
+		return SigningKey{}, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key.Private)
+	if err != nil {
+		return SigningKey{}, err
+	}
+
+	block := &pem.Block{
+		Type:    "PRIVATE KEY",
+		Headers: map[string]string{pemCreatedHeader: key.CreatedAt.Format(time.RFC3339Nano)},
+		Bytes:   der,
+	}
+
+	path := filepath.Join(ks.dir, key.Id+".pem")
+	err = os.WriteFile(path, pem.EncodeToMemory(block), 0600)
+	if err != nil {
+		return SigningKey{}, err
+	}
+
+	ks.mux.Lock()
+	defer ks.mux.Unlock()
+	ks.keys = append(ks.keys, key)
+	sortSigningKeys(ks.keys)
+
+	return key, nil
+}
+
+// sortSigningKeys orders keys oldest first, so the last one signs. Keys
+// created at the same moment, such as those written before creation times
+// kept fractions of a second, are ordered by id so every process and every
+// reload picks the same signing key.
+func sortSigningKeys(keys []SigningKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].Id < keys[j].Id
+		}
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+}
+
+// Prune deletes keys that stopped signing more than retention ago. A key
+// stops signing when the next newer key is created, so retention should be
+// at least the lifetime of the longest-lived token.
+func (ks *KeySet) Prune(retention time.Duration) ([]string, error) {
+	ks.mux.Lock()
+	defer ks.mux.Unlock()
+
+	cutoff := time.Now().Add(-retention)
+	kept := make([]SigningKey, 0, len(ks.keys))
+	removed := []string{}
+	for i, key := range ks.keys {
+		isCurrent := i == len(ks.keys)-1
+		if isCurrent || ks.keys[i+1].CreatedAt.After(cutoff) {
+			kept = append(kept, key)
+			continue
+		}
+
+		err := os.Remove(filepath.Join(ks.dir, key.Id+".pem"))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return removed, err
+		}
+		removed = append(removed, key.Id)
+	}
+	ks.keys = kept
+
+	return removed, nil
+}
+
+// JWKS returns the public half of every key so other services can verify
+// tokens without holding the private keys.
+func (ks *KeySet) JWKS() JWKS {
+	ks.mux.RLock()
+	defer ks.mux.RUnlock()
+
+	set := JWKS{Keys: make([]JWK, 0, len(ks.keys))}
+	for _, key := range ks.keys {
+		jwk := JWK{
+			Kid: key.Id,
+			Use: "sig",
+			Alg: key.Method.Alg(),
+		}
+
+		switch pub := key.Private.Public().(type) {
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		default:
+			continue
+		}
+
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	return set
+}
+
+func (ks *KeySet) signingKey() (SigningKey, error) {
+	ks.mux.RLock()
+	defer ks.mux.RUnlock()
+
+	if len(ks.keys) == 0 {
+		return SigningKey{}, errors.New("no signing keys loaded")
+	}
+
+	return ks.keys[len(ks.keys)-1], nil
+}
+
+func (ks *KeySet) verificationKey(t *jwt.Token) (interface{}, error) {
+	kid, ok := t.Header["kid"].(string)
+	if !ok || kid == "" {
+		return nil, errors.New("token is missing a key id")
+	}
+
+	ks.mux.RLock()
+	defer ks.mux.RUnlock()
+
+	for _, key := range ks.keys {
+		if key.Id != kid {
+			continue
+		}
+		if t.Method.Alg() != key.Method.Alg() {
+			return nil, errors.New("token algorithm does not match key")
+		}
+		return key.Private.Public(), nil
+	}
+
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+func generateSigningKey(algorithm string) (SigningKey, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return SigningKey{}, err
+	}
+
+	key := SigningKey{
+		Id:        id,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	switch algorithm {
+	case AlgorithmEdDSA, "":
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return SigningKey{}, err
+		}
+		key.Private = private
+		key.Method = jwt.SigningMethodEdDSA
+	case AlgorithmRS256:
+		private, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return SigningKey{}, err
+		}
+		key.Private = private
+		key.Method = jwt.SigningMethodRS256
+	default:
+		return SigningKey{}, fmt.Errorf("unsupported signing algorithm %q", algorithm)
+	}
+
+	return key, nil
+}
+
+func readSigningKey(path string) (SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return SigningKey{}, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return SigningKey{}, errors.New("no PEM block found")
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return SigningKey{}, err
+	}
+
+	key := SigningKey{
+		Id: strings.TrimSuffix(filepath.Base(path), ".pem"),
+	}
+
+	switch private := parsed.(type) {
+	case ed25519.PrivateKey:
+		key.Private = private
+		key.Method = jwt.SigningMethodEdDSA
+	case *rsa.PrivateKey:
+		key.Private = private
+		key.Method = jwt.SigningMethodRS256
+	default:
+		return SigningKey{}, errors.New("unsupported private key type")
+	}
+
+	created, ok := block.Headers[pemCreatedHeader]
+	if ok {
+		key.CreatedAt, err = time.Parse(time.RFC3339, created)
+		if err != nil {
+			return SigningKey{}, err
+		}
+	} else {
+		info, err := os.Stat(path)
+		if err != nil {
+			return SigningKey{}, err
+		}
+		key.CreatedAt = info.ModTime().UTC()
+	}
+
+	return key, nil
+}
@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRotateSigningKeyWithinOneSecond(t *testing.T) {
+	dir := t.TempDir()
+	ks, err := LoadKeySet(dir, AlgorithmEdDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var newest SigningKey
+	for i := 0; i < 3; i++ {
+		newest, err = ks.Rotate(AlgorithmEdDSA)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		signing, err := ks.signingKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if signing.Id != newest.Id {
+			t.Fatalf("signing key = %s, want the newest key %s", signing.Id, newest.Id)
+		}
+
+		err = ks.Reload()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReloadOrdersKeysCreatedTogetherById(t *testing.T) {
+	dir := t.TempDir()
+	ks, err := LoadKeySet(dir, AlgorithmEdDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ks.Rotate(AlgorithmEdDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys written before creation times kept fractions of a second.
+	created := time.Now().UTC().Truncate(time.Second).Format(time.RFC3339)
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, _ := pem.Decode(data)
+		block.Headers[pemCreatedHeader] = created
+		err = os.WriteFile(path, pem.EncodeToMemory(block), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := filepath.Base(paths[0])
+	for _, path := range paths {
+		if filepath.Base(path) > want {
+			want = filepath.Base(path)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		err = ks.Reload()
+		if err != nil {
+			t.Fatal(err)
+		}
+		signing, err := ks.signingKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if signing.Id+".pem" != want {
+			t.Fatalf("signing key = %s, want %s", signing.Id+".pem", want)
+		}
+	}
+}
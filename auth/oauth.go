@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"regexp"
+)
+
+// pkceVerifierPattern is the code_verifier grammar from RFC 7636 section 4.1.
+var pkceVerifierPattern = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+
+// VerifyPKCE checks an S256 code_verifier against the code_challenge sent
+// to the authorization endpoint. The plain method isn't supported.
+func VerifyPKCE(verifier, challenge string) bool {
+	if !pkceVerifierPattern.MatchString(verifier) {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// GenerateOAuthClientCredentials returns a new client id and secret.
+func GenerateOAuthClientCredentials() (string, string, error) {
+	clientId, err := randomHex(12)
+	if err != nil {
+		return "", "", err
+	}
+
+	secret, err := randomHex(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	return clientId, secret, nil
+}
+
+// GenerateAuthorizationCode returns a single-use OAuth authorization code.
+func GenerateAuthorizationCode() (string, error) {
+	return randomHex(32)
+}
+
+// CheckSecretHash compares a presented secret with the HashToken of the
+// stored one in constant time.
+func CheckSecretHash(secret, hash string) bool {
+	return subtle.ConstantTimeCompare([]byte(HashToken(secret)), []byte(hash)) == 1
+}
@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVerifyPKCE(t *testing.T) {
+	// From RFC 7636 appendix B.
+	const verifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	const challenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+	tests := []struct {
+		name      string
+		verifier  string
+		challenge string
+		want      bool
+	}{
+		{"RFC 7636 example", verifier, challenge, true},
+		{"wrong verifier", strings.Replace(verifier, "d", "e", 1), challenge, false},
+		{"plain method", verifier, verifier, false},
+		{"padded challenge", verifier, challenge + "=", false},
+		{"standard base64 challenge", verifier, strings.NewReplacer("-", "+", "_", "/").Replace(challenge), false},
+		{"empty challenge", verifier, "", false},
+		{"empty verifier", "", challenge, false},
+		{"verifier too short", verifier[:42], challenge, false},
+		{"verifier too long", strings.Repeat("a", 129), challenge, false},
+		{"verifier with invalid characters", verifier[:42] + "+", challenge, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := VerifyPKCE(tt.verifier, tt.challenge); got != tt.want {
+				t.Errorf("VerifyPKCE() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyPKCELengthBounds(t *testing.T) {
+	// The shortest and longest verifiers the RFC allows, with challenges
+	// worked out from them.
+	tests := []struct {
+		verifier  string
+		challenge string
+	}{
+		{strings.Repeat("a", 43), "ZtNPunH49FD35FWYhT5Tv8I7vRKQJ8uxMaL0_9eHjNA"},
+		{strings.Repeat("a", 128), "aDbPE7rEAOkQUHHNavRwhN-srU5eMCyUv-0k4BOvtz4"},
+	}
+
+	for _, tt := range tests {
+		if !VerifyPKCE(tt.verifier, tt.challenge) {
+			t.Errorf("VerifyPKCE() rejected a %d character verifier", len(tt.verifier))
+		}
+	}
+}
+
+func TestCheckSecretHash(t *testing.T) {
+	hash := HashToken("client-secret")
+
+	tests := []struct {
+		secret string
+		want   bool
+	}{
+		{"client-secret", true},
+		{"client-secreT", false},
+		{"", false},
+		{hash, false},
+	}
+
+	for _, tt := range tests {
+		if got := CheckSecretHash(tt.secret, hash); got != tt.want {
+			t.Errorf("CheckSecretHash(%q) = %v, want %v", tt.secret, got, tt.want)
+		}
+	}
+}
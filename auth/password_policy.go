@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// PasswordPolicy rejects passwords that are too short, too long or appear
+// in a local list of breached passwords.
+type PasswordPolicy struct {
+	MinLength int
+	MaxLength int
+	breached  map[string]struct{}
+}
+
+// LoadBreachedPasswords reads a breached password list with one entry per
+// line. Entries may be plaintext passwords or upper or lower case SHA-1
+// hashes, optionally followed by ":count" as in the Have I Been Pwned
+// downloads. Blank lines and lines starting with # are ignored.
+func (p *PasswordPolicy) LoadBreachedPasswords(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if p.breached == nil {
+		p.breached = map[string]struct{}{}
+	}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		entry, _, _ := strings.Cut(line, ":")
+		if isSHA1Hex(entry) {
+			p.breached[strings.ToUpper(entry)] = struct{}{}
+			continue
+		}
+		p.breached[breachedKey(line)] = struct{}{}
+	}
+
+	return scanner.Err()
+}
+
+func (p PasswordPolicy) Validate(password string) error {
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		return fmt.Errorf("password must be at least %d characters", p.MinLength)
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		return fmt.Errorf("password must be at most %d characters", p.MaxLength)
+	}
+
+	if _, ok := p.breached[breachedKey(password)]; ok {
+		return errors.New("password has appeared in a data breach, choose another")
+	}
+
+	return nil
+}
+
+func breachedKey(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func isSHA1Hex(s string) bool {
+	if len(s) != sha1.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Cheap parameters keep the tests fast; only their relative strength
+// matters here.
+var (
+	testArgon2 = Argon2Params{Memory: 1024, Iterations: 2, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+	testArgon2Hasher = PasswordHasher{Algorithm: HashArgon2id, Argon2: testArgon2, BcryptCost: bcrypt.MinCost}
+	testBcryptHasher = PasswordHasher{Algorithm: HashBcrypt, Argon2: testArgon2, BcryptCost: bcrypt.MinCost}
+)
+
+func mustHash(t *testing.T, h PasswordHasher, password string) string {
+	t.Helper()
+	hash, err := h.HashPassword(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestParseArgon2id(t *testing.T) {
+	tests := []struct {
+		name    string
+		hash    string
+		want    Argon2Params
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			hash: "$argon2id$v=19$m=65536,t=3,p=2$c29tZXNhbHRzb21lc2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U",
+			want: Argon2Params{Memory: 65536, Iterations: 3, Parallelism: 2, SaltLength: 16, KeyLength: 29},
+		},
+		{name: "too few fields", hash: "$argon2id$v=19$m=65536,t=3,p=2$c29tZXNhbHQ", wantErr: true},
+		{name: "too many fields", hash: "$argon2id$v=19$m=65536,t=3,p=2$c29tZXNhbHQ$a2V5$a2V5", wantErr: true},
+		{name: "old version", hash: "$argon2id$v=16$m=65536,t=3,p=2$c29tZXNhbHQ$a2V5", wantErr: true},
+		{name: "missing version", hash: "$argon2id$m=65536,t=3,p=2$c29tZXNhbHQ$a2V5$", wantErr: true},
+		{name: "bad parameters", hash: "$argon2id$v=19$m=lots,t=3,p=2$c29tZXNhbHQ$a2V5", wantErr: true},
+		{name: "bad salt", hash: "$argon2id$v=19$m=65536,t=3,p=2$not*base64$a2V5", wantErr: true},
+		{name: "bad key", hash: "$argon2id$v=19$m=65536,t=3,p=2$c29tZXNhbHQ$not*base64", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, _, _, err := parseArgon2id(tt.hash)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseArgon2id() accepted %q", tt.hash)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseArgon2id() error = %v", err)
+			}
+			if params != tt.want {
+				t.Errorf("parseArgon2id() = %+v, want %+v", params, tt.want)
+			}
+		})
+	}
+}
+
+func TestHashPasswordArgon2idRoundTrip(t *testing.T) {
+	hash := mustHash(t, testArgon2Hasher, "correct horse")
+
+	params, salt, key, err := parseArgon2id(hash)
+	if err != nil {
+		t.Fatalf("parseArgon2id(HashPassword()) error = %v", err)
+	}
+	if params != testArgon2 {
+		t.Errorf("parsed params = %+v, want %+v", params, testArgon2)
+	}
+	if len(salt) != int(testArgon2.SaltLength) || len(key) != int(testArgon2.KeyLength) {
+		t.Errorf("salt and key are %d and %d bytes, want %d and %d", len(salt), len(key), testArgon2.SaltLength, testArgon2.KeyLength)
+	}
+
+	if other := mustHash(t, testArgon2Hasher, "correct horse"); other == hash {
+		t.Errorf("HashPassword() gave the same hash twice, so the salt isn't random")
+	}
+}
+
+func TestCheckPasswordHash(t *testing.T) {
+	weakArgon2Hasher := testArgon2Hasher
+	weakArgon2Hasher.Argon2.Iterations = 1
+	strongBcryptHasher := testBcryptHasher
+	strongBcryptHasher.BcryptCost = bcrypt.MinCost + 1
+	strongArgon2Hasher := testArgon2Hasher
+	strongArgon2Hasher.BcryptCost = bcrypt.MinCost + 1
+
+	argon2Hash := mustHash(t, testArgon2Hasher, "correct horse")
+	weakArgon2Hash := mustHash(t, weakArgon2Hasher, "correct horse")
+	bcryptHash := mustHash(t, testBcryptHasher, "correct horse")
+
+	tests := []struct {
+		name       string
+		hasher     PasswordHasher
+		password   string
+		hash       string
+		wantRehash bool
+		wantErr    error
+	}{
+		{name: "argon2id", hasher: testArgon2Hasher, password: "correct horse", hash: argon2Hash},
+		{name: "argon2id wrong password", hasher: testArgon2Hasher, password: "battery staple", hash: argon2Hash, wantErr: ErrPasswordMismatch},
+		{name: "argon2id weaker parameters", hasher: testArgon2Hasher, password: "correct horse", hash: weakArgon2Hash, wantRehash: true},
+		{name: "argon2id stronger parameters", hasher: weakArgon2Hasher, password: "correct horse", hash: argon2Hash},
+		{name: "argon2id configured for bcrypt", hasher: testBcryptHasher, password: "correct horse", hash: argon2Hash, wantRehash: true},
+		{name: "bcrypt fallback", hasher: testArgon2Hasher, password: "correct horse", hash: bcryptHash, wantRehash: true},
+		{name: "bcrypt fallback wrong password", hasher: testArgon2Hasher, password: "battery staple", hash: bcryptHash, wantErr: ErrPasswordMismatch},
+		{name: "bcrypt fallback ignores bcrypt cost", hasher: strongArgon2Hasher, password: "correct horse", hash: bcryptHash, wantRehash: true},
+		{name: "bcrypt", hasher: testBcryptHasher, password: "correct horse", hash: bcryptHash},
+		{name: "bcrypt lower cost", hasher: strongBcryptHasher, password: "correct horse", hash: bcryptHash, wantRehash: true},
+		{name: "bcrypt wrong password", hasher: testBcryptHasher, password: "battery staple", hash: bcryptHash, wantErr: ErrPasswordMismatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rehash, err := tt.hasher.CheckPasswordHash(tt.password, tt.hash)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("CheckPasswordHash() error = %v, want %v", err, tt.wantErr)
+			}
+			if rehash != tt.wantRehash {
+				t.Errorf("CheckPasswordHash() rehash = %v, want %v", rehash, tt.wantRehash)
+			}
+		})
+	}
+}
+
+func TestCheckPasswordHashMalformed(t *testing.T) {
+	for _, hash := range []string{"", "plaintext", "$argon2id$v=19$broken", "$2a$10$tooshort"} {
+		_, err := testArgon2Hasher.CheckPasswordHash("correct horse", hash)
+		if err == nil || errors.Is(err, ErrPasswordMismatch) {
+			t.Errorf("CheckPasswordHash(%q) error = %v, want a malformed hash error", hash, err)
+		}
+	}
+}
+
+func TestPasswordHasherValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		hasher  PasswordHasher
+		wantErr bool
+	}{
+		{name: "default", hasher: DefaultPasswordHasher},
+		{name: "bcrypt", hasher: testBcryptHasher},
+		{name: "unknown algorithm", hasher: PasswordHasher{Algorithm: "md5"}, wantErr: true},
+		{name: "zero memory", hasher: PasswordHasher{Algorithm: HashArgon2id, Argon2: Argon2Params{Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}}, wantErr: true},
+		{name: "short salt", hasher: PasswordHasher{Algorithm: HashArgon2id, Argon2: Argon2Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 4, KeyLength: 32}}, wantErr: true},
+		{name: "bcrypt cost too low", hasher: PasswordHasher{Algorithm: HashBcrypt, BcryptCost: bcrypt.MinCost - 1}, wantErr: true},
+		{name: "bcrypt cost too high", hasher: PasswordHasher{Algorithm: HashBcrypt, BcryptCost: bcrypt.MaxCost + 1}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.hasher.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
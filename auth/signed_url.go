@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var ErrSignedURLInvalid = errors.New("link is invalid or has expired")
+
+// SignPath returns path with expires and signature query parameters that
+// prove the link was issued by this server and stop working after expires.
+func SignPath(secret []byte, path string, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+
+	query := url.Values{}
+	query.Set("expires", exp)
+	query.Set("signature", pathSignature(secret, path, exp))
+
+	return path + "?" + query.Encode()
+}
+
+// VerifySignedPath checks the expires and signature query parameters that
+// SignPath added to path.
+func VerifySignedPath(secret []byte, path string, query url.Values, now time.Time) error {
+	exp := query.Get("expires")
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || now.Unix() > expires {
+		return ErrSignedURLInvalid
+	}
+
+	expected := pathSignature(secret, path, exp)
+	if !hmac.Equal([]byte(expected), []byte(query.Get("signature"))) {
+		return ErrSignedURLInvalid
+	}
+
+	return nil
+}
+
+func pathSignature(secret []byte, path, expires string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(path + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
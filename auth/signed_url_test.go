@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignPath(t *testing.T) {
+	// Worked out independently with
+	// printf '/api/exports/7/download\n1700000000' | openssl dgst -sha256 -hmac url_secret
+	const want = "/api/exports/7/download?expires=1700000000&signature=9b663fc1c161e2f2173407aeef5bbb6ddf0600ba39e7407f3a8ba3db6cfa29cf"
+
+	got := SignPath([]byte("url_secret"), "/api/exports/7/download", time.Unix(1700000000, 0))
+	if got != want {
+		t.Errorf("SignPath() = %s, want %s", got, want)
+	}
+}
+
+func TestVerifySignedPath(t *testing.T) {
+	secret := []byte("url_secret")
+	const path = "/api/exports/7/download"
+	expires := time.Unix(1700000000, 0)
+
+	signed, err := url.Parse(SignPath(secret, path, expires))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := signed.Query()
+
+	with := func(key, value string) url.Values {
+		q := url.Values{}
+		for k, v := range query {
+			q[k] = v
+		}
+		if value == "" {
+			q.Del(key)
+		} else {
+			q.Set(key, value)
+		}
+		return q
+	}
+
+	tests := []struct {
+		name    string
+		secret  []byte
+		path    string
+		query   url.Values
+		now     time.Time
+		wantErr bool
+	}{
+		{name: "valid", secret: secret, path: path, query: query, now: expires.Add(-time.Hour)},
+		{name: "at expiry", secret: secret, path: path, query: query, now: expires},
+		{name: "expired", secret: secret, path: path, query: query, now: expires.Add(time.Second), wantErr: true},
+		{name: "other secret", secret: []byte("other_secret"), path: path, query: query, now: expires.Add(-time.Hour), wantErr: true},
+		{name: "other path", secret: secret, path: "/api/exports/8/download", query: query, now: expires.Add(-time.Hour), wantErr: true},
+		{name: "extended expiry", secret: secret, path: path, query: with("expires", "1800000000"), now: expires.Add(-time.Hour), wantErr: true},
+		{name: "missing expiry", secret: secret, path: path, query: with("expires", ""), now: expires.Add(-time.Hour), wantErr: true},
+		{name: "non-numeric expiry", secret: secret, path: path, query: with("expires", "soon"), now: expires.Add(-time.Hour), wantErr: true},
+		{name: "tampered signature", secret: secret, path: path, query: with("signature", strings.Repeat("0", 64)), now: expires.Add(-time.Hour), wantErr: true},
+		{name: "missing signature", secret: secret, path: path, query: with("signature", ""), now: expires.Add(-time.Hour), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifySignedPath(tt.secret, tt.path, tt.query, tt.now)
+			if tt.wantErr && !errors.Is(err, ErrSignedURLInvalid) {
+				t.Errorf("VerifySignedPath() error = %v, want %v", err, ErrSignedURLInvalid)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("VerifySignedPath() error = %v", err)
+			}
+		})
+	}
+}
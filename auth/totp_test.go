@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA1 seed from RFC 6238 appendix B,
+// "12345678901234567890", in base32.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestValidateTOTP(t *testing.T) {
+	// The RFC lists 8 digit codes; ours are their last 6 digits.
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, v := range vectors {
+		now := time.Unix(v.unix, 0)
+		step, ok := ValidateTOTP(rfc6238Secret, v.code, now, 0)
+		if !ok {
+			t.Errorf("ValidateTOTP(%d, %s) rejected the RFC 6238 code", v.unix, v.code)
+			continue
+		}
+		if step != v.unix/totpPeriod {
+			t.Errorf("ValidateTOTP(%d, %s) step = %d, want %d", v.unix, v.code, step, v.unix/totpPeriod)
+		}
+	}
+}
+
+func TestValidateTOTPWindow(t *testing.T) {
+	// 1111111111 is step 37037037, whose code is 050471.
+	const code = "050471"
+	const step = 37037037
+
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		now      int64
+		lastStep int64
+		wantOk   bool
+	}{
+		{"current step", rfc6238Secret, code, step * totpPeriod, 0, true},
+		{"one step late", rfc6238Secret, code, (step + 1) * totpPeriod, 0, true},
+		{"one step early", rfc6238Secret, code, (step - 1) * totpPeriod, 0, true},
+		{"two steps late", rfc6238Secret, code, (step + 2) * totpPeriod, 0, false},
+		{"two steps early", rfc6238Secret, code, (step - 2) * totpPeriod, 0, false},
+		{"spaces in code", rfc6238Secret, "050 471", step * totpPeriod, 0, true},
+		{"lower case secret", "gezdgnbvgy3tqojqgezdgnbvgy3tqojq", code, step * totpPeriod, 0, true},
+		{"step already used", rfc6238Secret, code, step * totpPeriod, step, false},
+		{"later step used", rfc6238Secret, code, step * totpPeriod, step + 1, false},
+		{"earlier step used", rfc6238Secret, code, step * totpPeriod, step - 1, true},
+		{"wrong code", rfc6238Secret, "050472", step * totpPeriod, 0, false},
+		{"empty code", rfc6238Secret, "", step * totpPeriod, 0, false},
+		{"invalid secret", "not base32!", code, step * totpPeriod, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := ValidateTOTP(tt.secret, tt.code, time.Unix(tt.now, 0), tt.lastStep)
+			if ok != tt.wantOk {
+				t.Fatalf("ValidateTOTP() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if ok && got != step {
+				t.Errorf("ValidateTOTP() step = %d, want %d", got, step)
+			}
+		})
+	}
+}
+
+func TestGeneratedTOTPSecretValidates(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatalf("GenerateTOTPSecret() isn't unpadded base32: %v", err)
+	}
+
+	now := time.Now()
+	code := totpCode(key, now.Unix()/totpPeriod)
+	if _, ok := ValidateTOTP(secret, code, now, 0); !ok {
+		t.Errorf("ValidateTOTP() rejected a code for a generated secret")
+	}
+}
+
+func TestNormalizeRecoveryCode(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+	}{
+		{"3f9a-c2e1-77b0-d415", "3f9ac2e177b0d415"},
+		{"3F9A-C2E1-77B0-D415", "3f9ac2e177b0d415"},
+		{" 3f9a c2e1 77b0 d415 ", "3f9ac2e177b0d415"},
+		{"3f9ac2e177b0d415", "3f9ac2e177b0d415"},
+	}
+
+	for _, tt := range tests {
+		if got := NormalizeRecoveryCode(tt.code); got != tt.want {
+			t.Errorf("NormalizeRecoveryCode(%q) = %q, want %q", tt.code, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrWebhookSignature = errors.New("webhook signature doesn't match")
+	ErrWebhookTimestamp = errors.New("webhook timestamp is missing or outside the tolerance")
+)
+
+// SignWebhook returns the signature of a webhook body sent at timestamp, as
+// it appears in a signature header: "v1=" and a hex HMAC-SHA256 of the unix
+// timestamp, a dot and the raw body.
+func SignWebhook(secret []byte, timestamp time.Time, body []byte) string {
+	return "v1=" + webhookSignature(secret, strconv.FormatInt(timestamp.Unix(), 10), body)
+}
+
+// VerifyWebhook checks a webhook body against its timestamp and signature
+// headers. The signature header may carry several comma separated
+// signatures, and any of them made with any of secrets is accepted, so both
+// sides can rotate secrets without dropping events. Timestamps further than
+// tolerance from now are refused to limit replays.
+func VerifyWebhook(secrets [][]byte, timestampHeader, signatureHeader string, body []byte, now time.Time, tolerance time.Duration) error {
+	sent, err := strconv.ParseInt(timestampHeader, 10, 64)
+	if err != nil {
+		return ErrWebhookTimestamp
+	}
+	age := now.Sub(time.Unix(sent, 0))
+	if age > tolerance || age < -tolerance {
+		return ErrWebhookTimestamp
+	}
+
+	for _, secret := range secrets {
+		expected := []byte(webhookSignature(secret, timestampHeader, body))
+		for _, signature := range strings.Split(signatureHeader, ",") {
+			signature, ok := strings.CutPrefix(strings.TrimSpace(signature), "v1=")
+			if ok && hmac.Equal(expected, []byte(signature)) {
+				return nil
+			}
+		}
+	}
+
+	return ErrWebhookSignature
+}
+
+func webhookSignature(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
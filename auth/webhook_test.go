@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSignWebhook(t *testing.T) {
+	// Worked out independently with
+	// printf '1700000000.{"id":"evt_1"}' | openssl dgst -sha256 -hmac whsec_test
+	const want = "v1=c89214b5b5da833daed6f0b8c5bb6bd58cea9022bd80ccc78230f3942d632925"
+
+	got := SignWebhook([]byte("whsec_test"), time.Unix(1700000000, 0), []byte(`{"id":"evt_1"}`))
+	if got != want {
+		t.Errorf("SignWebhook() = %s, want %s", got, want)
+	}
+}
+
+func TestVerifyWebhook(t *testing.T) {
+	current := []byte("whsec_current")
+	old := []byte("whsec_old")
+	body := []byte(`{"id":"evt_1","event":"user.upgraded"}`)
+	sent := time.Unix(1700000000, 0)
+	const timestamp = "1700000000"
+	const tolerance = 5 * time.Minute
+
+	signed := SignWebhook(current, sent, body)
+	signedOld := SignWebhook(old, sent, body)
+
+	tests := []struct {
+		name      string
+		secrets   [][]byte
+		timestamp string
+		signature string
+		body      []byte
+		now       time.Time
+		wantErr   error
+	}{
+		{name: "valid", secrets: [][]byte{current}, timestamp: timestamp, signature: signed, body: body, now: sent},
+		{name: "old secret during rotation", secrets: [][]byte{current, old}, timestamp: timestamp, signature: signedOld, body: body, now: sent},
+		{name: "several signatures", secrets: [][]byte{current}, timestamp: timestamp, signature: signedOld + ", " + signed, body: body, now: sent},
+		{name: "rotated out secret", secrets: [][]byte{current}, timestamp: timestamp, signature: signedOld, body: body, now: sent, wantErr: ErrWebhookSignature},
+		{name: "tampered body", secrets: [][]byte{current}, timestamp: timestamp, signature: signed, body: []byte(`{"id":"evt_1","event":"user.downgraded"}`), now: sent, wantErr: ErrWebhookSignature},
+		{name: "missing version prefix", secrets: [][]byte{current}, timestamp: timestamp, signature: signed[len("v1="):], body: body, now: sent, wantErr: ErrWebhookSignature},
+		{name: "unknown version", secrets: [][]byte{current}, timestamp: timestamp, signature: "v0=" + signed[len("v1="):], body: body, now: sent, wantErr: ErrWebhookSignature},
+		{name: "no signature", secrets: [][]byte{current}, timestamp: timestamp, signature: "", body: body, now: sent, wantErr: ErrWebhookSignature},
+		{name: "no secrets", secrets: nil, timestamp: timestamp, signature: signed, body: body, now: sent, wantErr: ErrWebhookSignature},
+		{name: "signed for another timestamp", secrets: [][]byte{current}, timestamp: "1700000001", signature: signed, body: body, now: sent, wantErr: ErrWebhookSignature},
+		{name: "late within tolerance", secrets: [][]byte{current}, timestamp: timestamp, signature: signed, body: body, now: sent.Add(tolerance)},
+		{name: "early within tolerance", secrets: [][]byte{current}, timestamp: timestamp, signature: signed, body: body, now: sent.Add(-tolerance)},
+		{name: "too late", secrets: [][]byte{current}, timestamp: timestamp, signature: signed, body: body, now: sent.Add(tolerance + time.Second), wantErr: ErrWebhookTimestamp},
+		{name: "too early", secrets: [][]byte{current}, timestamp: timestamp, signature: signed, body: body, now: sent.Add(-tolerance - time.Second), wantErr: ErrWebhookTimestamp},
+		{name: "missing timestamp", secrets: [][]byte{current}, timestamp: "", signature: signed, body: body, now: sent, wantErr: ErrWebhookTimestamp},
+		{name: "non-numeric timestamp", secrets: [][]byte{current}, timestamp: sent.Format(time.RFC3339), signature: signed, body: body, now: sent, wantErr: ErrWebhookTimestamp},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyWebhook(tt.secrets, tt.timestamp, tt.signature, tt.body, tt.now, tolerance)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("VerifyWebhook() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/stephenoveson/chirpy/automod"
+	"github.com/stephenoveson/chirpy/database"
+)
+
+// moderateChirp scores a chirp for spam and runs its raw body past the
+// automod rules. The classifier is trained on chirps as they are stored, so
+// it scores the body as it will be stored, with profanity cleaned.
+// editingId is the chirp being edited, which is left out of the author's
+// recent chirps, or 0 for a new chirp. The score is nil until the
+// classifier has been trained.
+func (api *apiConfig) moderateChirp(user database.User, body string, editingId int) (automod.Decision, *float64, error) {
+	post := automod.Post{
+		Body:             body,
+		Now:              time.Now().UTC(),
+		AccountCreatedAt: user.CreatedAt,
+	}
+	if score, ok := api.spam.Score(cleanBody(body)); ok {
+		post.SpamScore = &score
+	}
+
+	if lookback := api.automod.Lookback(); lookback > 0 {
+		chirps, err := api.db.GetRecentChirpsByAuthor(user.Id, post.Now.Add(-lookback))
+		if err != nil {
+			return automod.Decision{}, nil, err
+		}
+		for _, chirp := range chirps {
+			if chirp.Id != editingId {
+				post.Recent = append(post.Recent, automod.RecentPost{Body: chirp.Body, CreatedAt: chirp.CreatedAt})
+			}
+		}
+	}
+
+	decision := api.automod.Evaluate(post)
+	if decision.Rule != "" {
+		log.Printf("Automod rule %q matched a chirp by user %d: %s", decision.Rule, user.Id, decision.Action)
+	}
+
+	return decision, post.SpamScore, nil
+}
+
+// chirpReview turns an automod decision other than reject into how the
+// chirp is saved.
+func chirpReview(decision automod.Decision) database.ChirpReview {
+	switch decision.Action {
+	case automod.ActionHold:
+		detail := "rule=" + decision.Rule
+		if decision.Reason != "" {
+			detail += ": " + decision.Reason
+		}
+		return database.ChirpReview{HoldDetail: detail}
+	case automod.ActionShadowHide:
+		return database.ChirpReview{ShadowHideRule: decision.Rule}
+	}
+
+	return database.ChirpReview{}
+}
+
+func (api *apiConfig) handleGetAutomodRules(w http.ResponseWriter, r *http.Request) {
+	respondWithJson(w, http.StatusOK, api.automod.Ruleset())
+}
+
+// handleSetAutomodRules replaces the whole ruleset. It is checked before
+// anything is written, so a bad ruleset leaves the current one in place.
+func (api *apiConfig) handleSetAutomodRules(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	ruleset := automod.Ruleset{}
+	err := decoder.Decode(&ruleset)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err = api.automod.SetRuleset(ruleset)
+	if errors.Is(err, automod.ErrInvalidRuleset) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Unable to save automod rules: %s", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save automod rules")
+		return
+	}
+
+	api.audit(r, "automod.rules_updated", "automod", 0, fmt.Sprintf("rules=%d", len(ruleset.Rules)))
+
+	respondWithJson(w, http.StatusOK, api.automod.Ruleset())
+}
+
+func (api *apiConfig) handleGetAutomodStats(w http.ResponseWriter, r *http.Request) {
+	respondWithJson(w, http.StatusOK, api.automod.Stats())
+}
+
+// reloadAutomodRules picks up edits to the rules file every interval. A
+// missing or invalid file leaves the current rules in place.
+func reloadAutomodRules(engine *automod.Engine, interval time.Duration) {
+	for range time.Tick(interval) {
+		err := engine.Reload()
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Unable to reload automod rules: %s", err)
+		}
+	}
+}
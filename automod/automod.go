@@ -0,0 +1,207 @@
+// Package automod decides what happens to a new chirp before it is saved,
+// using an ordered list of rules loaded from a JSON file that can change
+// while the server runs.
+package automod
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Decision is the outcome of evaluating a chirp. Rule is empty when no rule
+// matched and the chirp is allowed by default.
+type Decision struct {
+	Action Action
+	Rule   string
+	Reason string
+}
+
+type RuleStats struct {
+	Name      string     `json:"name"`
+	Action    Action     `json:"action"`
+	Hits      int        `json:"hits"`
+	LastHitAt *time.Time `json:"last_hit_at"`
+}
+
+type Stats struct {
+	Evaluated int         `json:"evaluated"`
+	LoadedAt  time.Time   `json:"loaded_at"`
+	Rules     []RuleStats `json:"rules"`
+}
+
+// Engine holds the current ruleset and counts how often each rule matches.
+// Counts are kept by rule name in memory, so they survive reloads but not
+// restarts.
+type Engine struct {
+	path string
+
+	mux       sync.RWMutex
+	ruleset   Ruleset
+	modTime   time.Time
+	loadedAt  time.Time
+	evaluated int
+	hits      map[string]int
+	lastHit   map[string]time.Time
+}
+
+// NewEngine loads the rules file at path. When the file doesn't exist the
+// engine starts with no rules and the error wraps os.ErrNotExist; the
+// engine is usable either way.
+func NewEngine(path string) (*Engine, error) {
+	e := &Engine{
+		path:    path,
+		ruleset: Ruleset{Rules: []Rule{}},
+		hits:    map[string]int{},
+		lastHit: map[string]time.Time{},
+	}
+
+	return e, e.Reload()
+}
+
+// Reload re-reads the rules file if it changed since it was last loaded. An
+// invalid file is reported and the current rules are kept.
+func (e *Engine) Reload() error {
+	info, err := os.Stat(e.path)
+	if err != nil {
+		return err
+	}
+
+	e.mux.RLock()
+	unchanged := info.ModTime().Equal(e.modTime)
+	e.mux.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	data, err := os.ReadFile(e.path)
+	if err != nil {
+		return err
+	}
+
+	ruleset, err := ParseRuleset(data)
+	if err != nil {
+		return err
+	}
+
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	e.ruleset = ruleset
+	e.modTime = info.ModTime()
+	e.loadedAt = time.Now().UTC()
+
+	return nil
+}
+
+// SetRuleset validates ruleset, writes it to the rules file and starts using
+// it straight away.
+func (e *Engine) SetRuleset(ruleset Ruleset) error {
+	err := ruleset.compile()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(ruleset, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(e.path), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp := e.path + ".tmp"
+	err = os.WriteFile(tmp, append(data, '\n'), 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, e.path)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(e.path)
+	if err != nil {
+		return err
+	}
+
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	e.ruleset = ruleset
+	e.modTime = info.ModTime()
+	e.loadedAt = time.Now().UTC()
+
+	return nil
+}
+
+func (e *Engine) Ruleset() Ruleset {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+	return e.ruleset
+}
+
+// Lookback is how far back Post.Recent must reach for the current rules.
+func (e *Engine) Lookback() time.Duration {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+
+	var d time.Duration
+	for _, rule := range e.ruleset.Rules {
+		if rule.lookback() > d {
+			d = rule.lookback()
+		}
+	}
+	return d
+}
+
+// Evaluate returns the action of the first rule p matches, or allow.
+func (e *Engine) Evaluate(p Post) Decision {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	e.evaluated++
+	for _, rule := range e.ruleset.Rules {
+		if !rule.matches(p) {
+			continue
+		}
+
+		e.hits[rule.Name]++
+		e.lastHit[rule.Name] = p.Now.UTC()
+		return Decision{
+			Action: rule.Action,
+			Rule:   rule.Name,
+			Reason: rule.Reason,
+		}
+	}
+
+	return Decision{Action: ActionAllow}
+}
+
+// Stats reports how often each current rule has matched since the server
+// started.
+func (e *Engine) Stats() Stats {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+
+	stats := Stats{
+		Evaluated: e.evaluated,
+		LoadedAt:  e.loadedAt,
+		Rules:     make([]RuleStats, 0, len(e.ruleset.Rules)),
+	}
+	for _, rule := range e.ruleset.Rules {
+		rs := RuleStats{
+			Name:   rule.Name,
+			Action: rule.Action,
+			Hits:   e.hits[rule.Name],
+		}
+		if last, ok := e.lastHit[rule.Name]; ok {
+			rs.LastHitAt = &last
+		}
+		stats.Rules = append(stats.Rules, rs)
+	}
+
+	return stats
+}
@@ -0,0 +1,326 @@
+package automod
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseRuleset(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{name: "empty", data: `{"rules": []}`},
+		{name: "no rules key", data: `{}`},
+		{name: "every condition", data: `{"rules": [{"name": "all", "action": "hold", "pattern": "(?i)buy", "link_domains": ["Example.com"], "repeated": {"similarity": 0.9, "count": 3, "within": "10m"}, "rate": {"count": 5, "within": "1m"}, "account_age_under": "24h", "spam_score_at_least": 0.8}]}`},
+		{name: "not json", data: `rules`, wantErr: true},
+		{name: "unknown field", data: `{"rules": [{"name": "a", "action": "hold", "pattern": "x", "severity": 3}]}`, wantErr: true},
+		{name: "missing name", data: `{"rules": [{"action": "hold", "pattern": "x"}]}`, wantErr: true},
+		{name: "unknown action", data: `{"rules": [{"name": "a", "action": "ban", "pattern": "x"}]}`, wantErr: true},
+		{name: "no condition", data: `{"rules": [{"name": "a", "action": "hold"}]}`, wantErr: true},
+		{name: "duplicate name", data: `{"rules": [{"name": "a", "action": "hold", "pattern": "x"}, {"name": "a", "action": "reject", "pattern": "y"}]}`, wantErr: true},
+		{name: "invalid pattern", data: `{"rules": [{"name": "a", "action": "hold", "pattern": "("}]}`, wantErr: true},
+		{name: "empty link domain", data: `{"rules": [{"name": "a", "action": "hold", "link_domains": [" "]}]}`, wantErr: true},
+		{name: "similarity above 1", data: `{"rules": [{"name": "a", "action": "hold", "repeated": {"similarity": 1.5, "count": 1, "within": "1m"}}]}`, wantErr: true},
+		{name: "repeated without count", data: `{"rules": [{"name": "a", "action": "hold", "repeated": {"similarity": 0.5, "within": "1m"}}]}`, wantErr: true},
+		{name: "rate without within", data: `{"rules": [{"name": "a", "action": "hold", "rate": {"count": 1}}]}`, wantErr: true},
+		{name: "numeric duration", data: `{"rules": [{"name": "a", "action": "hold", "account_age_under": 60}]}`, wantErr: true},
+		{name: "negative account age", data: `{"rules": [{"name": "a", "action": "hold", "account_age_under": "-1h"}]}`, wantErr: true},
+		{name: "spam score above 1", data: `{"rules": [{"name": "a", "action": "hold", "spam_score_at_least": 2}]}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseRuleset([]byte(tt.data))
+			if tt.wantErr && !errors.Is(err, ErrInvalidRuleset) {
+				t.Errorf("ParseRuleset() error = %v, want %v", err, ErrInvalidRuleset)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("ParseRuleset() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestShippedRulesParse(t *testing.T) {
+	data, err := os.ReadFile("rules.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ParseRuleset(data)
+	if err != nil {
+		t.Errorf("rules.json: %v", err)
+	}
+}
+
+func mustRule(t *testing.T, data string) Rule {
+	t.Helper()
+	ruleset, err := ParseRuleset([]byte(`{"rules": [` + data + `]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ruleset.Rules[0]
+}
+
+func score(f float64) *float64 {
+	return &f
+}
+
+func TestRuleMatches(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	recent := func(body string, ago time.Duration) RecentPost {
+		return RecentPost{Body: body, CreatedAt: now.Add(-ago)}
+	}
+
+	tests := []struct {
+		name string
+		rule string
+		post Post
+		want bool
+	}{
+		{
+			name: "pattern",
+			rule: `{"name": "r", "action": "hold", "pattern": "(?i)free money"}`,
+			post: Post{Body: "Get FREE MONEY now", Now: now},
+			want: true,
+		},
+		{
+			name: "pattern is case sensitive by default",
+			rule: `{"name": "r", "action": "hold", "pattern": "free money"}`,
+			post: Post{Body: "Get FREE MONEY now", Now: now},
+			want: false,
+		},
+		{
+			name: "link domain",
+			rule: `{"name": "r", "action": "hold", "link_domains": ["spam.example"]}`,
+			post: Post{Body: "see https://spam.example/offer", Now: now},
+			want: true,
+		},
+		{
+			name: "link subdomain without scheme",
+			rule: `{"name": "r", "action": "hold", "link_domains": [".Spam.Example"]}`,
+			post: Post{Body: "see www.SPAM.example", Now: now},
+			want: true,
+		},
+		{
+			name: "link to a lookalike domain",
+			rule: `{"name": "r", "action": "hold", "link_domains": ["spam.example"]}`,
+			post: Post{Body: "see https://notspam.example/", Now: now},
+			want: false,
+		},
+		{
+			name: "no link",
+			rule: `{"name": "r", "action": "hold", "link_domains": ["spam.example"]}`,
+			post: Post{Body: "spam example", Now: now},
+			want: false,
+		},
+		{
+			name: "repeated",
+			rule: `{"name": "r", "action": "hold", "repeated": {"similarity": 0.9, "count": 2, "within": "10m"}}`,
+			post: Post{Body: "Buy my book!", Now: now, Recent: []RecentPost{recent("buy my book", time.Minute), recent("BUY MY BOOK", 5*time.Minute)}},
+			want: true,
+		},
+		{
+			name: "repeated too few times",
+			rule: `{"name": "r", "action": "hold", "repeated": {"similarity": 0.9, "count": 2, "within": "10m"}}`,
+			post: Post{Body: "buy my book", Now: now, Recent: []RecentPost{recent("buy my book", time.Minute), recent("something else", 2*time.Minute)}},
+			want: false,
+		},
+		{
+			name: "repeated outside the window",
+			rule: `{"name": "r", "action": "hold", "repeated": {"similarity": 0.9, "count": 2, "within": "10m"}}`,
+			post: Post{Body: "buy my book", Now: now, Recent: []RecentPost{recent("buy my book", time.Minute), recent("buy my book", 11*time.Minute)}},
+			want: false,
+		},
+		{
+			name: "rate",
+			rule: `{"name": "r", "action": "reject", "rate": {"count": 2, "within": "1m"}}`,
+			post: Post{Body: "hi", Now: now, Recent: []RecentPost{recent("a", 10*time.Second), recent("b", time.Minute)}},
+			want: true,
+		},
+		{
+			name: "rate outside the window",
+			rule: `{"name": "r", "action": "reject", "rate": {"count": 2, "within": "1m"}}`,
+			post: Post{Body: "hi", Now: now, Recent: []RecentPost{recent("a", 10*time.Second), recent("b", 2*time.Minute)}},
+			want: false,
+		},
+		{
+			name: "new account",
+			rule: `{"name": "r", "action": "hold", "account_age_under": "24h"}`,
+			post: Post{Body: "hi", Now: now, AccountCreatedAt: now.Add(-time.Hour)},
+			want: true,
+		},
+		{
+			name: "old account",
+			rule: `{"name": "r", "action": "hold", "account_age_under": "24h"}`,
+			post: Post{Body: "hi", Now: now, AccountCreatedAt: now.Add(-24 * time.Hour)},
+			want: false,
+		},
+		{
+			name: "account without a creation time",
+			rule: `{"name": "r", "action": "hold", "account_age_under": "24h"}`,
+			post: Post{Body: "hi", Now: now},
+			want: false,
+		},
+		{
+			name: "spam score at threshold",
+			rule: `{"name": "r", "action": "hold", "spam_score_at_least": 0.8}`,
+			post: Post{Body: "hi", Now: now, SpamScore: score(0.8)},
+			want: true,
+		},
+		{
+			name: "spam score below threshold",
+			rule: `{"name": "r", "action": "hold", "spam_score_at_least": 0.8}`,
+			post: Post{Body: "hi", Now: now, SpamScore: score(0.79)},
+			want: false,
+		},
+		{
+			name: "classifier still learning",
+			rule: `{"name": "r", "action": "hold", "spam_score_at_least": 0}`,
+			post: Post{Body: "hi", Now: now},
+			want: false,
+		},
+		{
+			name: "every condition must match",
+			rule: `{"name": "r", "action": "hold", "pattern": "(?i)https?://", "account_age_under": "24h"}`,
+			post: Post{Body: "https://example.com", Now: now, AccountCreatedAt: now.Add(-48 * time.Hour)},
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mustRule(t, tt.rule).matches(tt.post); got != tt.want {
+				t.Errorf("matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want float64
+	}{
+		{"buy my book", "Buy my book!", 1},
+		{"buy my book", "buy my car", 0.5},
+		{"buy my book", "hello there", 0},
+		{"", "", 1},
+		{"", "hello", 0},
+	}
+
+	for _, tt := range tests {
+		if got := similarity(tt.a, tt.b); got != tt.want {
+			t.Errorf("similarity(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestEngineEvaluate(t *testing.T) {
+	engine, err := NewEngine(filepath.Join(t.TempDir(), "rules.json"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("NewEngine() error = %v, want %v", err, os.ErrNotExist)
+	}
+
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	if got := engine.Evaluate(Post{Body: "anything", Now: now}); got != (Decision{Action: ActionAllow}) {
+		t.Errorf("Evaluate() with no rules = %+v, want allow", got)
+	}
+
+	ruleset, err := ParseRuleset([]byte(`{"rules": [
+		{"name": "trusted", "action": "allow", "pattern": "^\\[announcement\\]"},
+		{"name": "slurs", "action": "reject", "reason": "Not allowed", "pattern": "(?i)kerfuffle"},
+		{"name": "links", "action": "hold", "reason": "Has a link", "pattern": "https?://"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = engine.SetRuleset(ruleset)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		body string
+		want Decision
+	}{
+		{"hello", Decision{Action: ActionAllow}},
+		{"what a Kerfuffle", Decision{Action: ActionReject, Rule: "slurs", Reason: "Not allowed"}},
+		{"kerfuffle at https://example.com", Decision{Action: ActionReject, Rule: "slurs", Reason: "Not allowed"}},
+		{"see https://example.com", Decision{Action: ActionHold, Rule: "links", Reason: "Has a link"}},
+		{"[announcement] see https://example.com", Decision{Action: ActionAllow, Rule: "trusted"}},
+	}
+
+	for _, tt := range tests {
+		if got := engine.Evaluate(Post{Body: tt.body, Now: now}); got != tt.want {
+			t.Errorf("Evaluate(%q) = %+v, want %+v", tt.body, got, tt.want)
+		}
+	}
+
+	stats := engine.Stats()
+	if stats.Evaluated != len(tests)+1 {
+		t.Errorf("Stats().Evaluated = %d, want %d", stats.Evaluated, len(tests)+1)
+	}
+	hits := map[string]int{}
+	for _, rule := range stats.Rules {
+		hits[rule.Name] = rule.Hits
+	}
+	want := map[string]int{"trusted": 1, "slurs": 2, "links": 1}
+	for name, n := range want {
+		if hits[name] != n {
+			t.Errorf("Stats() hits for %s = %d, want %d", name, hits[name], n)
+		}
+	}
+}
+
+func TestEngineReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	err := os.WriteFile(path, []byte(`{"rules": [{"name": "a", "action": "hold", "pattern": "x"}]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	engine, err := NewEngine(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An invalid file is reported and the rules already loaded are kept.
+	err = os.WriteFile(path, []byte(`{"rules": [{"name": "a", "action": "ban", "pattern": "x"}]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.Reload(); !errors.Is(err, ErrInvalidRuleset) {
+		t.Errorf("Reload() error = %v, want %v", err, ErrInvalidRuleset)
+	}
+	if rules := engine.Ruleset().Rules; len(rules) != 1 || rules[0].Action != ActionHold {
+		t.Errorf("Ruleset() after a failed reload = %+v, want the previous rules", rules)
+	}
+
+	err = os.WriteFile(path, []byte(`{"rules": [{"name": "b", "action": "reject", "rate": {"count": 3, "within": "5m"}}]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(path, time.Now(), time.Now().Add(2*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if rules := engine.Ruleset().Rules; len(rules) != 1 || rules[0].Name != "b" {
+		t.Errorf("Ruleset() after reload = %+v, want rule b", rules)
+	}
+	if engine.Lookback() != 5*time.Minute {
+		t.Errorf("Lookback() = %v, want 5m", engine.Lookback())
+	}
+}
@@ -0,0 +1,116 @@
+package automod
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Post is a chirp about to be saved, with what the rules need to know about
+// its author.
+type Post struct {
+	Body string
+	Now  time.Time
+	// AccountCreatedAt is zero when the account predates creation times.
+	AccountCreatedAt time.Time
+	// Recent holds the author's chirps from at least Engine.Lookback ago.
+	Recent []RecentPost
+	// SpamScore is nil when the spam classifier couldn't score the chirp.
+	SpamScore *float64
+}
+
+type RecentPost struct {
+	Body      string
+	CreatedAt time.Time
+}
+
+var linkPattern = regexp.MustCompile(`(?i)(?:https?://)?((?:[a-z0-9](?:[a-z0-9-]*[a-z0-9])?\.)+[a-z]{2,})(?:[:/?#]\S*)?`)
+
+func (r Rule) matches(p Post) bool {
+	if r.pattern != nil && !r.pattern.MatchString(p.Body) {
+		return false
+	}
+
+	if len(r.LinkDomains) > 0 && !r.linksTo(p.Body) {
+		return false
+	}
+
+	if r.Repeated != nil {
+		similar := 0
+		for _, recent := range p.Recent {
+			if p.Now.Sub(recent.CreatedAt) <= r.Repeated.Within.Duration && similarity(p.Body, recent.Body) >= r.Repeated.Similarity {
+				similar++
+			}
+		}
+		if similar < r.Repeated.Count {
+			return false
+		}
+	}
+
+	if r.Rate != nil {
+		posted := 0
+		for _, recent := range p.Recent {
+			if p.Now.Sub(recent.CreatedAt) <= r.Rate.Within.Duration {
+				posted++
+			}
+		}
+		if posted < r.Rate.Count {
+			return false
+		}
+	}
+
+	if r.AccountAgeUnder != nil {
+		if p.AccountCreatedAt.IsZero() || p.Now.Sub(p.AccountCreatedAt) >= r.AccountAgeUnder.Duration {
+			return false
+		}
+	}
+
+	if r.SpamScoreAtLeast != nil {
+		if p.SpamScore == nil || *p.SpamScore < *r.SpamScoreAtLeast {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (r Rule) linksTo(body string) bool {
+	for _, match := range linkPattern.FindAllStringSubmatch(body, -1) {
+		host := strings.ToLower(match[1])
+		for _, domain := range r.LinkDomains {
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// similarity is the Jaccard index of the sets of words in a and b, from 0
+// for nothing in common to 1 for the same words.
+func similarity(a, b string) float64 {
+	wordsA := wordSet(a)
+	wordsB := wordSet(b)
+	if len(wordsA) == 0 && len(wordsB) == 0 {
+		return 1
+	}
+
+	shared := 0
+	for word := range wordsA {
+		if wordsB[word] {
+			shared++
+		}
+	}
+
+	return float64(shared) / float64(len(wordsA)+len(wordsB)-shared)
+}
+
+func wordSet(s string) map[string]bool {
+	words := map[string]bool{}
+	for _, word := range strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r > 127)
+	}) {
+		words[word] = true
+	}
+	return words
+}
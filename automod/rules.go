@@ -0,0 +1,204 @@
+package automod
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Action is what happens to a chirp that matches a rule.
+type Action string
+
+const (
+	// ActionAllow publishes the chirp and stops evaluating, so an allow
+	// rule placed first exempts matching chirps from the rules after it.
+	ActionAllow Action = "allow"
+	// ActionHold saves the chirp hidden from everyone but its author and
+	// puts it in the moderation queue.
+	ActionHold Action = "hold"
+	// ActionShadowHide saves the chirp so only its author can see it,
+	// without telling them.
+	ActionShadowHide Action = "shadow_hide"
+	// ActionReject refuses to save the chirp.
+	ActionReject Action = "reject"
+)
+
+func (a Action) valid() bool {
+	switch a {
+	case ActionAllow, ActionHold, ActionShadowHide, ActionReject:
+		return true
+	}
+	return false
+}
+
+// Duration is a time.Duration written as a string such as "10m" in the
+// rules file.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return errors.New("durations must be strings such as \"10m\"")
+	}
+
+	d.Duration, err = time.ParseDuration(s)
+	return err
+}
+
+// Rule matches a chirp when every condition it sets matches. A rule must
+// set at least one condition.
+type Rule struct {
+	Name   string `json:"name"`
+	Action Action `json:"action"`
+	// Reason is shown to the author when the chirp is rejected and to
+	// moderators when it is held.
+	Reason string `json:"reason,omitempty"`
+
+	// Pattern is an RE2 regular expression matched against the chirp body.
+	// Use (?i) for a case-insensitive match.
+	Pattern string `json:"pattern,omitempty"`
+	// LinkDomains matches chirps linking to any of these domains or their
+	// subdomains.
+	LinkDomains []string `json:"link_domains,omitempty"`
+	// Repeated matches when the author posted at least Count chirps within
+	// Within whose words overlap with this one by at least Similarity.
+	Repeated *RepeatedCondition `json:"repeated,omitempty"`
+	// Rate matches when the author already posted at least Count chirps
+	// within Within.
+	Rate *RateCondition `json:"rate,omitempty"`
+	// AccountAgeUnder matches authors whose account is younger than this.
+	// Accounts created before creation times were recorded never match.
+	AccountAgeUnder *Duration `json:"account_age_under,omitempty"`
+	// SpamScoreAtLeast matches chirps the spam classifier scores at least
+	// this high. It never matches while the classifier is still learning.
+	SpamScoreAtLeast *float64 `json:"spam_score_at_least,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+type RepeatedCondition struct {
+	Similarity float64  `json:"similarity"`
+	Count      int      `json:"count"`
+	Within     Duration `json:"within"`
+}
+
+type RateCondition struct {
+	Count  int      `json:"count"`
+	Within Duration `json:"within"`
+}
+
+// ErrInvalidRuleset wraps every problem found while checking a ruleset.
+var ErrInvalidRuleset = errors.New("invalid ruleset")
+
+// Ruleset is the rules file. Rules are evaluated in order and the first
+// match decides.
+type Ruleset struct {
+	Rules []Rule `json:"rules"`
+}
+
+// ParseRuleset decodes and validates a rules file.
+func ParseRuleset(data []byte) (Ruleset, error) {
+	ruleset := Ruleset{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&ruleset)
+	if err != nil {
+		return Ruleset{}, fmt.Errorf("%w: %w", ErrInvalidRuleset, err)
+	}
+
+	return ruleset, ruleset.compile()
+}
+
+func (rs *Ruleset) compile() error {
+	if rs.Rules == nil {
+		rs.Rules = []Rule{}
+	}
+
+	names := map[string]bool{}
+	for i := range rs.Rules {
+		rule := &rs.Rules[i]
+		err := rule.compile()
+		if err != nil {
+			return fmt.Errorf("%w: rule %d (%s): %w", ErrInvalidRuleset, i+1, rule.Name, err)
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("%w: rule %d: duplicate name %q", ErrInvalidRuleset, i+1, rule.Name)
+		}
+		names[rule.Name] = true
+	}
+
+	return nil
+}
+
+func (r *Rule) compile() error {
+	if r.Name == "" {
+		return errors.New("name is required")
+	}
+	if !r.Action.valid() {
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+	if r.Pattern == "" && len(r.LinkDomains) == 0 && r.Repeated == nil && r.Rate == nil && r.AccountAgeUnder == nil && r.SpamScoreAtLeast == nil {
+		return errors.New("at least one condition is required")
+	}
+
+	if r.Pattern != "" {
+		pattern, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return err
+		}
+		r.pattern = pattern
+	}
+
+	for i, domain := range r.LinkDomains {
+		r.LinkDomains[i] = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(domain), "."))
+		if r.LinkDomains[i] == "" {
+			return errors.New("link domains can't be empty")
+		}
+	}
+
+	if r.Repeated != nil {
+		if r.Repeated.Similarity <= 0 || r.Repeated.Similarity > 1 {
+			return errors.New("repeated similarity must be greater than 0 and at most 1")
+		}
+		if r.Repeated.Count < 1 || r.Repeated.Within.Duration <= 0 {
+			return errors.New("repeated needs a positive count and within")
+		}
+	}
+
+	if r.Rate != nil && (r.Rate.Count < 1 || r.Rate.Within.Duration <= 0) {
+		return errors.New("rate needs a positive count and within")
+	}
+
+	if r.AccountAgeUnder != nil && r.AccountAgeUnder.Duration <= 0 {
+		return errors.New("account_age_under must be positive")
+	}
+
+	if r.SpamScoreAtLeast != nil && (*r.SpamScoreAtLeast < 0 || *r.SpamScoreAtLeast > 1) {
+		return errors.New("spam_score_at_least must be between 0 and 1")
+	}
+
+	return nil
+}
+
+// lookback is how far back a rule needs to see the author's chirps.
+func (r Rule) lookback() time.Duration {
+	var d time.Duration
+	if r.Repeated != nil {
+		d = r.Repeated.Within.Duration
+	}
+	if r.Rate != nil && r.Rate.Within.Duration > d {
+		d = r.Rate.Within.Duration
+	}
+	return d
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/stephenoveson/chirpy/database"
+)
+
+func (api *apiConfig) handleBlockUser(w http.ResponseWriter, r *http.Request) {
+	api.changeRelation(w, r, api.db.BlockUser)
+}
+
+func (api *apiConfig) handleUnblockUser(w http.ResponseWriter, r *http.Request) {
+	api.changeRelation(w, r, api.db.UnblockUser)
+}
+
+func (api *apiConfig) handleMuteUser(w http.ResponseWriter, r *http.Request) {
+	api.changeRelation(w, r, api.db.MuteUser)
+}
+
+func (api *apiConfig) handleUnmuteUser(w http.ResponseWriter, r *http.Request) {
+	api.changeRelation(w, r, api.db.UnmuteUser)
+}
+
+func (api *apiConfig) handleGetBlockedUsers(w http.ResponseWriter, r *http.Request) {
+	api.listRelations(w, r, api.db.GetBlockedUsers)
+}
+
+func (api *apiConfig) handleGetMutedUsers(w http.ResponseWriter, r *http.Request) {
+	api.listRelations(w, r, api.db.GetMutedUsers)
+}
+
+// changeRelation applies change between the caller and the user in the
+// path, for the block, mute and follow routes.
+func (api *apiConfig) changeRelation(w http.ResponseWriter, r *http.Request, change func(userId, targetId int) error) {
+	type response struct{}
+	userId := principalFromContext(r.Context()).UserId
+
+	targetId, err := strconv.Atoi(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to convert parameter to integer.")
+		return
+	}
+
+	err = change(userId, targetId)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	respondWithJson(w, http.StatusNoContent, response{})
+}
+
+func (api *apiConfig) listRelations(w http.ResponseWriter, r *http.Request, list func(userId int) ([]database.Relation, error)) {
+	userId := principalFromContext(r.Context()).UserId
+
+	relations, err := list(userId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to read from database")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, relations)
+}
@@ -3,23 +3,29 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/stephenoveson/chirpy/auth"
+	"github.com/stephenoveson/chirpy/automod"
 	"github.com/stephenoveson/chirpy/database"
+	"github.com/stephenoveson/chirpy/entitlements"
 )
 
 func (api *apiConfig) handlerGetChirps(w http.ResponseWriter, r *http.Request) {
+	viewerId := principalFromContext(r.Context()).UserId
 	authorId := r.URL.Query().Get("author_id")
 	sortBy := r.URL.Query().Get("sort")
 	id, err := strconv.Atoi(authorId)
 	var chirps []database.Chirp
 	if authorId == "" {
-		chirps, err = api.db.GetChirps(0, sortBy)
+		chirps, err = api.db.GetChirps(viewerId, 0, sortBy)
 	} else {
-		chirps, err = api.db.GetChirps(id, sortBy)
+		chirps, err = api.db.GetChirps(viewerId, id, sortBy)
 	}
 
 	if err != nil {
@@ -37,7 +43,7 @@ func (api *apiConfig) handlerGetChirpById(w http.ResponseWriter, r *http.Request
 		respondWithError(w, http.StatusInternalServerError, "Unable to convert parameter to integer.")
 		return
 	}
-	chirp, err := api.db.GetChirpById(id)
+	chirp, err := api.db.GetChirpById(principalFromContext(r.Context()).UserId, id)
 	if err != nil {
 		respondWithError(w, http.StatusNotFound, "Unable to read chirps from database.")
 		return
@@ -48,16 +54,92 @@ func (api *apiConfig) handlerGetChirpById(w http.ResponseWriter, r *http.Request
 
 func (api *apiConfig) handlerCreateChirps(w http.ResponseWriter, r *http.Request) {
 	type chirpBody struct {
-		Body string `json:"body"`
+		Body      string     `json:"body"`
+		ReplyToId int        `json:"reply_to_id"`
+		PublishAt *time.Time `json:"publish_at"`
+	}
+	userId := principalFromContext(r.Context()).UserId
+
+	decoder := json.NewDecoder(r.Body)
+	chirp := chirpBody{}
+	err := decoder.Decode(&chirp)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+		return
+	}
+
+	user, err := api.db.GetUserById(userId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create chirp")
+		return
+	}
+	limits := api.limitsFor(user)
+
+	cleanString, err := validateChirp(chirp.Body, limits.MaxChirpLength)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if chirp.PublishAt != nil && !api.checkScheduledChirp(w, user, limits, *chirp.PublishAt) {
+		return
+	}
+
+	if !api.checkChirpRate(w, user, limits) {
+		return
+	}
+
+	decision, spamScore, err := api.moderateChirp(user, chirp.Body, 0)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create chirp")
+		return
+	}
+	if decision.Action == automod.ActionReject {
+		respondWithRejection(w, decision)
+		return
+	}
+
+	newChirp := database.Chirp{
+		Body:      cleanString,
+		AuthorId:  userId,
+		ReplyToId: chirp.ReplyToId,
+	}
+	if chirp.PublishAt != nil {
+		publishAt := chirp.PublishAt.UTC()
+		newChirp.PublishAt = &publishAt
+	}
+
+	savedChirp, err := api.db.CreateChirp(newChirp, chirpReview(decision))
+	if errors.Is(err, database.ErrChirpNotFound) {
+		respondWithError(w, http.StatusNotFound, "Unable to find the chirp you're replying to")
+		return
 	}
-	token, err := auth.GetBearerToken(r.Header)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Not authorized to create a chirp")
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create chirp")
 		return
 	}
-	userId, err := auth.ValidateJWT(token, api.secret)
+
+	api.recordSpamScore(savedChirp.Id, spamScore)
+
+	if decision.Action == automod.ActionHold {
+		respondWithJson(w, http.StatusAccepted, savedChirp)
+		return
+	}
+	respondWithJson(w, http.StatusCreated, savedChirp)
+}
+
+// handleEditChirp replaces the body of one of the caller's chirps, within
+// the edit window their plan allows. The new body goes through automod like
+// a new chirp.
+func (api *apiConfig) handleEditChirp(w http.ResponseWriter, r *http.Request) {
+	type chirpBody struct {
+		Body string `json:"body"`
+	}
+	userId := principalFromContext(r.Context()).UserId
+
+	chirpId, err := strconv.Atoi(r.PathValue("chirpID"))
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Not authorized to create a chirp")
+		respondWithError(w, http.StatusBadRequest, "Unable to convert parameter to integer.")
 		return
 	}
 
@@ -65,29 +147,129 @@ func (api *apiConfig) handlerCreateChirps(w http.ResponseWriter, r *http.Request
 	chirp := chirpBody{}
 	err = decoder.Decode(&chirp)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	user, err := api.db.GetUserById(userId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't edit chirp")
+		return
+	}
+	limits := api.limitsFor(user)
+	if limits.EditWindow() == 0 {
+		respondWithError(w, http.StatusForbidden, "Your plan doesn't include editing chirps")
 		return
 	}
 
-	cleanString, err := validateChirp(chirp.Body)
+	cleanString, err := validateChirp(chirp.Body, limits.MaxChirpLength)
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	userIdInt, err := strconv.Atoi(userId)
+	decision, spamScore, err := api.moderateChirp(user, chirp.Body, chirpId)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "A problem has occurred on the server")
+		respondWithError(w, http.StatusInternalServerError, "Couldn't edit chirp")
+		return
+	}
+	if decision.Action == automod.ActionReject {
+		respondWithRejection(w, decision)
 		return
 	}
 
-	savedChirp, err := api.db.CreateChirp(cleanString, userIdInt)
+	savedChirp, err := api.db.EditChirp(chirpId, userId, cleanString, limits.EditWindow(), chirpReview(decision))
+	if errors.Is(err, database.ErrChirpNotFound) {
+		respondWithError(w, http.StatusNotFound, "Chirp unable to be found or you are not the author")
+		return
+	}
+	if errors.Is(err, database.ErrEditWindowClosed) || errors.Is(err, database.ErrChirpLabeled) {
+		respondWithError(w, http.StatusForbidden, err.Error())
+		return
+	}
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create chirp")
+		respondWithError(w, http.StatusInternalServerError, "Couldn't edit chirp")
 		return
 	}
 
-	respondWithJson(w, http.StatusCreated, savedChirp)
+	api.recordSpamScore(savedChirp.Id, spamScore)
+
+	respondWithJson(w, http.StatusOK, savedChirp)
+}
+
+func respondWithRejection(w http.ResponseWriter, decision automod.Decision) {
+	reason := decision.Reason
+	if reason == "" {
+		reason = "This chirp can't be posted"
+	}
+	respondWithError(w, http.StatusUnprocessableEntity, reason)
+}
+
+func (api *apiConfig) recordSpamScore(chirpId int, score *float64) {
+	if score == nil {
+		return
+	}
+	err := api.db.SetSpamScore(chirpId, *score)
+	if err != nil {
+		log.Printf("Unable to record spam score for chirp %d: %s", chirpId, err)
+	}
+}
+
+// checkChirpRate refuses a new chirp once the author has posted as many in
+// the last hour as their plan allows, telling them when they can post again.
+func (api *apiConfig) checkChirpRate(w http.ResponseWriter, u database.User, limits entitlements.Limits) bool {
+	if limits.ChirpsPerHour == 0 {
+		return true
+	}
+
+	now := time.Now()
+	recent, err := api.db.GetRecentChirpsByAuthor(u.Id, now.Add(-time.Hour))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create chirp")
+		return false
+	}
+	if len(recent) < limits.ChirpsPerHour {
+		return true
+	}
+
+	retryAfter := recent[limits.ChirpsPerHour-1].CreatedAt.Add(time.Hour).Sub(now)
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+	respondWithError(w, http.StatusTooManyRequests, fmt.Sprintf("Your plan allows %d chirps an hour", limits.ChirpsPerHour))
+	return false
+}
+
+func (api *apiConfig) checkScheduledChirp(w http.ResponseWriter, u database.User, limits entitlements.Limits, publishAt time.Time) bool {
+	if limits.MaxScheduledChirps == 0 {
+		respondWithError(w, http.StatusForbidden, "Your plan doesn't include scheduling chirps")
+		return false
+	}
+	if !publishAt.After(time.Now()) {
+		respondWithError(w, http.StatusBadRequest, "publish_at must be in the future")
+		return false
+	}
+
+	scheduled, err := api.db.CountScheduledChirps(u.Id, time.Now())
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create chirp")
+		return false
+	}
+	if scheduled >= limits.MaxScheduledChirps {
+		respondWithError(w, http.StatusForbidden, fmt.Sprintf("Your plan allows %d scheduled chirps at a time", limits.MaxScheduledChirps))
+		return false
+	}
+
+	return true
+}
+
+// publishScheduledChirps publishes scheduled chirps every interval once
+// their time has come, so replies notify and webhooks go out for them.
+func (api *apiConfig) publishScheduledChirps(interval time.Duration) {
+	for ; ; time.Sleep(interval) {
+		_, err := api.db.PublishDueChirps(time.Now())
+		if err != nil {
+			log.Printf("Unable to publish scheduled chirps: %s", err)
+		}
+	}
 }
 
 func (api *apiConfig) handleDeleteChrips(w http.ResponseWriter, r *http.Request) {
@@ -99,35 +281,47 @@ func (api *apiConfig) handleDeleteChrips(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	token, err := auth.GetBearerToken(r.Header)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Not authorized to create a chirp")
+	userId := principalFromContext(r.Context()).UserId
+
+	chirp, err := api.db.GetChirpById(database.SystemViewer, chirpId)
+	if err == nil && chirp.AuthorId != userId {
+		api.handleModeratorDeleteChirp(w, r, chirp)
 		return
 	}
 
-	userId, err := auth.ValidateJWT(token, api.secret)
+	err = api.db.DeleteChirpById(chirpId, userId)
 	if err != nil {
-		respondWithError(w, http.StatusForbidden, "Not authorized to create a chirp")
+		respondWithError(w, http.StatusForbidden, "Chirp unable to be found or you are not the author")
 		return
 	}
 
-	userIdInt, err := strconv.Atoi(userId)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "A problem has occurred on the server")
+	respondWithJson(w, http.StatusNoContent, response{})
+}
+
+// handleModeratorDeleteChirp lets staff remove someone else's chirp. The
+// request has to carry the admin scope as well as come from a moderator.
+func (api *apiConfig) handleModeratorDeleteChirp(w http.ResponseWriter, r *http.Request, chirp database.Chirp) {
+	type response struct{}
+	p := principalFromContext(r.Context())
+
+	user, err := api.db.GetUserById(p.UserId)
+	if err != nil || !user.HasRole(database.RoleModerator) || !user.TOTPEnabled || !p.hasScope(auth.ScopeAdmin) {
+		respondWithError(w, http.StatusForbidden, "Chirp unable to be found or you are not the author")
 		return
 	}
 
-	err = api.db.DeleteChirpById(chirpId, userIdInt)
+	_, err = api.db.RemoveChirp(chirp.Id)
 	if err != nil {
-		respondWithError(w, http.StatusForbidden, "Chirp unable to be found or you are not the author")
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete chirp")
 		return
 	}
 
+	api.audit(r, "chirp.deleted", "chirp", chirp.Id, fmt.Sprintf("author_id=%d", chirp.AuthorId))
 	respondWithJson(w, http.StatusNoContent, response{})
 }
 
-func validateChirp(body string) (string, error) {
-	if len(body) > 140 {
+func validateChirp(body string, maxLength int) (string, error) {
+	if len(body) > maxLength {
 		return "", errors.New("chirp is too long")
 	}
 
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stephenoveson/chirpy/auth"
+	"github.com/stephenoveson/chirpy/database"
+)
+
+const (
+	dataExportLifetime     = 7 * 24 * time.Hour
+	dataExportLinkLifetime = 15 * time.Minute
+)
+
+// urlSigningSecretFromEnv returns the key signed download links are made
+// with. Without URL_SIGNING_SECRET a random key is used, so links stop
+// working when the server restarts.
+func urlSigningSecretFromEnv() ([]byte, error) {
+	secret := os.Getenv("URL_SIGNING_SECRET")
+	if secret != "" {
+		if len(secret) < 32 {
+			return nil, errors.New("URL_SIGNING_SECRET must be at least 32 random characters")
+		}
+		return []byte(secret), nil
+	}
+
+	log.Printf("URL_SIGNING_SECRET is not set, signed links won't survive a restart")
+	random, err := auth.GenerateNonce()
+	return []byte(random), err
+}
+
+type dataExportResponse struct {
+	Id          int        `json:"id"`
+	Status      string     `json:"status"`
+	Progress    int        `json:"progress"`
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	StatusURL   string     `json:"status_url"`
+	DownloadURL string     `json:"download_url,omitempty"`
+}
+
+func (api *apiConfig) newDataExportResponse(export database.DataExport) dataExportResponse {
+	resp := dataExportResponse{
+		Id:          export.Id,
+		Status:      export.Status,
+		Progress:    export.Progress,
+		Error:       export.Error,
+		CreatedAt:   export.CreatedAt,
+		CompletedAt: optionalTime(export.CompletedAt),
+		ExpiresAt:   optionalTime(export.ExpiresAt),
+		StatusURL:   fmt.Sprintf("%s/api/users/me/exports/%d", api.publicURL, export.Id),
+	}
+
+	if export.Status == database.ExportComplete {
+		path := fmt.Sprintf("/api/exports/%d/download", export.Id)
+		expires := time.Now().Add(dataExportLinkLifetime)
+		if expires.After(export.ExpiresAt) {
+			expires = export.ExpiresAt
+		}
+		resp.DownloadURL = api.publicURL + auth.SignPath(api.urlSigningSecret, path, expires)
+	}
+
+	return resp
+}
+
+// handleStartDataExport queues a copy of everything stored about the caller.
+// Asking again while an export is still being assembled returns that export
+// rather than starting another.
+func (api *apiConfig) handleStartDataExport(w http.ResponseWriter, r *http.Request) {
+	userId := principalFromContext(r.Context()).UserId
+
+	export, created, err := api.db.CreateDataExport(userId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't start data export")
+		return
+	}
+
+	if created {
+		go api.runDataExport(export)
+	}
+
+	resp := api.newDataExportResponse(export)
+	w.Header().Set("Location", resp.StatusURL)
+	respondWithJson(w, http.StatusAccepted, resp)
+}
+
+func (api *apiConfig) handleGetDataExport(w http.ResponseWriter, r *http.Request) {
+	userId := principalFromContext(r.Context()).UserId
+
+	exportId, err := strconv.Atoi(r.PathValue("exportID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to convert parameter to integer.")
+		return
+	}
+
+	export, err := api.db.GetDataExport(exportId)
+	if err != nil || export.UserId != userId {
+		respondWithError(w, http.StatusNotFound, "Unable to find export")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, api.newDataExportResponse(export))
+}
+
+// handleDownloadDataExport serves a finished export to whoever holds a
+// signed link from the status endpoint, so it works from a plain browser
+// download without an Authorization header.
+func (api *apiConfig) handleDownloadDataExport(w http.ResponseWriter, r *http.Request) {
+	err := auth.VerifySignedPath(api.urlSigningSecret, r.URL.Path, r.URL.Query(), time.Now())
+	if err != nil {
+		respondWithError(w, http.StatusForbidden, err.Error())
+		return
+	}
+
+	exportId, err := strconv.Atoi(r.PathValue("exportID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to convert parameter to integer.")
+		return
+	}
+
+	export, err := api.db.GetDataExport(exportId)
+	if err != nil || export.Status != database.ExportComplete || time.Now().After(export.ExpiresAt) {
+		respondWithError(w, http.StatusNotFound, "Unable to find export")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="chirpy-export-%d.zip"`, export.Id))
+	w.Header().Set("Cache-Control", "no-store")
+	http.ServeFile(w, r, filepath.Join(api.exportDir, export.FileName))
+}
+
+// runDataExport assembles the zip for export, recording progress after each
+// file so the status endpoint can report it.
+func (api *apiConfig) runDataExport(export database.DataExport) {
+	export.Status = database.ExportRunning
+	export.Progress = 0
+	api.updateDataExport(export)
+
+	fileName, err := api.writeDataExport(&export)
+	if err != nil {
+		log.Printf("Unable to export data for user %d: %s", export.UserId, err)
+		export.Status = database.ExportFailed
+		export.Error = "Couldn't assemble export"
+		export.ExpiresAt = time.Now().Add(dataExportLifetime).UTC()
+		api.updateDataExport(export)
+		return
+	}
+
+	now := time.Now().UTC()
+	export.Status = database.ExportComplete
+	export.Progress = 100
+	export.FileName = fileName
+	export.CompletedAt = now
+	export.ExpiresAt = now.Add(dataExportLifetime)
+	api.updateDataExport(export)
+}
+
+func (api *apiConfig) writeDataExport(export *database.DataExport) (string, error) {
+	type profile struct {
+		userSuccess
+		TOTPEnabled bool       `json:"totp_enabled"`
+		DeleteAfter *time.Time `json:"delete_after"`
+	}
+	type session struct {
+		ClientId  string     `json:"client_id,omitempty"`
+		Scopes    []string   `json:"scopes"`
+		CreatedAt time.Time  `json:"created_at"`
+		ExpiresAt time.Time  `json:"expires_at"`
+		RevokedAt *time.Time `json:"revoked_at"`
+	}
+
+	user, err := api.db.GetUserById(export.UserId)
+	if err != nil {
+		return "", err
+	}
+
+	sections := []struct {
+		name string
+		load func() (interface{}, error)
+	}{
+		{"profile.json", func() (interface{}, error) {
+			return profile{
+				userSuccess: newUserSuccess(user),
+				TOTPEnabled: user.TOTPEnabled,
+				DeleteAfter: optionalTime(user.DeleteAfter),
+			}, nil
+		}},
+		{"chirps.json", func() (interface{}, error) {
+			return api.db.GetChirps(user.Id, user.Id, "asc")
+		}},
+		{"sessions.json", func() (interface{}, error) {
+			tokens, err := api.db.GetRefreshTokensForUser(user.Id)
+			sessions := make([]session, 0, len(tokens))
+			for _, token := range tokens {
+				sessions = append(sessions, session{
+					ClientId:  token.ClientId,
+					Scopes:    token.Scopes,
+					CreatedAt: token.CreatedAt,
+					ExpiresAt: token.ExpiresAt,
+					RevokedAt: optionalTime(token.RevokedAt),
+				})
+			}
+			return sessions, err
+		}},
+		{"api_keys.json", func() (interface{}, error) {
+			keys, err := api.db.GetAPIKeysForUser(user.Id)
+			resp := make([]apiKeyResponse, 0, len(keys))
+			for _, key := range keys {
+				resp = append(resp, newAPIKeyResponse(key))
+			}
+			return resp, err
+		}},
+		{"blocks.json", func() (interface{}, error) {
+			return api.db.GetBlockedUsers(user.Id)
+		}},
+		{"mutes.json", func() (interface{}, error) {
+			return api.db.GetMutedUsers(user.Id)
+		}},
+		{"following.json", func() (interface{}, error) {
+			return api.db.GetFollowing(user.Id)
+		}},
+		{"followers.json", func() (interface{}, error) {
+			return api.db.GetFollowers(user.Id, database.FollowApproved)
+		}},
+		{"subscription.json", func() (interface{}, error) {
+			return newSubscriptionResponse(user), nil
+		}},
+	}
+
+	nonce, err := auth.GenerateNonce()
+	if err != nil {
+		return "", err
+	}
+	fileName := fmt.Sprintf("%d-%s.zip", export.Id, nonce)
+	path := filepath.Join(api.exportDir, fileName)
+
+	err = os.MkdirAll(api.exportDir, 0700)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(path + ".tmp")
+	defer f.Close()
+
+	archive := zip.NewWriter(f)
+	for i, section := range sections {
+		value, err := section.load()
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", section.name, err)
+		}
+
+		entry, err := archive.Create(section.name)
+		if err != nil {
+			return "", err
+		}
+
+		encoder := json.NewEncoder(entry)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(value)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", section.name, err)
+		}
+
+		export.Progress = (i + 1) * 100 / (len(sections) + 1)
+		api.updateDataExport(*export)
+	}
+
+	err = archive.Close()
+	if err != nil {
+		return "", err
+	}
+	err = f.Close()
+	if err != nil {
+		return "", err
+	}
+
+	return fileName, os.Rename(path+".tmp", path)
+}
+
+func (api *apiConfig) updateDataExport(export database.DataExport) {
+	err := api.db.UpdateDataExport(export)
+	if err != nil {
+		log.Printf("Unable to update data export %d: %s", export.Id, err)
+	}
+}
+
+// maintainDataExports restarts exports interrupted by a restart, then at
+// startup and every interval deletes expired exports and any zip left
+// behind by an export that no longer exists, such as one belonging to a
+// deleted account.
+func (api *apiConfig) maintainDataExports(interval time.Duration) {
+	exports, err := api.db.GetDataExports()
+	if err != nil {
+		log.Printf("Unable to load data exports: %s", err)
+	}
+	for _, export := range exports {
+		if export.IsActive() {
+			go api.runDataExport(export)
+		}
+	}
+
+	for ; ; time.Sleep(interval) {
+		api.pruneDataExports()
+	}
+}
+
+// pruneDataExports keeps zips by the id of the export they belong to, so an
+// export that finishes while the directory is being listed keeps its zip.
+// Zips written since the exports were loaded are left for the next pass.
+func (api *apiConfig) pruneDataExports() {
+	loadedAt := time.Now()
+	exports, err := api.db.GetDataExports()
+	if err != nil {
+		log.Printf("Unable to load data exports: %s", err)
+		return
+	}
+
+	kept := map[int]bool{}
+	keptFiles := map[string]bool{}
+	for _, export := range exports {
+		if export.IsActive() || loadedAt.Before(export.ExpiresAt) {
+			kept[export.Id] = true
+			keptFiles[export.FileName] = true
+			continue
+		}
+
+		err = api.db.DeleteDataExport(export.Id)
+		if err != nil {
+			log.Printf("Unable to delete data export %d: %s", export.Id, err)
+			kept[export.Id] = true
+			keptFiles[export.FileName] = true
+		}
+	}
+
+	paths, err := filepath.Glob(filepath.Join(api.exportDir, "*.zip"))
+	if err != nil {
+		log.Printf("Unable to list data exports: %s", err)
+		return
+	}
+	for _, path := range paths {
+		name := filepath.Base(path)
+		if kept[dataExportId(name)] || keptFiles[name] {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().After(loadedAt) {
+			continue
+		}
+		err = os.Remove(path)
+		if err != nil {
+			log.Printf("Unable to remove data export %s: %s", path, err)
+		}
+	}
+}
+
+// dataExportId returns the export id a zip is named after, or 0 for zips
+// named before ids were part of the name.
+func dataExportId(fileName string) int {
+	prefix, _, ok := strings.Cut(fileName, "-")
+	if !ok {
+		return 0
+	}
+	id, err := strconv.Atoi(prefix)
+	if err != nil {
+		return 0
+	}
+	return id
+}
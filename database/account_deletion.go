@@ -0,0 +1,200 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+)
+
+// userIdFields are the payload fields that name a user, in outbox events and
+// in the webhooks sent and received about them.
+var userIdFields = map[string]bool{
+	"user_id":     true,
+	"author_id":   true,
+	"follower_id": true,
+	"followee_id": true,
+}
+
+// ScheduleUserDeletion marks userId for deletion at deleteAfter and signs the
+// account out everywhere by revoking its refresh tokens and API keys.
+func (db *DB) ScheduleUserDeletion(userId int, deleteAfter time.Time) (User, error) {
+	user := User{}
+	err := db.update(func(data *DBStructure) error {
+		var ok bool
+		user, ok = data.Users[userId]
+		if !ok {
+			return errors.New("unable to find user")
+		}
+
+		user.DeleteAfter = deleteAfter
+		data.Users[userId] = user
+
+		data.revokeUserSessions(userId)
+		now := time.Now().UTC()
+		for id, key := range data.APIKeys {
+			if key.UserId == userId && key.RevokedAt.IsZero() {
+				key.RevokedAt = now
+				data.APIKeys[id] = key
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+func (db *DB) CancelUserDeletion(userId int) error {
+	_, err := db.updateUser(userId, func(user *User) error {
+		user.DeleteAfter = time.Time{}
+		return nil
+	})
+	return err
+}
+
+// GetUsersDueForDeletion returns users whose grace period ended before now.
+func (db *DB) GetUsersDueForDeletion(now time.Time) ([]User, error) {
+	data, err := db.loadDB()
+	if err != nil {
+		return []User{}, err
+	}
+
+	users := []User{}
+	for _, user := range data.Users {
+		if user.IsPendingDeletion() && now.After(user.DeleteAfter) {
+			users = append(users, user)
+		}
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Id < users[j].Id
+	})
+
+	return users, nil
+}
+
+// PurgeUser permanently removes userId along with their chirps, data
+// exports, reports by or about them and every credential they held, and
+// forgets the login throttles kept under throttleKeys. Outbox events and
+// outbound webhook deliveries about them are deleted, whether or not they
+// were handled, and the payloads of inbound webhooks about them are erased,
+// keeping the event ids so replays are still refused. Audit entries keep the
+// bare user id, which no longer leads to any personal data.
+func (db *DB) PurgeUser(userId int, throttleKeys []string) error {
+	return db.update(func(data *DBStructure) error {
+		if _, ok := data.Users[userId]; !ok {
+			return errors.New("unable to find user")
+		}
+		delete(data.Users, userId)
+
+		for id, chirp := range data.Chirps {
+			if chirp.AuthorId == userId {
+				delete(data.Chirps, id)
+				data.forgetChirp(id)
+			}
+		}
+
+		clients := map[string]bool{}
+		for id, client := range data.OAuthClients {
+			if client.OwnerId == userId {
+				clients[id] = true
+				delete(data.OAuthClients, id)
+			}
+		}
+		for hash, code := range data.OAuthCodes {
+			if code.UserId == userId || clients[code.ClientId] {
+				delete(data.OAuthCodes, hash)
+			}
+		}
+
+		now := time.Now().UTC()
+		for hash, token := range data.RefreshTokens {
+			if token.UserId == userId {
+				delete(data.RefreshTokens, hash)
+			} else if clients[token.ClientId] && token.RevokedAt.IsZero() {
+				token.RevokedAt = now
+				data.RefreshTokens[hash] = token
+			}
+		}
+
+		for id, key := range data.APIKeys {
+			if key.UserId == userId {
+				delete(data.APIKeys, id)
+			}
+		}
+		for id, link := range data.MagicLinks {
+			if link.UserId == userId {
+				delete(data.MagicLinks, id)
+			}
+		}
+		for id, export := range data.DataExports {
+			if export.UserId == userId {
+				delete(data.DataExports, id)
+			}
+		}
+		data.forgetRelations(userId)
+		data.forgetNotifications(userId)
+		for id, report := range data.Reports {
+			if report.ReporterId == userId || report.TargetUserId == userId {
+				delete(data.Reports, id)
+			}
+		}
+		for _, key := range throttleKeys {
+			delete(data.LoginThrottles, key)
+			delete(data.MagicLinkRequests, key)
+		}
+
+		for id, event := range data.Outbox {
+			if payloadMentionsUser(event.Payload, userId) {
+				delete(data.Outbox, id)
+			}
+		}
+		for id, delivery := range data.WebhookDeliveries {
+			if payloadMentionsUser([]byte(delivery.Payload), userId) {
+				delete(data.WebhookDeliveries, id)
+			}
+		}
+		for id, inbound := range data.InboundWebhooks {
+			if payloadMentionsUser([]byte(inbound.Payload), userId) {
+				inbound.Payload = ""
+				data.InboundWebhooks[id] = inbound
+			}
+		}
+		return nil
+	})
+}
+
+// payloadMentionsUser reports whether any of userIdFields, at any depth of
+// the JSON in payload, is userId.
+func payloadMentionsUser(payload []byte, userId int) bool {
+	var v interface{}
+	err := json.Unmarshal(payload, &v)
+	if err != nil {
+		return false
+	}
+	return mentionsUser(v, float64(userId))
+}
+
+func mentionsUser(v interface{}, userId float64) bool {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if id, ok := value.(float64); ok && id == userId && userIdFields[key] {
+				return true
+			}
+			if mentionsUser(value, userId) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, value := range v {
+			if mentionsUser(value, userId) {
+				return true
+			}
+		}
+	}
+	return false
+}
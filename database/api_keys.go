@@ -0,0 +1,130 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// APIKey is a long-lived credential a user creates for a bot or
+// integration. Only the SHA-256 hash of the key is stored; Prefix is kept in
+// the clear so users can tell their keys apart.
+type APIKey struct {
+	Id         int       `json:"id"`
+	UserId     int       `json:"user_id"`
+	Name       string    `json:"name"`
+	Prefix     string    `json:"prefix"`
+	KeyHash    string    `json:"key_hash"`
+	Scopes     []string  `json:"scopes"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	RevokedAt  time.Time `json:"revoked_at"`
+}
+
+func (k APIKey) IsActive(now time.Time) bool {
+	if !k.RevokedAt.IsZero() {
+		return false
+	}
+	return k.ExpiresAt.IsZero() || now.Before(k.ExpiresAt)
+}
+
+func (db *DB) CreateAPIKey(key APIKey) (APIKey, error) {
+	err := db.update(func(data *DBStructure) error {
+		if _, ok := data.Users[key.UserId]; !ok {
+			return errors.New("unable to find user")
+		}
+
+		key.Id = nextId(data, "api_keys", data.APIKeys)
+		key.CreatedAt = time.Now().UTC()
+		data.APIKeys[key.Id] = key
+		return nil
+	})
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	return key, nil
+}
+
+func (db *DB) GetAPIKeysForUser(userId int) ([]APIKey, error) {
+	data, err := db.loadDB()
+	if err != nil {
+		return []APIKey{}, err
+	}
+
+	keys := []APIKey{}
+	for _, key := range data.APIKeys {
+		if key.UserId == userId {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Id < keys[j].Id
+	})
+
+	return keys, nil
+}
+
+// GetAPIKeyByHash returns the active key with the given hash.
+func (db *DB) GetAPIKeyByHash(keyHash string) (APIKey, error) {
+	data, err := db.loadDB()
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	for _, key := range data.APIKeys {
+		if key.KeyHash == keyHash && key.IsActive(time.Now()) {
+			return key, nil
+		}
+	}
+
+	return APIKey{}, errors.New("invalid api key")
+}
+
+// TouchAPIKeys records when each key in usedAt was last used. Keys that no
+// longer exist are skipped.
+func (db *DB) TouchAPIKeys(usedAt map[int]time.Time) error {
+	return db.update(func(data *DBStructure) error {
+		changed := false
+		for id, at := range usedAt {
+			key, ok := data.APIKeys[id]
+			if !ok || !at.After(key.LastUsedAt) {
+				continue
+			}
+
+			key.LastUsedAt = at
+			data.APIKeys[id] = key
+			changed = true
+		}
+
+		if !changed {
+			return errUnchanged
+		}
+		return nil
+	})
+}
+
+func (db *DB) RevokeAPIKey(userId, id int) (APIKey, error) {
+	key := APIKey{}
+	err := db.update(func(data *DBStructure) error {
+		var ok bool
+		key, ok = data.APIKeys[id]
+		if !ok || key.UserId != userId {
+			return errors.New("unable to find api key")
+		}
+		if !key.RevokedAt.IsZero() {
+			return errUnchanged
+		}
+
+		key.RevokedAt = time.Now().UTC()
+		data.APIKeys[id] = key
+		return nil
+	})
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	return key, nil
+}
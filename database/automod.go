@@ -0,0 +1,62 @@
+package database
+
+import (
+	"sort"
+	"time"
+)
+
+// ChirpReview is what automod decided about a chirp being saved. The zero
+// value publishes it.
+type ChirpReview struct {
+	// HoldDetail, when set, hides the chirp from everyone but its author
+	// until a moderator unhides it, and files an automod report with it.
+	HoldDetail string
+	// ShadowHideRule, when set, hides the chirp from everyone but its author
+	// without telling them, recording the rule responsible.
+	ShadowHideRule string
+}
+
+func (data *DBStructure) review(chirp *Chirp, review ChirpReview) {
+	if review.ShadowHideRule != "" {
+		data.ShadowHidden[chirp.Id] = review.ShadowHideRule
+	}
+	if review.HoldDetail == "" {
+		return
+	}
+
+	chirp.Hidden = true
+	id := nextId(data, "reports", data.Reports)
+	data.Reports[id] = Report{
+		Id:           id,
+		TargetType:   ReportTargetChirp,
+		TargetId:     chirp.Id,
+		TargetUserId: chirp.AuthorId,
+		Reason:       ReportAutomod,
+		Detail:       review.HoldDetail,
+		Status:       ReportOpen,
+		CreatedAt:    time.Now().UTC(),
+	}
+}
+
+// GetRecentChirpsByAuthor returns every chirp authorId created since since,
+// including hidden ones, newest first. Chirps without a creation time are
+// left out.
+func (db *DB) GetRecentChirpsByAuthor(authorId int, since time.Time) ([]Chirp, error) {
+	data, err := db.loadDB()
+	if err != nil {
+		return []Chirp{}, err
+	}
+
+	chirps := []Chirp{}
+	for _, chirp := range data.Chirps {
+		if chirp.AuthorId == authorId && chirp.CreatedAt.After(since) {
+			chirps = append(chirps, chirp)
+		}
+	}
+
+	sort.Slice(chirps, func(i, j int) bool {
+		return chirps[i].Id > chirps[j].Id
+	})
+
+	return chirps, nil
+}
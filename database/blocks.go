@@ -0,0 +1,125 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// Relation is one entry in a user's block or mute list.
+type Relation struct {
+	UserId    int       `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// BlockUser also ends any follow between the two users, in either
+// direction, including pending requests.
+func (db *DB) BlockUser(userId, targetId int) error {
+	return db.addRelation(userId, targetId, func(data *DBStructure) map[int]map[int]time.Time {
+		data.removeFollow(userId, targetId)
+		data.removeFollow(targetId, userId)
+		return data.Blocks
+	})
+}
+
+func (db *DB) UnblockUser(userId, targetId int) error {
+	return db.removeRelation(userId, targetId, func(data *DBStructure) map[int]map[int]time.Time {
+		return data.Blocks
+	})
+}
+
+func (db *DB) MuteUser(userId, targetId int) error {
+	return db.addRelation(userId, targetId, func(data *DBStructure) map[int]map[int]time.Time {
+		return data.Mutes
+	})
+}
+
+func (db *DB) UnmuteUser(userId, targetId int) error {
+	return db.removeRelation(userId, targetId, func(data *DBStructure) map[int]map[int]time.Time {
+		return data.Mutes
+	})
+}
+
+func (db *DB) GetBlockedUsers(userId int) ([]Relation, error) {
+	data, err := db.loadDB()
+	if err != nil {
+		return []Relation{}, err
+	}
+	return relationList(data.Blocks[userId]), nil
+}
+
+func (db *DB) GetMutedUsers(userId int) ([]Relation, error) {
+	data, err := db.loadDB()
+	if err != nil {
+		return []Relation{}, err
+	}
+	return relationList(data.Mutes[userId]), nil
+}
+
+func (db *DB) addRelation(userId, targetId int, table func(*DBStructure) map[int]map[int]time.Time) error {
+	if userId == targetId {
+		return errors.New("you can't do that to yourself")
+	}
+
+	return db.update(func(data *DBStructure) error {
+		if _, ok := data.Users[targetId]; !ok {
+			return errors.New("unable to find user")
+		}
+
+		relations := table(data)
+		if relations[userId] == nil {
+			relations[userId] = map[int]time.Time{}
+		}
+		if _, ok := relations[userId][targetId]; ok {
+			return errUnchanged
+		}
+		relations[userId][targetId] = time.Now().UTC()
+		return nil
+	})
+}
+
+func (db *DB) removeRelation(userId, targetId int, table func(*DBStructure) map[int]map[int]time.Time) error {
+	return db.update(func(data *DBStructure) error {
+		relations := table(data)
+		if _, ok := relations[userId][targetId]; !ok {
+			return errors.New("unable to find user in list")
+		}
+		delete(relations[userId], targetId)
+		if len(relations[userId]) == 0 {
+			delete(relations, userId)
+		}
+		return nil
+	})
+}
+
+// forgetRelations drops every block, mute and follow made by or against
+// userId.
+func (data *DBStructure) forgetRelations(userId int) {
+	delete(data.Follows, userId)
+	for follower := range data.Follows {
+		data.removeFollow(follower, userId)
+	}
+
+	for _, relations := range []map[int]map[int]time.Time{data.Blocks, data.Mutes} {
+		delete(relations, userId)
+		for owner, targets := range relations {
+			delete(targets, userId)
+			if len(targets) == 0 {
+				delete(relations, owner)
+			}
+		}
+	}
+}
+
+func relationList(targets map[int]time.Time) []Relation {
+	list := make([]Relation, 0, len(targets))
+	for userId, createdAt := range targets {
+		list = append(list, Relation{UserId: userId, CreatedAt: createdAt})
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.After(list[j].CreatedAt)
+	})
+
+	return list
+}
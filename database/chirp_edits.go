@@ -0,0 +1,73 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrEditWindowClosed = errors.New("this chirp can no longer be edited")
+	ErrChirpLabeled     = errors.New("this chirp has been reviewed by a moderator and can't be edited")
+)
+
+// EditChirp replaces the body of authorId's chirp, applying review to the
+// new body. A chirp can be edited for window after it was published, or
+// until then if it is scheduled. Chirps a moderator has labeled as spam or
+// not spam can't be edited, so the classifier's training stays true to
+// them. Chirps by someone else return ErrChirpNotFound.
+func (db *DB) EditChirp(chirpId, authorId int, body string, window time.Duration, review ChirpReview) (Chirp, error) {
+	chirp := Chirp{}
+	err := db.update(func(data *DBStructure) error {
+		var ok bool
+		chirp, ok = data.Chirps[chirpId]
+		if !ok || chirp.AuthorId != authorId {
+			return ErrChirpNotFound
+		}
+
+		if _, ok := data.SpamLabels[chirpId]; ok {
+			return ErrChirpLabeled
+		}
+
+		now := time.Now().UTC()
+		published := chirp.CreatedAt
+		if chirp.PublishAt != nil {
+			published = *chirp.PublishAt
+		}
+		if chirp.CreatedAt.IsZero() || now.After(published.Add(window)) {
+			return ErrEditWindowClosed
+		}
+
+		chirp.Body = body
+		chirp.EditedAt = &now
+		data.review(&chirp, review)
+		data.Chirps[chirpId] = chirp
+		return data.publishChirp(chirpId, now)
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return chirp, nil
+}
+
+// CountScheduledChirps returns how many of authorId's chirps are waiting to
+// be published.
+func (db *DB) CountScheduledChirps(authorId int, now time.Time) (int, error) {
+	data, err := db.loadDB()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, chirp := range data.Chirps {
+		if chirp.AuthorId == authorId && chirp.IsScheduled(now) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// IsScheduled reports whether c is still waiting to be published at now.
+func (c Chirp) IsScheduled(now time.Time) bool {
+	return c.PublishAt != nil && c.PublishAt.After(now)
+}
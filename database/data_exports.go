@@ -0,0 +1,140 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+const (
+	ExportPending  = "pending"
+	ExportRunning  = "running"
+	ExportComplete = "complete"
+	ExportFailed   = "failed"
+)
+
+// DataExport is a request by a user for a copy of their personal data. The
+// zip it produces is kept as FileName inside the export directory until
+// ExpiresAt.
+type DataExport struct {
+	Id          int       `json:"id"`
+	UserId      int       `json:"user_id"`
+	Status      string    `json:"status"`
+	Progress    int       `json:"progress"`
+	Error       string    `json:"error"`
+	FileName    string    `json:"file_name"`
+	CreatedAt   time.Time `json:"created_at"`
+	CompletedAt time.Time `json:"completed_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// IsActive reports whether the export is still being assembled.
+func (e DataExport) IsActive() bool {
+	return e.Status == ExportPending || e.Status == ExportRunning
+}
+
+// CreateDataExport queues a new export for userId, or returns the one that is
+// already in progress so repeated requests don't pile up jobs.
+func (db *DB) CreateDataExport(userId int) (DataExport, bool, error) {
+	export := DataExport{}
+	created := false
+	err := db.update(func(data *DBStructure) error {
+		if _, ok := data.Users[userId]; !ok {
+			return errors.New("unable to find user")
+		}
+
+		for _, existing := range data.DataExports {
+			if existing.UserId == userId && existing.IsActive() {
+				export = existing
+				return errUnchanged
+			}
+		}
+
+		export = DataExport{
+			Id:        nextId(data, "data_exports", data.DataExports),
+			UserId:    userId,
+			Status:    ExportPending,
+			CreatedAt: time.Now().UTC(),
+		}
+		data.DataExports[export.Id] = export
+		created = true
+		return nil
+	})
+	if err != nil {
+		return DataExport{}, false, err
+	}
+
+	return export, created, nil
+}
+
+func (db *DB) GetDataExport(id int) (DataExport, error) {
+	data, err := db.loadDB()
+	if err != nil {
+		return DataExport{}, err
+	}
+
+	export, ok := data.DataExports[id]
+	if !ok {
+		return DataExport{}, errors.New("unable to find export")
+	}
+
+	return export, nil
+}
+
+// GetDataExports returns every export, oldest first.
+func (db *DB) GetDataExports() ([]DataExport, error) {
+	data, err := db.loadDB()
+	if err != nil {
+		return []DataExport{}, err
+	}
+
+	exports := make([]DataExport, 0, len(data.DataExports))
+	for _, export := range data.DataExports {
+		exports = append(exports, export)
+	}
+
+	sort.Slice(exports, func(i, j int) bool {
+		return exports[i].Id < exports[j].Id
+	})
+
+	return exports, nil
+}
+
+func (db *DB) UpdateDataExport(export DataExport) error {
+	return db.update(func(data *DBStructure) error {
+		if _, ok := data.DataExports[export.Id]; !ok {
+			return errors.New("unable to find export")
+		}
+		data.DataExports[export.Id] = export
+		return nil
+	})
+}
+
+func (db *DB) DeleteDataExport(id int) error {
+	return db.update(func(data *DBStructure) error {
+		delete(data.DataExports, id)
+		return nil
+	})
+}
+
+// GetRefreshTokensForUser returns every refresh token issued to userId,
+// including rotated and revoked ones, oldest first.
+func (db *DB) GetRefreshTokensForUser(userId int) ([]RefreshToken, error) {
+	data, err := db.loadDB()
+	if err != nil {
+		return []RefreshToken{}, err
+	}
+
+	tokens := []RefreshToken{}
+	for _, token := range data.RefreshTokens {
+		if token.UserId == userId {
+			tokens = append(tokens, token)
+		}
+	}
+
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+
+	return tokens, nil
+}
@@ -11,34 +11,121 @@ import (
 )
 
 type DB struct {
-	path string
-	mux  *sync.RWMutex
+	path      string
+	mux       *sync.RWMutex
+	published chan struct{}
 }
 
 type Chirp struct {
-	Id       int    `json:"id"`
-	Body     string `json:"body"`
-	AuthorId int    `json:"author_id"`
+	Id        int    `json:"id"`
+	Body      string `json:"body"`
+	AuthorId  int    `json:"author_id"`
+	ReplyToId int    `json:"reply_to_id,omitempty"`
+	Hidden    bool   `json:"hidden,omitempty"`
+	// CreatedAt is zero for chirps saved before it was recorded.
+	CreatedAt time.Time `json:"created_at"`
+	// PublishAt is set for scheduled chirps, which only their author sees
+	// until then.
+	PublishAt *time.Time `json:"publish_at,omitempty"`
+	EditedAt  *time.Time `json:"edited_at,omitempty"`
 }
 
+var (
+	ErrChirpNotFound = errors.New("unable to find chirp")
+	ErrUserNotFound  = errors.New("unable to find user")
+)
+
 type User struct {
-	Id           int       `json:"id"`
-	Email        string    `json:"email"`
-	Password     string    `json:"password"`
-	RefreshToken string    `json:"refresh_token"`
-	ExpiresAt    time.Time `json:"expires_at"`
-	IsChirpyRed  bool      `json:"is_chirpy_red"`
+	Id        int    `json:"id"`
+	Email     string `json:"email"`
+	Password  string `json:"password"`
+	Role      string `json:"role"`
+	Protected bool   `json:"protected"`
+	// CreatedAt is zero for accounts created before it was recorded.
+	CreatedAt time.Time `json:"created_at"`
+
+	TOTPSecret    string   `json:"totp_secret"`
+	TOTPEnabled   bool     `json:"totp_enabled"`
+	TOTPLastStep  int64    `json:"totp_last_step"`
+	RecoveryCodes []string `json:"recovery_codes"`
+
+	DeleteAfter time.Time `json:"delete_after"`
+
+	Warnings         int       `json:"warnings"`
+	SuspendedUntil   time.Time `json:"suspended_until"`
+	BannedAt         time.Time `json:"banned_at"`
+	SuspensionReason string    `json:"suspension_reason"`
+	ChirpsHidden     bool      `json:"chirps_hidden"`
+
+	Subscription Subscription `json:"subscription"`
+	// LegacyChirpyRed is set for users upgraded before subscriptions were
+	// tracked, until ExpireSubscriptions gives them a subscription.
+	LegacyChirpyRed bool `json:"is_chirpy_red,omitempty"`
+}
+
+// IsPendingDeletion reports whether u has asked for their account to be
+// deleted and can still cancel by logging in.
+func (u User) IsPendingDeletion() bool {
+	return !u.DeleteAfter.IsZero()
 }
 
 type DBStructure struct {
-	Chirps map[int]Chirp `json:"chirps"`
-	Users  map[int]User  `json:"users"`
+	Chirps         map[int]Chirp            `json:"chirps"`
+	Users          map[int]User             `json:"users"`
+	RefreshTokens  map[string]RefreshToken  `json:"refresh_tokens"`
+	AuditLog       []AuditEntry             `json:"audit_log"`
+	LoginThrottles map[string]LoginThrottle `json:"login_throttles"`
+	APIKeys        map[int]APIKey           `json:"api_keys"`
+
+	OAuthClients        map[string]OAuthClient `json:"oauth_clients"`
+	OAuthCodes          map[string]OAuthCode   `json:"oauth_codes"`
+	RevokedAccessTokens map[string]time.Time   `json:"revoked_access_tokens"`
+
+	MagicLinks        map[string]MagicLink   `json:"magic_links"`
+	MagicLinkRequests map[string][]time.Time `json:"magic_link_requests"`
+
+	DataExports map[int]DataExport `json:"data_exports"`
+
+	Blocks map[int]map[int]time.Time `json:"blocks"`
+	Mutes  map[int]map[int]time.Time `json:"mutes"`
+
+	Follows map[int]map[int]Follow `json:"follows"`
+
+	Reports map[int]Report `json:"reports"`
+
+	// ShadowHidden maps chirps automod has hidden from everyone but their
+	// author to the rule that hid them. It is kept apart from Chirp so it
+	// never appears in a response.
+	ShadowHidden map[int]string `json:"shadow_hidden"`
+
+	// Unpublished holds chirps that were held, shadow hidden or scheduled
+	// when they were created, until chirp.published goes out for them.
+	Unpublished map[int]bool `json:"unpublished"`
+
+	SpamScores map[int]float64   `json:"spam_scores"`
+	SpamLabels map[int]SpamLabel `json:"spam_labels"`
+
+	InboundWebhooks map[int]InboundWebhook `json:"inbound_webhooks"`
+
+	Webhooks          map[int]Webhook         `json:"webhooks"`
+	WebhookDeliveries map[int]WebhookDelivery `json:"webhook_deliveries"`
+
+	Notifications map[int]Notification `json:"notifications"`
+
+	Outbox            map[int]OutboxEvent         `json:"outbox"`
+	OutboxCheckpoints map[string]OutboxCheckpoint `json:"outbox_checkpoints"`
+
+	Sequences map[string]int `json:"sequences"`
+
+	// published is set when this write adds to the outbox.
+	published bool
 }
 
 func NewDB(path string) (*DB, error) {
 	db := &DB{
-		path: path,
-		mux:  &sync.RWMutex{},
+		path:      path,
+		mux:       &sync.RWMutex{},
+		published: make(chan struct{}, 1),
 	}
 
 	err := db.ensureDB()
@@ -49,28 +136,48 @@ func NewDB(path string) (*DB, error) {
 	return db, nil
 }
 
-func (db *DB) CreateChirp(body string, authorId int) (Chirp, error) {
-	data, err := db.loadDB()
-	if err != nil {
-		log.Fatal("Unable to create chirp")
-		return Chirp{}, err
-	}
+// CreateChirp saves chirp's body by its author, as a reply when ReplyToId
+// is set and scheduled when PublishAt is set, applying review. Replying to a
+// chirp the author can't see returns ErrChirpNotFound.
+func (db *DB) CreateChirp(chirp Chirp, review ChirpReview) (Chirp, error) {
+	err := db.update(func(data *DBStructure) error {
+		if chirp.ReplyToId != 0 {
+			parent, ok := data.Chirps[chirp.ReplyToId]
+			if !ok || !data.canSeeChirp(chirp.AuthorId, parent) {
+				return ErrChirpNotFound
+			}
+		}
 
-	id := len(data.Chirps) + 1
-	chirp := Chirp{
-		Body:     body,
-		Id:       id,
-		AuthorId: authorId,
-	}
+		chirp = Chirp{
+			Body:      chirp.Body,
+			Id:        nextId(data, "chirps", data.Chirps),
+			AuthorId:  chirp.AuthorId,
+			ReplyToId: chirp.ReplyToId,
+			CreatedAt: time.Now().UTC(),
+			PublishAt: chirp.PublishAt,
+		}
+		data.review(&chirp, review)
 
-	data.Chirps[id] = chirp
+		data.Chirps[chirp.Id] = chirp
+		data.Unpublished[chirp.Id] = true
 
-	db.writeDB(data)
+		err := data.publish(EventChirpCreated, chirp)
+		if err != nil {
+			return err
+		}
+		return data.publishChirp(chirp.Id, chirp.CreatedAt)
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
 
 	return chirp, nil
 }
 
-func (db *DB) GetChirps(authorId int, sortBy string) ([]Chirp, error) {
+// GetChirps lists chirps by authorId, or by everyone when authorId is 0, as
+// seen by viewerId. Chirps viewerId isn't allowed to see and chirps by
+// authors viewerId has muted are left out.
+func (db *DB) GetChirps(viewerId, authorId int, sortBy string) ([]Chirp, error) {
 	data, err := db.loadDB()
 	if err != nil {
 		return []Chirp{}, err
@@ -78,6 +185,9 @@ func (db *DB) GetChirps(authorId int, sortBy string) ([]Chirp, error) {
 
 	chirps := make([]Chirp, 0, len(data.Chirps))
 	for _, chirp := range data.Chirps {
+		if !data.canSeeChirp(viewerId, chirp) || data.hasMuted(viewerId, chirp.AuthorId) {
+			continue
+		}
 		if authorId == chirp.AuthorId {
 			chirps = append(chirps, chirp)
 		} else if authorId == 0 {
@@ -98,38 +208,53 @@ func (db *DB) GetChirps(authorId int, sortBy string) ([]Chirp, error) {
 	return chirps, nil
 }
 
-func (db *DB) GetChirpById(id int) (Chirp, error) {
+// GetChirpById returns ErrChirpNotFound when the chirp doesn't exist or
+// viewerId isn't allowed to see it. Muting doesn't hide a chirp fetched by
+// id.
+func (db *DB) GetChirpById(viewerId, id int) (Chirp, error) {
 	data, err := db.loadDB()
 	if err != nil {
 		return Chirp{}, err
 	}
 
 	chirp, ok := data.Chirps[id]
-	if !ok {
-		return Chirp{}, errors.New("unable to find entry")
+	if !ok || !data.canSeeChirp(viewerId, chirp) {
+		return Chirp{}, ErrChirpNotFound
 	}
 
 	return chirp, nil
 }
 
 func (db *DB) DeleteChirpById(chirpId, userId int) error {
+	return db.update(func(data *DBStructure) error {
+		chirp, ok := data.Chirps[chirpId]
+		if !ok {
+			return errors.New("could not find chirp")
+		}
+
+		if chirp.AuthorId != userId {
+			return errors.New("unable to delete chirp")
+		}
+
+		delete(data.Chirps, chirpId)
+		data.forgetChirp(chirpId)
+
+		return data.publish(EventChirpDeleted, ChirpDeletedEvent{Id: chirp.Id, AuthorId: chirp.AuthorId})
+	})
+}
+
+func (db *DB) GetUserById(id int) (User, error) {
 	data, err := db.loadDB()
 	if err != nil {
-		return err
+		return User{}, err
 	}
 
-	chirp, ok := data.Chirps[chirpId]
+	user, ok := data.Users[id]
 	if !ok {
-		return errors.New("could not find chirp")
-	}
-
-	if chirp.AuthorId != userId {
-		return errors.New("unable to delete chirp")
+		return User{}, errors.New("unable to find user")
 	}
 
-	delete(data.Chirps, chirpId)
-
-	return db.writeDB(data)
+	return user, nil
 }
 
 func (db *DB) GetUserByEmail(email string) (User, error) {
@@ -148,145 +273,167 @@ func (db *DB) GetUserByEmail(email string) (User, error) {
 }
 
 func (db *DB) CreateUser(email, password string) (User, error) {
-	data, err := db.loadDB()
-	if err != nil {
-		log.Fatal("Unable to create chirp")
-		return User{}, err
-	}
-
-	hasDupEmail := db.checkDuplicateEmails(email)
-	if hasDupEmail {
-		return User{}, errors.New("email already in use")
-	}
+	return db.CreateUserWithRole(email, password, RoleUser)
+}
 
-	id := len(data.Users) + 1
-	user := User{
-		Id:       id,
-		Email:    email,
-		Password: password,
+func (db *DB) CreateUserWithRole(email, password, role string) (User, error) {
+	if !IsValidRole(role) {
+		return User{}, errors.New("invalid role")
 	}
 
-	data.Users[id] = user
+	user := User{}
+	err := db.update(func(data *DBStructure) error {
+		if data.hasEmail(email) {
+			return errors.New("email already in use")
+		}
 
-	db.writeDB(data)
+		user = User{
+			Id:        nextId(data, "users", data.Users),
+			Email:     email,
+			Password:  password,
+			Role:      role,
+			CreatedAt: time.Now().UTC(),
+		}
+		data.Users[user.Id] = user
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
 
 	return user, nil
 }
 
 func (db *DB) UpdateUser(id int, u User) (User, error) {
-	data, err := db.loadDB()
-	if err != nil {
-		log.Fatal("Unable to load db")
-		return User{}, err
-	}
-	user, ok := data.Users[id]
-	if !ok {
-		return User{}, errors.New("unable to find user")
-	}
+	return db.updateUser(id, func(user *User) error {
+		user.Email = u.Email
+		user.Password = u.Password
+		return nil
+	})
+}
 
-	if user.RefreshToken == "" {
-		user.RefreshToken = u.RefreshToken
-		user.ExpiresAt = u.ExpiresAt
-	}
-	user.Email = u.Email
-	user.Password = u.Password
+func (db *DB) UpdatePasswordHash(userId int, hash string) error {
+	_, err := db.updateUser(userId, func(user *User) error {
+		user.Password = hash
+		return nil
+	})
+	return err
+}
 
-	data.Users[id] = user
+// RemoveChirp deletes a chirp regardless of its author, for moderators.
+func (db *DB) RemoveChirp(chirpId int) (Chirp, error) {
+	chirp := Chirp{}
+	err := db.update(func(data *DBStructure) error {
+		var ok bool
+		chirp, ok = data.Chirps[chirpId]
+		if !ok {
+			return errors.New("could not find chirp")
+		}
 
-	return user, db.writeDB(data)
-}
+		delete(data.Chirps, chirpId)
+		data.forgetChirp(chirpId)
 
-func (db *DB) ConfirmUserToken(token string) (User, error) {
-	data, err := db.loadDB()
+		return data.publish(EventChirpDeleted, ChirpDeletedEvent{Id: chirp.Id, AuthorId: chirp.AuthorId})
+	})
 	if err != nil {
-		log.Fatal("Unable to load db")
-		return User{}, err
+		return Chirp{}, err
 	}
 
-	user, err := db.findUserByToken(data, token)
-	if err != nil {
-		return User{}, err
-	}
+	return chirp, nil
+}
 
-	if time.Now().Before(user.ExpiresAt) {
-		return user, nil
+// nextId allocates the next id for the rows table. Ids are never reused,
+// even after the newest row is deleted, so a stale token or audit entry
+// can't end up pointing at someone else's row.
+func nextId[T any](data *DBStructure, table string, rows map[int]T) int {
+	id := data.Sequences[table]
+	for existing := range rows {
+		if existing > id {
+			id = existing
+		}
 	}
-
-	return User{}, errors.New("token does not exist on user")
+	id++
+	data.Sequences[table] = id
+	return id
 }
 
-func (db *DB) RevokeUserToken(token string) error {
-	data, err := db.loadDB()
-	if err != nil {
-		log.Fatal("Unable to load db")
-		return err
-	}
+func (db *DB) createDB() error {
+	dbStructure := DBStructure{}
+	dbStructure.ensureMaps()
+	return db.saveDB(dbStructure)
+}
 
-	user, err := db.findUserByToken(data, token)
-	if err != nil {
-		return err
+func (db *DB) ensureDB() error {
+	_, err := os.ReadFile(db.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return db.createDB()
 	}
+	return err
+}
 
-	user.RefreshToken = ""
-	user.ExpiresAt = time.Time{}
-	data.Users[user.Id] = user
+// loadDB reads the database for a query. Anything that changes it goes
+// through update instead.
+func (db *DB) loadDB() (DBStructure, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
 
-	return db.writeDB(data)
+	return db.readDB()
 }
 
-func (db *DB) UpgradeUser(userId int) error {
-	data, err := db.loadDB()
+// update loads the database, applies change and saves the result, holding
+// the write lock throughout so concurrent updates can't overwrite each
+// other. Nothing is saved when change returns an error; errUnchanged skips
+// the save without failing. change must not call other DB methods.
+func (db *DB) update(change func(data *DBStructure) error) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	data, err := db.readDB()
 	if err != nil {
-		log.Fatal("Unable to load db")
 		return err
 	}
 
-	user, ok := data.Users[userId]
-	if !ok {
-		return errors.New("unable to get user.")
+	err = change(&data)
+	if errors.Is(err, errUnchanged) {
+		return nil
 	}
-
-	user.IsChirpyRed = true
-
-	data.Users[userId] = user
-
-	return db.writeDB(data)
-
-}
-
-func (db *DB) createDB() error {
-	dbStructure := DBStructure{
-		Chirps: map[int]Chirp{},
-		Users:  map[int]User{},
+	if err != nil {
+		return err
 	}
-	return db.writeDB(dbStructure)
+
+	return db.saveDB(data)
 }
 
-func (db *DB) findUserByToken(data DBStructure, token string) (User, error) {
-	db.mux.RLock()
-	defer db.mux.RUnlock()
+// updateUser applies change to userId within update and returns the saved
+// user.
+func (db *DB) updateUser(userId int, change func(user *User) error) (User, error) {
+	user := User{}
+	err := db.update(func(data *DBStructure) error {
+		var ok bool
+		user, ok = data.Users[userId]
+		if !ok {
+			return ErrUserNotFound
+		}
 
-	for _, u := range data.Users {
-		if u.RefreshToken == token {
-			return u, nil
+		err := change(&user)
+		if err != nil {
+			return err
 		}
+		data.Users[userId] = user
+		return nil
+	})
+	if err != nil {
+		return User{}, err
 	}
 
-	return User{}, errors.New("Unable to find user token")
-}
-
-func (db *DB) ensureDB() error {
-	_, err := os.ReadFile(db.path)
-	if errors.Is(err, os.ErrNotExist) {
-		return db.createDB()
-	}
-	return err
+	return user, nil
 }
 
-func (db *DB) loadDB() (DBStructure, error) {
-	db.mux.RLock()
-	defer db.mux.RUnlock()
+// errUnchanged lets an update that found nothing to change finish without
+// saving.
+var errUnchanged = errors.New("nothing changed")
 
+func (db *DB) readDB() (DBStructure, error) {
 	data, err := os.ReadFile(db.path)
 	if err != nil {
 		log.Fatal("Unable to read from database.")
@@ -297,14 +444,98 @@ func (db *DB) loadDB() (DBStructure, error) {
 	if err != nil {
 		return DBStructure{}, err
 	}
+	chirps.ensureMaps()
 
 	return chirps, nil
 }
 
-func (db *DB) writeDB(dbStructure DBStructure) error {
-	db.mux.Lock()
-	defer db.mux.Unlock()
+// ensureMaps initializes any collections missing from older db.json files so
+// callers can write into them without checking for nil.
+func (data *DBStructure) ensureMaps() {
+	if data.Chirps == nil {
+		data.Chirps = map[int]Chirp{}
+	}
+	if data.Users == nil {
+		data.Users = map[int]User{}
+	}
+	if data.RefreshTokens == nil {
+		data.RefreshTokens = map[string]RefreshToken{}
+	}
+	if data.AuditLog == nil {
+		data.AuditLog = []AuditEntry{}
+	}
+	if data.LoginThrottles == nil {
+		data.LoginThrottles = map[string]LoginThrottle{}
+	}
+	if data.APIKeys == nil {
+		data.APIKeys = map[int]APIKey{}
+	}
+	if data.OAuthClients == nil {
+		data.OAuthClients = map[string]OAuthClient{}
+	}
+	if data.OAuthCodes == nil {
+		data.OAuthCodes = map[string]OAuthCode{}
+	}
+	if data.RevokedAccessTokens == nil {
+		data.RevokedAccessTokens = map[string]time.Time{}
+	}
+	if data.MagicLinks == nil {
+		data.MagicLinks = map[string]MagicLink{}
+	}
+	if data.MagicLinkRequests == nil {
+		data.MagicLinkRequests = map[string][]time.Time{}
+	}
+	if data.DataExports == nil {
+		data.DataExports = map[int]DataExport{}
+	}
+	if data.Blocks == nil {
+		data.Blocks = map[int]map[int]time.Time{}
+	}
+	if data.ShadowHidden == nil {
+		data.ShadowHidden = map[int]string{}
+	}
+	if data.Unpublished == nil {
+		data.Unpublished = map[int]bool{}
+	}
+	if data.Webhooks == nil {
+		data.Webhooks = map[int]Webhook{}
+	}
+	if data.WebhookDeliveries == nil {
+		data.WebhookDeliveries = map[int]WebhookDelivery{}
+	}
+	if data.Notifications == nil {
+		data.Notifications = map[int]Notification{}
+	}
+	if data.Outbox == nil {
+		data.Outbox = map[int]OutboxEvent{}
+	}
+	if data.OutboxCheckpoints == nil {
+		data.OutboxCheckpoints = map[string]OutboxCheckpoint{}
+	}
+	if data.InboundWebhooks == nil {
+		data.InboundWebhooks = map[int]InboundWebhook{}
+	}
+	if data.SpamScores == nil {
+		data.SpamScores = map[int]float64{}
+	}
+	if data.SpamLabels == nil {
+		data.SpamLabels = map[int]SpamLabel{}
+	}
+	if data.Mutes == nil {
+		data.Mutes = map[int]map[int]time.Time{}
+	}
+	if data.Follows == nil {
+		data.Follows = map[int]map[int]Follow{}
+	}
+	if data.Reports == nil {
+		data.Reports = map[int]Report{}
+	}
+	if data.Sequences == nil {
+		data.Sequences = map[string]int{}
+	}
+}
 
+func (db *DB) saveDB(dbStructure DBStructure) error {
 	data, err := json.Marshal(dbStructure)
 	if err != nil {
 		return err
@@ -315,17 +546,17 @@ func (db *DB) writeDB(dbStructure DBStructure) error {
 		log.Fatal("Unable to write to database.")
 		return err
 	}
-	return nil
-}
 
-func (db *DB) checkDuplicateEmails(email string) bool {
-	data, err := db.loadDB()
-	if err != nil {
-		return true
+	if dbStructure.published {
+		select {
+		case db.published <- struct{}{}:
+		default:
+		}
 	}
+	return nil
+}
 
-	db.mux.RLock()
-	defer db.mux.RUnlock()
+func (data *DBStructure) hasEmail(email string) bool {
 	for _, user := range data.Users {
 		if user.Email == email {
 			return true
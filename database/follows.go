@@ -0,0 +1,207 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+const (
+	FollowPending  = "pending"
+	FollowApproved = "approved"
+)
+
+var ErrFollowBlocked = errors.New("unable to follow this user")
+
+// Follow is FollowerId following FolloweeId. Following a protected account
+// starts out pending until the followee approves it.
+type Follow struct {
+	FollowerId int       `json:"follower_id"`
+	FolloweeId int       `json:"followee_id"`
+	Status     string    `json:"status"`
+	CreatedAt  time.Time `json:"created_at"`
+	ApprovedAt time.Time `json:"approved_at"`
+}
+
+// FollowUser follows targetId, or asks to when targetId is protected.
+// Following someone already followed or requested returns the existing
+// follow.
+func (db *DB) FollowUser(userId, targetId int) (Follow, error) {
+	if userId == targetId {
+		return Follow{}, errors.New("you can't do that to yourself")
+	}
+
+	follow := Follow{}
+	err := db.update(func(data *DBStructure) error {
+		target, ok := data.Users[targetId]
+		if !ok {
+			return errors.New("unable to find user")
+		}
+		_, blockedByTarget := data.Blocks[targetId][userId]
+		_, blockedByUser := data.Blocks[userId][targetId]
+		if blockedByTarget || blockedByUser {
+			return ErrFollowBlocked
+		}
+
+		if follow, ok = data.Follows[userId][targetId]; ok {
+			return errUnchanged
+		}
+
+		now := time.Now().UTC()
+		follow = Follow{
+			FollowerId: userId,
+			FolloweeId: targetId,
+			Status:     FollowApproved,
+			CreatedAt:  now,
+			ApprovedAt: now,
+		}
+		if target.Protected {
+			follow.Status = FollowPending
+			follow.ApprovedAt = time.Time{}
+		}
+
+		if data.Follows[userId] == nil {
+			data.Follows[userId] = map[int]Follow{}
+		}
+		data.Follows[userId][targetId] = follow
+
+		return data.publish(EventUserFollowed, follow)
+	})
+	if err != nil {
+		return Follow{}, err
+	}
+
+	return follow, nil
+}
+
+// UnfollowUser stops userId following targetId or withdraws a pending
+// request.
+func (db *DB) UnfollowUser(userId, targetId int) error {
+	return db.update(func(data *DBStructure) error {
+		if !data.removeFollow(userId, targetId) {
+			return errors.New("you aren't following this user")
+		}
+		return nil
+	})
+}
+
+// ApproveFollowRequest lets followerId see userId's chirps.
+func (db *DB) ApproveFollowRequest(userId, followerId int) (Follow, error) {
+	follow := Follow{}
+	err := db.update(func(data *DBStructure) error {
+		var ok bool
+		follow, ok = data.Follows[followerId][userId]
+		if !ok || follow.Status != FollowPending {
+			return errors.New("unable to find follow request")
+		}
+
+		follow.Status = FollowApproved
+		follow.ApprovedAt = time.Now().UTC()
+		data.Follows[followerId][userId] = follow
+		return nil
+	})
+	if err != nil {
+		return Follow{}, err
+	}
+
+	return follow, nil
+}
+
+// RemoveFollower rejects a pending request from followerId or removes them
+// as an approved follower of userId.
+func (db *DB) RemoveFollower(userId, followerId int) error {
+	return db.update(func(data *DBStructure) error {
+		if !data.removeFollow(followerId, userId) {
+			return errors.New("unable to find follower")
+		}
+		return nil
+	})
+}
+
+// GetFollowers returns the follows of userId with the given status, newest
+// first.
+func (db *DB) GetFollowers(userId int, status string) ([]Follow, error) {
+	data, err := db.loadDB()
+	if err != nil {
+		return []Follow{}, err
+	}
+
+	follows := []Follow{}
+	for _, followees := range data.Follows {
+		follow, ok := followees[userId]
+		if ok && follow.Status == status {
+			follows = append(follows, follow)
+		}
+	}
+
+	return sortFollows(follows), nil
+}
+
+// GetFollowing returns everyone userId follows or has asked to follow,
+// newest first.
+func (db *DB) GetFollowing(userId int) ([]Follow, error) {
+	data, err := db.loadDB()
+	if err != nil {
+		return []Follow{}, err
+	}
+
+	follows := make([]Follow, 0, len(data.Follows[userId]))
+	for _, follow := range data.Follows[userId] {
+		follows = append(follows, follow)
+	}
+
+	return sortFollows(follows), nil
+}
+
+// SetUserProtected changes whether userId's chirps are limited to approved
+// followers. Making an account public approves every pending request.
+func (db *DB) SetUserProtected(userId int, protected bool) (User, error) {
+	user := User{}
+	err := db.update(func(data *DBStructure) error {
+		var ok bool
+		user, ok = data.Users[userId]
+		if !ok {
+			return errors.New("unable to find user")
+		}
+
+		user.Protected = protected
+		data.Users[userId] = user
+
+		if !protected {
+			now := time.Now().UTC()
+			for follower, followees := range data.Follows {
+				follow, ok := followees[userId]
+				if ok && follow.Status == FollowPending {
+					follow.Status = FollowApproved
+					follow.ApprovedAt = now
+					data.Follows[follower][userId] = follow
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+func (data *DBStructure) removeFollow(followerId, followeeId int) bool {
+	if _, ok := data.Follows[followerId][followeeId]; !ok {
+		return false
+	}
+
+	delete(data.Follows[followerId], followeeId)
+	if len(data.Follows[followerId]) == 0 {
+		delete(data.Follows, followerId)
+	}
+	return true
+}
+
+func sortFollows(follows []Follow) []Follow {
+	sort.Slice(follows, func(i, j int) bool {
+		return follows[i].CreatedAt.After(follows[j].CreatedAt)
+	})
+	return follows
+}
@@ -0,0 +1,186 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+const (
+	InboundReceived  = "received"
+	InboundProcessed = "processed"
+	InboundIgnored   = "ignored"
+	InboundFailed    = "failed"
+	InboundInvalid   = "invalid"
+
+	// inboundRetention is how long received payloads are kept for audit and
+	// replay. It also bounds how long an event id is remembered, which only
+	// needs to outlast a provider's retries.
+	inboundRetention = 90 * 24 * time.Hour
+)
+
+var (
+	ErrInboundDuplicate = errors.New("event was already processed")
+	ErrInboundNotFound  = errors.New("unable to find inbound webhook")
+)
+
+// InboundWebhook is an authenticated payload received from a provider, kept
+// as it arrived so it can be audited and replayed.
+type InboundWebhook struct {
+	Id          int       `json:"id"`
+	Provider    string    `json:"provider"`
+	EventId     string    `json:"event_id"`
+	Event       string    `json:"event"`
+	Payload     string    `json:"payload"`
+	Status      string    `json:"status"`
+	Error       string    `json:"error"`
+	Attempts    int       `json:"attempts"`
+	ReceivedAt  time.Time `json:"received_at"`
+	ProcessedAt time.Time `json:"processed_at"`
+}
+
+// RecordInboundWebhook stores a payload from provider. A payload whose event
+// id was already processed is not stored again and returns
+// ErrInboundDuplicate. Payloads without an event id are never duplicates.
+func (db *DB) RecordInboundWebhook(provider, eventId, event, payload string) (InboundWebhook, error) {
+	inbound := InboundWebhook{}
+	err := db.update(func(data *DBStructure) error {
+		if data.inboundProcessed(provider, eventId, 0) {
+			return ErrInboundDuplicate
+		}
+
+		now := time.Now().UTC()
+		for id, old := range data.InboundWebhooks {
+			if now.Sub(old.ReceivedAt) > inboundRetention {
+				delete(data.InboundWebhooks, id)
+			}
+		}
+
+		inbound = InboundWebhook{
+			Id:         nextId(data, "inbound_webhooks", data.InboundWebhooks),
+			Provider:   provider,
+			EventId:    eventId,
+			Event:      event,
+			Payload:    payload,
+			Status:     InboundReceived,
+			ReceivedAt: now,
+		}
+		data.InboundWebhooks[inbound.Id] = inbound
+		return nil
+	})
+	if err != nil {
+		return InboundWebhook{}, err
+	}
+
+	return inbound, nil
+}
+
+// inboundProcessed reports whether an event from provider with eventId,
+// other than exceptId, has already been processed.
+func (data DBStructure) inboundProcessed(provider, eventId string, exceptId int) bool {
+	if eventId == "" {
+		return false
+	}
+	for _, inbound := range data.InboundWebhooks {
+		if inbound.Id != exceptId && inbound.Provider == provider && inbound.EventId == eventId && inbound.Status == InboundProcessed {
+			return true
+		}
+	}
+	return false
+}
+
+// ApplyInboundWebhookToUser applies inbound webhook id to userId and marks it
+// processed in one write, so an event delivered twice at once is only
+// applied once; the loser gets ErrInboundDuplicate. Events apply publishes
+// are saved in the same write. apply runs under the database lock, so it
+// must not call back into the DB.
+func (db *DB) ApplyInboundWebhookToUser(id, userId int, apply func(user *User, outbox Outbox) error) error {
+	return db.update(func(data *DBStructure) error {
+		inbound, ok := data.InboundWebhooks[id]
+		if !ok {
+			return ErrInboundNotFound
+		}
+		if data.inboundProcessed(inbound.Provider, inbound.EventId, id) {
+			return ErrInboundDuplicate
+		}
+
+		user, ok := data.Users[userId]
+		if !ok {
+			return ErrUserNotFound
+		}
+
+		err := apply(&user, Outbox{data: data})
+		if err != nil {
+			return err
+		}
+		data.Users[userId] = user
+
+		inbound.Status = InboundProcessed
+		data.InboundWebhooks[id] = inbound
+		return nil
+	})
+}
+
+// FinishInboundWebhook records the outcome of an attempt to handle inbound
+// webhook id.
+func (db *DB) FinishInboundWebhook(id int, status, errMsg string) (InboundWebhook, error) {
+	inbound := InboundWebhook{}
+	err := db.update(func(data *DBStructure) error {
+		var ok bool
+		inbound, ok = data.InboundWebhooks[id]
+		if !ok {
+			return ErrInboundNotFound
+		}
+
+		inbound.Status = status
+		inbound.Error = errMsg
+		inbound.Attempts++
+		inbound.ProcessedAt = time.Now().UTC()
+		data.InboundWebhooks[id] = inbound
+		return nil
+	})
+	if err != nil {
+		return InboundWebhook{}, err
+	}
+
+	return inbound, nil
+}
+
+func (db *DB) GetInboundWebhook(id int) (InboundWebhook, error) {
+	data, err := db.loadDB()
+	if err != nil {
+		return InboundWebhook{}, err
+	}
+
+	inbound, ok := data.InboundWebhooks[id]
+	if !ok {
+		return InboundWebhook{}, ErrInboundNotFound
+	}
+
+	return inbound, nil
+}
+
+// GetInboundWebhooks returns up to limit payloads, newest first, from
+// provider and with status when they are set.
+func (db *DB) GetInboundWebhooks(provider, status string, limit int) ([]InboundWebhook, error) {
+	data, err := db.loadDB()
+	if err != nil {
+		return []InboundWebhook{}, err
+	}
+
+	inbox := []InboundWebhook{}
+	for _, inbound := range data.InboundWebhooks {
+		if (provider == "" || inbound.Provider == provider) && (status == "" || inbound.Status == status) {
+			inbox = append(inbox, inbound)
+		}
+	}
+
+	sort.Slice(inbox, func(i, j int) bool {
+		return inbox[i].Id > inbox[j].Id
+	})
+	if len(inbox) > limit {
+		inbox = inbox[:limit]
+	}
+
+	return inbox, nil
+}
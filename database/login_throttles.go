@@ -0,0 +1,150 @@
+package database
+
+import (
+	"sort"
+	"time"
+)
+
+// LoginThrottle counts failed logins for one key, such as an email address
+// or a client IP, and how long further attempts are refused.
+type LoginThrottle struct {
+	Key           string    `json:"key"`
+	Failures      int       `json:"failures"`
+	LastFailureAt time.Time `json:"last_failure_at"`
+	LockedUntil   time.Time `json:"locked_until"`
+}
+
+func (t LoginThrottle) IsLocked(now time.Time) bool {
+	return now.Before(t.LockedUntil)
+}
+
+// LockoutPolicy returns how long a key is locked after its nth consecutive
+// failure, and after how much quiet time the count starts over.
+type LockoutPolicy interface {
+	LockoutFor(key string, failures int) time.Duration
+	ResetAfter() time.Duration
+}
+
+// maxLoginThrottles caps how many keys are tracked, since anyone can fail a
+// login for any email address from any IP.
+const maxLoginThrottles = 10000
+
+func (db *DB) GetLoginThrottle(key string) (LoginThrottle, error) {
+	data, err := db.loadDB()
+	if err != nil {
+		return LoginThrottle{}, err
+	}
+
+	throttle, ok := data.LoginThrottles[key]
+	if !ok {
+		return LoginThrottle{Key: key}, nil
+	}
+
+	return throttle, nil
+}
+
+// RecordLoginFailure bumps the failure count of every key and applies the
+// policy's lockout. The updated throttles are returned in the same order.
+// Failures recorded at the same moment are all counted. Keys whose count
+// would have started over are dropped, and the oldest unlocked keys after
+// them when more than maxLoginThrottles are tracked.
+func (db *DB) RecordLoginFailure(keys []string, now time.Time, policy LockoutPolicy) ([]LoginThrottle, error) {
+	throttles := make([]LoginThrottle, 0, len(keys))
+	err := db.update(func(data *DBStructure) error {
+		for _, key := range keys {
+			throttle, ok := data.LoginThrottles[key]
+			if !ok || now.Sub(throttle.LastFailureAt) > policy.ResetAfter() {
+				throttle = LoginThrottle{Key: key}
+			}
+
+			throttle.Failures++
+			throttle.LastFailureAt = now
+			lockout := policy.LockoutFor(key, throttle.Failures)
+			if lockout > 0 {
+				throttle.LockedUntil = now.Add(lockout)
+			}
+
+			data.LoginThrottles[key] = throttle
+			throttles = append(throttles, throttle)
+		}
+
+		data.pruneLoginThrottles(now, policy.ResetAfter())
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return throttles, nil
+}
+
+// pruneLoginThrottles drops throttles that are no longer locked and whose
+// failures are older than resetAfter. If that leaves too many, unlocked ones
+// go first, then locked ones, each oldest failure first, so flooding the
+// table with new keys can't cheaply lift a lockout.
+func (data *DBStructure) pruneLoginThrottles(now time.Time, resetAfter time.Duration) {
+	for key, throttle := range data.LoginThrottles {
+		if !throttle.IsLocked(now) && now.Sub(throttle.LastFailureAt) > resetAfter {
+			delete(data.LoginThrottles, key)
+		}
+	}
+
+	excess := len(data.LoginThrottles) - maxLoginThrottles
+	if excess <= 0 {
+		return
+	}
+
+	throttles := make([]LoginThrottle, 0, len(data.LoginThrottles))
+	for _, throttle := range data.LoginThrottles {
+		throttles = append(throttles, throttle)
+	}
+	sort.Slice(throttles, func(i, j int) bool {
+		lockedI, lockedJ := throttles[i].IsLocked(now), throttles[j].IsLocked(now)
+		if lockedI != lockedJ {
+			return !lockedI
+		}
+		return throttles[i].LastFailureAt.Before(throttles[j].LastFailureAt)
+	})
+	for _, throttle := range throttles[:excess] {
+		delete(data.LoginThrottles, throttle.Key)
+	}
+}
+
+func (db *DB) ClearLoginFailures(keys ...string) error {
+	return db.update(func(data *DBStructure) error {
+		changed := false
+		for _, key := range keys {
+			if _, ok := data.LoginThrottles[key]; ok {
+				delete(data.LoginThrottles, key)
+				changed = true
+			}
+		}
+
+		if !changed {
+			return errUnchanged
+		}
+		return nil
+	})
+}
+
+// GetLockedLoginThrottles returns every key that is locked at now, soonest
+// to unlock first.
+func (db *DB) GetLockedLoginThrottles(now time.Time) ([]LoginThrottle, error) {
+	data, err := db.loadDB()
+	if err != nil {
+		return []LoginThrottle{}, err
+	}
+
+	throttles := []LoginThrottle{}
+	for _, throttle := range data.LoginThrottles {
+		if throttle.IsLocked(now) {
+			throttles = append(throttles, throttle)
+		}
+	}
+
+	sort.Slice(throttles, func(i, j int) bool {
+		return throttles[i].LockedUntil.Before(throttles[j].LockedUntil)
+	})
+
+	return throttles, nil
+}
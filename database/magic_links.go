@@ -0,0 +1,95 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrMagicLinkUsed = errors.New("login link has already been used")
+
+// MagicLink tracks an emailed login link by the jti of its token so it can
+// only be redeemed once.
+type MagicLink struct {
+	TokenId   string    `json:"token_id"`
+	UserId    int       `json:"user_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+	UsedAt    time.Time `json:"used_at"`
+}
+
+func (db *DB) CreateMagicLink(link MagicLink) error {
+	return db.update(func(data *DBStructure) error {
+		now := time.Now()
+		for id, l := range data.MagicLinks {
+			if now.After(l.ExpiresAt) {
+				delete(data.MagicLinks, id)
+			}
+		}
+
+		data.MagicLinks[link.TokenId] = link
+		return nil
+	})
+}
+
+// ConsumeMagicLink marks a link as used and returns it. The check and the
+// mark happen under one lock, so a link clicked twice at once only logs in
+// once.
+func (db *DB) ConsumeMagicLink(tokenId string) (MagicLink, error) {
+	link := MagicLink{}
+	used := false
+	err := db.update(func(data *DBStructure) error {
+		var ok bool
+		link, ok = data.MagicLinks[tokenId]
+		if !ok || time.Now().After(link.ExpiresAt) {
+			return errors.New("invalid login link")
+		}
+		if !link.UsedAt.IsZero() {
+			used = true
+			return errUnchanged
+		}
+
+		link.UsedAt = time.Now().UTC()
+		data.MagicLinks[tokenId] = link
+		return nil
+	})
+	if err != nil {
+		return MagicLink{}, err
+	}
+	if used {
+		return link, ErrMagicLinkUsed
+	}
+
+	return link, nil
+}
+
+// RecordMagicLinkRequest notes a request for key at now and returns how many
+// requests key made within window, including this one. Requests older than
+// window are dropped for every key, so keys for addresses nobody asks about
+// again don't pile up.
+func (db *DB) RecordMagicLinkRequest(key string, now time.Time, window time.Duration) (int, error) {
+	count := 0
+	err := db.update(func(data *DBStructure) error {
+		for k, requests := range data.MagicLinkRequests {
+			recent := []time.Time{}
+			for _, t := range requests {
+				if now.Sub(t) < window {
+					recent = append(recent, t)
+				}
+			}
+
+			if len(recent) == 0 {
+				delete(data.MagicLinkRequests, k)
+			} else {
+				data.MagicLinkRequests[k] = recent
+			}
+		}
+
+		data.MagicLinkRequests[key] = append(data.MagicLinkRequests[key], now)
+		count = len(data.MagicLinkRequests[key])
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
@@ -0,0 +1,159 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	ModerationHide      = "hide"
+	ModerationUnhide    = "unhide"
+	ModerationWarn      = "warn"
+	ModerationSuspend   = "suspend"
+	ModerationBan       = "ban"
+	ModerationReinstate = "reinstate"
+	ModerationSpam      = "spam"
+	ModerationNotSpam   = "not_spam"
+)
+
+// IsSuspended reports whether u is barred from using their account at now,
+// either until a suspension ends or permanently by a ban.
+func (u User) IsSuspended(now time.Time) bool {
+	return !u.BannedAt.IsZero() || now.Before(u.SuspendedUntil)
+}
+
+// SuspendedError is returned by CheckAccount for an account that is
+// suspended or banned.
+type SuspendedError struct {
+	Until  time.Time
+	Banned bool
+	Reason string
+}
+
+func (e *SuspendedError) Error() string {
+	if e.Banned {
+		return "account is banned"
+	}
+	return fmt.Sprintf("account is suspended until %s", e.Until.Format(time.RFC3339))
+}
+
+// CheckAccount returns a *SuspendedError when userId is suspended or banned
+// and an error when the account doesn't exist. It satisfies
+// auth.AccountChecker.
+func (db *DB) CheckAccount(userId int) error {
+	user, err := db.GetUserById(userId)
+	if err != nil {
+		return err
+	}
+
+	return user.SuspensionError(time.Now())
+}
+
+// SuspensionError returns a *SuspendedError describing why u can't use their
+// account at now, or nil.
+func (u User) SuspensionError(now time.Time) error {
+	if !u.IsSuspended(now) {
+		return nil
+	}
+	return &SuspendedError{
+		Until:  u.SuspendedUntil,
+		Banned: !u.BannedAt.IsZero(),
+		Reason: u.SuspensionReason,
+	}
+}
+
+// SetChirpHidden hides a chirp from everyone but its author, or shows it
+// again, and resolves open reports against it. Showing it also lifts an
+// automod shadow-hide.
+func (db *DB) SetChirpHidden(chirpId, moderatorId int, hidden bool) (Chirp, error) {
+	chirp := Chirp{}
+	err := db.update(func(data *DBStructure) error {
+		var ok bool
+		chirp, ok = data.Chirps[chirpId]
+		if !ok {
+			return ErrChirpNotFound
+		}
+
+		action := ModerationUnhide
+		chirp.Hidden = hidden
+		if hidden {
+			action = ModerationHide
+		}
+		data.Chirps[chirpId] = chirp
+		delete(data.ShadowHidden, chirpId)
+		data.resolveReports(ReportTargetChirp, chirpId, moderatorId, action)
+		return data.publishChirp(chirpId, time.Now())
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return chirp, nil
+}
+
+// WarnUser records a warning against userId and resolves open reports
+// against them.
+func (db *DB) WarnUser(userId, moderatorId int) (User, error) {
+	return db.moderateUser(userId, moderatorId, ModerationWarn, func(user *User) {
+		user.Warnings++
+	})
+}
+
+// SuspendUser bars userId from the service until until, signing them out
+// everywhere. With hideChirps their chirps are hidden for as long as the
+// suspension lasts.
+func (db *DB) SuspendUser(userId, moderatorId int, until time.Time, reason string, hideChirps bool) (User, error) {
+	return db.moderateUser(userId, moderatorId, ModerationSuspend, func(user *User) {
+		user.SuspendedUntil = until
+		user.SuspensionReason = reason
+		user.ChirpsHidden = hideChirps
+	})
+}
+
+// BanUser bars userId from the service permanently, signing them out
+// everywhere. With hideChirps their chirps are hidden too.
+func (db *DB) BanUser(userId, moderatorId int, reason string, hideChirps bool) (User, error) {
+	return db.moderateUser(userId, moderatorId, ModerationBan, func(user *User) {
+		user.BannedAt = time.Now().UTC()
+		user.SuspensionReason = reason
+		user.ChirpsHidden = hideChirps
+	})
+}
+
+// ReinstateUser lifts a suspension or ban.
+func (db *DB) ReinstateUser(userId, moderatorId int) (User, error) {
+	return db.moderateUser(userId, moderatorId, ModerationReinstate, func(user *User) {
+		user.SuspendedUntil = time.Time{}
+		user.BannedAt = time.Time{}
+		user.SuspensionReason = ""
+		user.ChirpsHidden = false
+	})
+}
+
+func (db *DB) moderateUser(userId, moderatorId int, action string, apply func(*User)) (User, error) {
+	user := User{}
+	err := db.update(func(data *DBStructure) error {
+		var ok bool
+		user, ok = data.Users[userId]
+		if !ok {
+			return errors.New("unable to find user")
+		}
+
+		apply(&user)
+		data.Users[userId] = user
+		if action != ModerationReinstate {
+			data.resolveReports(ReportTargetUser, userId, moderatorId, action)
+		}
+
+		if user.IsSuspended(time.Now()) {
+			data.revokeUserSessions(userId)
+		}
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
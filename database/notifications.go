@@ -0,0 +1,188 @@
+package database
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	NotificationReply         = "reply"
+	NotificationFollow        = "follow"
+	NotificationFollowRequest = "follow_request"
+)
+
+// Notification tells UserId that ActorIds did the same thing, such as
+// replying to ChirpId. Unread notifications gather new actors instead of
+// repeating; once read, the next actor starts a new one.
+type Notification struct {
+	Id       int    `json:"id"`
+	UserId   int    `json:"user_id"`
+	Type     string `json:"type"`
+	ChirpId  int    `json:"chirp_id,omitempty"`
+	ActorIds []int  `json:"actor_ids"` // newest first
+	Read     bool   `json:"read"`
+	// LastEventId is the outbox event that last changed it, so an event
+	// handled twice doesn't notify twice.
+	LastEventId int       `json:"last_event_id"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Notify records that actorId did notificationType to userId, about chirpId
+// when it is set, because of outbox event eventId. Nothing is recorded when
+// userId has blocked or muted actorId or been blocked by them.
+func (db *DB) Notify(userId int, notificationType string, chirpId, actorId, eventId int) error {
+	return db.update(func(data *DBStructure) error {
+		if _, ok := data.Users[userId]; !ok || !data.canNotify(userId, actorId) {
+			return errUnchanged
+		}
+
+		unread := 0
+		for id, notification := range data.Notifications {
+			if notification.UserId != userId || notification.Type != notificationType || notification.ChirpId != chirpId {
+				continue
+			}
+			if notification.LastEventId >= eventId {
+				return errUnchanged
+			}
+			if !notification.Read {
+				unread = id
+			}
+		}
+
+		now := time.Now().UTC()
+		notification, ok := data.Notifications[unread]
+		if !ok {
+			notification = Notification{
+				Id:        nextId(data, "notifications", data.Notifications),
+				UserId:    userId,
+				Type:      notificationType,
+				ChirpId:   chirpId,
+				CreatedAt: now,
+			}
+		}
+
+		actorIds := []int{actorId}
+		for _, id := range notification.ActorIds {
+			if id != actorId {
+				actorIds = append(actorIds, id)
+			}
+		}
+		notification.ActorIds = actorIds
+		notification.LastEventId = eventId
+		notification.UpdatedAt = now
+		data.Notifications[notification.Id] = notification
+		return nil
+	})
+}
+
+func (data DBStructure) canNotify(userId, actorId int) bool {
+	_, blockedByUser := data.Blocks[userId][actorId]
+	_, blockedByActor := data.Blocks[actorId][userId]
+	return userId != actorId && !blockedByUser && !blockedByActor && !data.hasMuted(userId, actorId)
+}
+
+// GetNotifications returns up to limit of userId's notifications, most
+// recently updated first, optionally only unread ones. Paging resumes after
+// the notification with id beforeId last updated at updatedAt: those updated
+// earlier are returned, and those updated at the same moment only if their
+// id is lower. A beforeId of 0 returns only notifications updated before
+// updatedAt. Actors userId has since blocked, muted or been blocked by are
+// left out, along with notifications that leaves empty.
+func (db *DB) GetNotifications(userId int, updatedAt time.Time, beforeId int, unreadOnly bool, limit int) ([]Notification, error) {
+	data, err := db.loadDB()
+	if err != nil {
+		return []Notification{}, err
+	}
+
+	notifications := []Notification{}
+	for _, notification := range data.Notifications {
+		if notification.UserId != userId || (unreadOnly && notification.Read) {
+			continue
+		}
+		if !notification.UpdatedAt.Before(updatedAt) && !(notification.UpdatedAt.Equal(updatedAt) && notification.Id < beforeId) {
+			continue
+		}
+
+		actorIds := []int{}
+		for _, actorId := range notification.ActorIds {
+			if data.canNotify(userId, actorId) {
+				actorIds = append(actorIds, actorId)
+			}
+		}
+		if len(actorIds) == 0 {
+			continue
+		}
+		notification.ActorIds = actorIds
+
+		notifications = append(notifications, notification)
+	}
+
+	sort.Slice(notifications, func(i, j int) bool {
+		if notifications[i].UpdatedAt.Equal(notifications[j].UpdatedAt) {
+			return notifications[i].Id > notifications[j].Id
+		}
+		return notifications[i].UpdatedAt.After(notifications[j].UpdatedAt)
+	})
+	if len(notifications) > limit {
+		notifications = notifications[:limit]
+	}
+
+	return notifications, nil
+}
+
+// MarkNotificationsRead marks ids read, or every notification when ids is
+// empty, and returns how many it changed. Ids belonging to someone other
+// than userId are skipped.
+func (db *DB) MarkNotificationsRead(userId int, ids []int) (int, error) {
+	marked := 0
+	err := db.update(func(data *DBStructure) error {
+		selected := map[int]bool{}
+		for _, id := range ids {
+			selected[id] = true
+		}
+
+		for id, notification := range data.Notifications {
+			if notification.UserId != userId || notification.Read || (len(ids) > 0 && !selected[id]) {
+				continue
+			}
+			notification.Read = true
+			data.Notifications[id] = notification
+			marked++
+		}
+
+		if marked == 0 {
+			return errUnchanged
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return marked, nil
+}
+
+// forgetNotifications drops userId's notifications and takes them out of
+// everyone else's.
+func (data *DBStructure) forgetNotifications(userId int) {
+	for id, notification := range data.Notifications {
+		if notification.UserId == userId {
+			delete(data.Notifications, id)
+			continue
+		}
+
+		actorIds := []int{}
+		for _, actorId := range notification.ActorIds {
+			if actorId != userId {
+				actorIds = append(actorIds, actorId)
+			}
+		}
+		if len(actorIds) == 0 {
+			delete(data.Notifications, id)
+			continue
+		}
+		notification.ActorIds = actorIds
+		data.Notifications[id] = notification
+	}
+}
@@ -0,0 +1,196 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+var ErrOAuthCodeReused = errors.New("authorization code has already been used")
+
+// OAuthClient is a third-party application registered by a user. Public
+// clients, such as single page or mobile apps, have no secret and rely on
+// PKCE alone.
+type OAuthClient struct {
+	ClientId     string    `json:"client_id"`
+	SecretHash   string    `json:"secret_hash"`
+	Name         string    `json:"name"`
+	OwnerId      int       `json:"owner_id"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Scopes       []string  `json:"scopes"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func (c OAuthClient) IsConfidential() bool {
+	return c.SecretHash != ""
+}
+
+// OAuthCode is an authorization code waiting to be exchanged at the token
+// endpoint. Codes are stored by hash and can be exchanged once; FamilyId
+// records the refresh token family the exchange started so a replayed code
+// can revoke it.
+type OAuthCode struct {
+	CodeHash      string    `json:"code_hash"`
+	ClientId      string    `json:"client_id"`
+	UserId        int       `json:"user_id"`
+	RedirectURI   string    `json:"redirect_uri"`
+	Scopes        []string  `json:"scopes"`
+	CodeChallenge string    `json:"code_challenge"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	UsedAt        time.Time `json:"used_at"`
+	FamilyId      string    `json:"family_id"`
+}
+
+func (db *DB) CreateOAuthClient(client OAuthClient) (OAuthClient, error) {
+	client.CreatedAt = time.Now().UTC()
+	err := db.update(func(data *DBStructure) error {
+		if _, ok := data.OAuthClients[client.ClientId]; ok {
+			return errors.New("client id already in use")
+		}
+
+		data.OAuthClients[client.ClientId] = client
+		return nil
+	})
+	if err != nil {
+		return OAuthClient{}, err
+	}
+
+	return client, nil
+}
+
+func (db *DB) GetOAuthClient(clientId string) (OAuthClient, error) {
+	data, err := db.loadDB()
+	if err != nil {
+		return OAuthClient{}, err
+	}
+
+	client, ok := data.OAuthClients[clientId]
+	if !ok {
+		return OAuthClient{}, errors.New("unable to find client")
+	}
+
+	return client, nil
+}
+
+func (db *DB) GetOAuthClientsForOwner(ownerId int) ([]OAuthClient, error) {
+	data, err := db.loadDB()
+	if err != nil {
+		return []OAuthClient{}, err
+	}
+
+	clients := []OAuthClient{}
+	for _, client := range data.OAuthClients {
+		if client.OwnerId == ownerId {
+			clients = append(clients, client)
+		}
+	}
+
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].CreatedAt.Before(clients[j].CreatedAt)
+	})
+
+	return clients, nil
+}
+
+// DeleteOAuthClient removes a client along with its pending codes and
+// revokes every refresh token issued to it.
+func (db *DB) DeleteOAuthClient(ownerId int, clientId string) error {
+	return db.update(func(data *DBStructure) error {
+		client, ok := data.OAuthClients[clientId]
+		if !ok || client.OwnerId != ownerId {
+			return errors.New("unable to find client")
+		}
+
+		delete(data.OAuthClients, clientId)
+		for hash, code := range data.OAuthCodes {
+			if code.ClientId == clientId {
+				delete(data.OAuthCodes, hash)
+			}
+		}
+
+		now := time.Now().UTC()
+		for hash, token := range data.RefreshTokens {
+			if token.ClientId == clientId && token.RevokedAt.IsZero() {
+				token.RevokedAt = now
+				data.RefreshTokens[hash] = token
+			}
+		}
+		return nil
+	})
+}
+
+func (db *DB) CreateOAuthCode(code OAuthCode) error {
+	return db.update(func(data *DBStructure) error {
+		now := time.Now()
+		for hash, c := range data.OAuthCodes {
+			if now.After(c.ExpiresAt) {
+				delete(data.OAuthCodes, hash)
+			}
+		}
+
+		data.OAuthCodes[code.CodeHash] = code
+		return nil
+	})
+}
+
+// ExchangeOAuthCode redeems a code for a new refresh token family stored
+// under tokenHash. check must accept the code, confirming the client,
+// redirect URI and PKCE verifier, before it is used up, so nobody else
+// holding the code can burn it. Presenting an accepted code a second time
+// revokes the refresh tokens the first exchange produced and returns
+// ErrOAuthCodeReused along with the code.
+func (db *DB) ExchangeOAuthCode(codeHash string, check func(code OAuthCode) error, tokenHash string, expiresAt time.Time) (OAuthCode, RefreshToken, error) {
+	code := OAuthCode{}
+	token := RefreshToken{}
+	reused := false
+	err := db.update(func(data *DBStructure) error {
+		now := time.Now().UTC()
+		var ok bool
+		code, ok = data.OAuthCodes[codeHash]
+		if !ok || now.After(code.ExpiresAt) {
+			return errors.New("invalid authorization code")
+		}
+
+		err := check(code)
+		if err != nil {
+			return err
+		}
+
+		if !code.UsedAt.IsZero() {
+			if code.FamilyId != "" {
+				revokeFamily(*data, code.FamilyId, now)
+			}
+			reused = true
+			return nil
+		}
+
+		if _, ok := data.Users[code.UserId]; !ok {
+			return ErrUserNotFound
+		}
+
+		token = RefreshToken{
+			TokenHash: tokenHash,
+			UserId:    code.UserId,
+			ClientId:  code.ClientId,
+			Scopes:    code.Scopes,
+			FamilyId:  tokenHash,
+			CreatedAt: now,
+			ExpiresAt: expiresAt,
+		}
+		data.RefreshTokens[tokenHash] = token
+		data.pruneRefreshTokens(now)
+
+		code.UsedAt = now
+		code.FamilyId = token.FamilyId
+		data.OAuthCodes[codeHash] = code
+		return nil
+	})
+	if err != nil {
+		return OAuthCode{}, RefreshToken{}, err
+	}
+	if reused {
+		return code, RefreshToken{}, ErrOAuthCodeReused
+	}
+
+	return code, token, nil
+}
@@ -0,0 +1,254 @@
+package database
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// Events published to the outbox.
+const (
+	EventChirpCreated = "chirp.created"
+	// EventChirpPublished follows chirp.created once the chirp is past
+	// review and its scheduled time, which for most chirps is straight away.
+	EventChirpPublished = "chirp.published"
+	EventChirpDeleted   = "chirp.deleted"
+	EventUserUpgraded   = "user.upgraded"
+	EventUserDowngraded = "user.downgraded"
+	EventUserFollowed   = "user.followed"
+)
+
+// OutboxEvent is a change recorded in the same write as the change itself,
+// so it can't be lost between saving and publishing.
+type OutboxEvent struct {
+	Id        int             `json:"id"`
+	Type      string          `json:"type"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// maxSkippedOutboxEvents is how many skipped events a checkpoint remembers.
+const maxSkippedOutboxEvents = 100
+
+// OutboxCheckpoint is how far a consumer has got through the outbox.
+type OutboxCheckpoint struct {
+	Consumer    string    `json:"consumer"`
+	LastEventId int       `json:"last_event_id"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	Failures    int       `json:"failures"`
+	Error       string    `json:"error"`
+	// Skipped holds the ids of the most recent events the consumer gave up
+	// on, oldest first.
+	Skipped []int `json:"skipped"`
+}
+
+// ChirpDeletedEvent is the payload of chirp.deleted.
+type ChirpDeletedEvent struct {
+	Id       int `json:"id"`
+	AuthorId int `json:"author_id"`
+}
+
+// UserEvent is the payload of user.upgraded and user.downgraded.
+type UserEvent struct {
+	UserId int    `json:"user_id"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Outbox publishes events as part of a write in progress. They are saved
+// with it or not at all.
+type Outbox struct {
+	data *DBStructure
+}
+
+func (o Outbox) Publish(eventType string, payload interface{}) error {
+	return o.data.publish(eventType, payload)
+}
+
+func (data *DBStructure) publish(eventType string, payload interface{}) error {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	event := OutboxEvent{
+		Id:        nextId(data, "outbox", data.Outbox),
+		Type:      eventType,
+		Payload:   raw,
+		CreatedAt: time.Now().UTC(),
+	}
+	data.Outbox[event.Id] = event
+	data.published = true
+
+	return nil
+}
+
+// Published is signalled after a write that published events, so
+// consumers needn't wait for their next poll.
+func (db *DB) Published() <-chan struct{} {
+	return db.published
+}
+
+// StartOutboxConsumer returns consumer's checkpoint, creating it the first
+// time it runs at the end of the outbox, so a new consumer doesn't replay
+// history.
+func (db *DB) StartOutboxConsumer(consumer string) (OutboxCheckpoint, error) {
+	checkpoint := OutboxCheckpoint{}
+	err := db.update(func(data *DBStructure) error {
+		var ok bool
+		checkpoint, ok = data.OutboxCheckpoints[consumer]
+		if ok {
+			return errUnchanged
+		}
+
+		checkpoint = OutboxCheckpoint{
+			Consumer:    consumer,
+			LastEventId: data.Sequences["outbox"],
+			UpdatedAt:   time.Now().UTC(),
+		}
+		data.OutboxCheckpoints[consumer] = checkpoint
+		return nil
+	})
+	if err != nil {
+		return OutboxCheckpoint{}, err
+	}
+
+	return checkpoint, nil
+}
+
+// GetOutboxEvents returns up to limit events after afterId, oldest first.
+func (db *DB) GetOutboxEvents(afterId, limit int) ([]OutboxEvent, error) {
+	data, err := db.loadDB()
+	if err != nil {
+		return []OutboxEvent{}, err
+	}
+
+	events := []OutboxEvent{}
+	for id, event := range data.Outbox {
+		if id > afterId {
+			events = append(events, event)
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Id < events[j].Id
+	})
+	if len(events) > limit {
+		events = events[:limit]
+	}
+
+	return events, nil
+}
+
+// AdvanceOutboxCheckpoint records that consumer has handled every event up
+// to eventId.
+func (db *DB) AdvanceOutboxCheckpoint(consumer string, eventId int) error {
+	return db.update(func(data *DBStructure) error {
+		checkpoint := data.OutboxCheckpoints[consumer]
+		checkpoint.Consumer = consumer
+		checkpoint.LastEventId = eventId
+		checkpoint.UpdatedAt = time.Now().UTC()
+		checkpoint.Failures = 0
+		checkpoint.Error = ""
+		data.OutboxCheckpoints[consumer] = checkpoint
+		return nil
+	})
+}
+
+// FailOutboxCheckpoint records that consumer couldn't handle the event after
+// its checkpoint. The checkpoint stays put, so the event is tried again.
+func (db *DB) FailOutboxCheckpoint(consumer string, errMsg string) (OutboxCheckpoint, error) {
+	checkpoint := OutboxCheckpoint{}
+	err := db.update(func(data *DBStructure) error {
+		checkpoint = data.OutboxCheckpoints[consumer]
+		checkpoint.Consumer = consumer
+		checkpoint.UpdatedAt = time.Now().UTC()
+		checkpoint.Failures++
+		checkpoint.Error = errMsg
+		data.OutboxCheckpoints[consumer] = checkpoint
+		return nil
+	})
+	if err != nil {
+		return OutboxCheckpoint{}, err
+	}
+
+	return checkpoint, nil
+}
+
+// SkipOutboxEvent moves consumer's checkpoint past eventId without handling
+// it, keeping errMsg and the event's id so the skip can be looked into.
+func (db *DB) SkipOutboxEvent(consumer string, eventId int, errMsg string) error {
+	return db.update(func(data *DBStructure) error {
+		checkpoint := data.OutboxCheckpoints[consumer]
+		checkpoint.Consumer = consumer
+		checkpoint.LastEventId = eventId
+		checkpoint.UpdatedAt = time.Now().UTC()
+		checkpoint.Failures = 0
+		checkpoint.Error = errMsg
+		checkpoint.Skipped = append(checkpoint.Skipped, eventId)
+		if len(checkpoint.Skipped) > maxSkippedOutboxEvents {
+			checkpoint.Skipped = checkpoint.Skipped[len(checkpoint.Skipped)-maxSkippedOutboxEvents:]
+		}
+		data.OutboxCheckpoints[consumer] = checkpoint
+		return nil
+	})
+}
+
+// GetOutboxCheckpoints returns every consumer's checkpoint along with how
+// many events are waiting for it.
+func (db *DB) GetOutboxCheckpoints() ([]OutboxCheckpoint, map[string]int, error) {
+	data, err := db.loadDB()
+	if err != nil {
+		return []OutboxCheckpoint{}, map[string]int{}, err
+	}
+
+	checkpoints := make([]OutboxCheckpoint, 0, len(data.OutboxCheckpoints))
+	pending := map[string]int{}
+	for _, checkpoint := range data.OutboxCheckpoints {
+		checkpoints = append(checkpoints, checkpoint)
+		for id := range data.Outbox {
+			if id > checkpoint.LastEventId {
+				pending[checkpoint.Consumer]++
+			}
+		}
+	}
+
+	sort.Slice(checkpoints, func(i, j int) bool {
+		return checkpoints[i].Consumer < checkpoints[j].Consumer
+	})
+
+	return checkpoints, pending, nil
+}
+
+// PruneOutbox deletes events created before cutoff that every one of
+// consumers has handled. Consumers that no longer run should be left out,
+// or they would keep every event forever.
+func (db *DB) PruneOutbox(consumers []string, cutoff time.Time) (int, error) {
+	pruned := 0
+	err := db.update(func(data *DBStructure) error {
+		handled := data.Sequences["outbox"]
+		for _, consumer := range consumers {
+			checkpoint, ok := data.OutboxCheckpoints[consumer]
+			if !ok {
+				return errUnchanged
+			}
+			handled = min(handled, checkpoint.LastEventId)
+		}
+
+		for id, event := range data.Outbox {
+			if id <= handled && event.CreatedAt.Before(cutoff) {
+				delete(data.Outbox, id)
+				pruned++
+			}
+		}
+
+		if pruned == 0 {
+			return errUnchanged
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return pruned, nil
+}
@@ -0,0 +1,49 @@
+package database
+
+import "time"
+
+// isPublished reports whether chirp is past automod, moderators and its
+// scheduled time, so everyone its author shares with can see it.
+func (data DBStructure) isPublished(chirp Chirp, now time.Time) bool {
+	_, shadowHidden := data.ShadowHidden[chirp.Id]
+	return !chirp.Hidden && !shadowHidden && !chirp.IsScheduled(now)
+}
+
+// publishChirp publishes chirp.published for chirpId if it has become
+// visible since it was created. Each chirp is published at most once.
+func (data *DBStructure) publishChirp(chirpId int, now time.Time) error {
+	chirp, ok := data.Chirps[chirpId]
+	if !ok || !data.Unpublished[chirpId] || !data.isPublished(chirp, now) {
+		return nil
+	}
+
+	delete(data.Unpublished, chirpId)
+	return data.publish(EventChirpPublished, chirp)
+}
+
+// PublishDueChirps publishes scheduled chirps whose time has come and
+// returns how many it published.
+func (db *DB) PublishDueChirps(now time.Time) (int, error) {
+	published := 0
+	err := db.update(func(data *DBStructure) error {
+		for id := range data.Unpublished {
+			err := data.publishChirp(id, now)
+			if err != nil {
+				return err
+			}
+			if !data.Unpublished[id] {
+				published++
+			}
+		}
+
+		if published == 0 {
+			return errUnchanged
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return published, nil
+}
@@ -0,0 +1,180 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrRefreshTokenInvalid = errors.New("refresh token is invalid or expired")
+	ErrRefreshTokenReused  = errors.New("refresh token has already been used")
+)
+
+// RefreshToken is stored by the SHA-256 hash of the token handed to the
+// client, never the token itself. Every token issued by rotating another one
+// shares its FamilyId so a replayed token can take the whole chain down.
+// Tokens issued to OAuth clients record the client and the scopes the user
+// granted it; first-party tokens leave both empty.
+type RefreshToken struct {
+	TokenHash  string    `json:"token_hash"`
+	UserId     int       `json:"user_id"`
+	ClientId   string    `json:"client_id"`
+	Scopes     []string  `json:"scopes"`
+	FamilyId   string    `json:"family_id"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	RevokedAt  time.Time `json:"revoked_at"`
+	ReplacedBy string    `json:"replaced_by"`
+}
+
+func (t RefreshToken) IsActive(now time.Time) bool {
+	return t.RevokedAt.IsZero() && now.Before(t.ExpiresAt)
+}
+
+// CreateRefreshToken starts a new token family for a fresh login.
+func (db *DB) CreateRefreshToken(userId int, tokenHash string, expiresAt time.Time) (RefreshToken, error) {
+	return db.CreateClientRefreshToken(userId, "", nil, tokenHash, expiresAt)
+}
+
+// CreateClientRefreshToken starts a new token family for an OAuth client
+// acting for userId with scopes.
+func (db *DB) CreateClientRefreshToken(userId int, clientId string, scopes []string, tokenHash string, expiresAt time.Time) (RefreshToken, error) {
+	token := RefreshToken{}
+	err := db.update(func(data *DBStructure) error {
+		if _, ok := data.Users[userId]; !ok {
+			return errors.New("unable to find user")
+		}
+
+		token = RefreshToken{
+			TokenHash: tokenHash,
+			UserId:    userId,
+			ClientId:  clientId,
+			Scopes:    scopes,
+			FamilyId:  tokenHash,
+			CreatedAt: time.Now().UTC(),
+			ExpiresAt: expiresAt,
+		}
+		data.RefreshTokens[tokenHash] = token
+		data.pruneRefreshTokens(token.CreatedAt)
+		return nil
+	})
+	if err != nil {
+		return RefreshToken{}, err
+	}
+
+	return token, nil
+}
+
+// RotateRefreshToken exchanges an active token for newHash in the same family.
+// The token must have been issued to clientId, which is empty for first-party
+// logins. Presenting a token that was already rotated revokes the entire
+// family and returns ErrRefreshTokenReused along with the presented token so
+// the caller knows which user was affected. A suspended or banned user's
+// token is left as it is and their *SuspendedError returned. The checks and
+// the rotation happen under one lock, so two refreshes racing with the same
+// token can't both succeed.
+func (db *DB) RotateRefreshToken(oldHash, newHash, clientId string, expiresAt time.Time) (RefreshToken, error) {
+	old := RefreshToken{}
+	token := RefreshToken{}
+	reused := false
+	err := db.update(func(data *DBStructure) error {
+		now := time.Now().UTC()
+		var ok bool
+		old, ok = data.RefreshTokens[oldHash]
+		if !ok || old.ClientId != clientId {
+			return ErrRefreshTokenInvalid
+		}
+
+		if old.ReplacedBy != "" {
+			revokeFamily(*data, old.FamilyId, now)
+			reused = true
+			return nil
+		}
+
+		if !old.IsActive(now) {
+			return ErrRefreshTokenInvalid
+		}
+
+		user, ok := data.Users[old.UserId]
+		if !ok {
+			return ErrUserNotFound
+		}
+		err := user.SuspensionError(now)
+		if err != nil {
+			return err
+		}
+
+		old.RevokedAt = now
+		old.ReplacedBy = newHash
+		data.RefreshTokens[oldHash] = old
+
+		token = RefreshToken{
+			TokenHash: newHash,
+			UserId:    old.UserId,
+			ClientId:  old.ClientId,
+			Scopes:    old.Scopes,
+			FamilyId:  old.FamilyId,
+			CreatedAt: now,
+			ExpiresAt: expiresAt,
+		}
+		data.RefreshTokens[newHash] = token
+		data.pruneRefreshTokens(now)
+		return nil
+	})
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	if reused {
+		return old, ErrRefreshTokenReused
+	}
+
+	return token, nil
+}
+
+// RevokeRefreshToken ends the session the token belongs to by revoking every
+// token in its family. The token must have been issued to clientId.
+func (db *DB) RevokeRefreshToken(tokenHash, clientId string) error {
+	return db.update(func(data *DBStructure) error {
+		token, ok := data.RefreshTokens[tokenHash]
+		if !ok || token.ClientId != clientId || !token.IsActive(time.Now()) {
+			return ErrRefreshTokenInvalid
+		}
+
+		revokeFamily(*data, token.FamilyId, time.Now().UTC())
+		return nil
+	})
+}
+
+// pruneRefreshTokens drops tokens that can no longer be used or tell
+// anything: expired ones, and revoked ones that were never rotated. Rotated
+// tokens are kept until they expire so presenting one again is still caught
+// as reuse.
+func (data *DBStructure) pruneRefreshTokens(now time.Time) {
+	for hash, token := range data.RefreshTokens {
+		if now.After(token.ExpiresAt) || (!token.RevokedAt.IsZero() && token.ReplacedBy == "") {
+			delete(data.RefreshTokens, hash)
+		}
+	}
+}
+
+func revokeFamily(data DBStructure, familyId string, now time.Time) {
+	for hash, t := range data.RefreshTokens {
+		if t.FamilyId != familyId || !t.RevokedAt.IsZero() {
+			continue
+		}
+		t.RevokedAt = now
+		data.RefreshTokens[hash] = t
+	}
+}
+
+// revokeUserSessions revokes every refresh token issued to userId, including
+// those held by OAuth clients.
+func (data *DBStructure) revokeUserSessions(userId int) {
+	now := time.Now().UTC()
+	for hash, token := range data.RefreshTokens {
+		if token.UserId == userId && token.RevokedAt.IsZero() {
+			token.RevokedAt = now
+			data.RefreshTokens[hash] = token
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+const (
+	ReportSpam          = "spam"
+	ReportHarassment    = "harassment"
+	ReportHate          = "hate"
+	ReportViolence      = "violence"
+	ReportSelfHarm      = "self_harm"
+	ReportImpersonation = "impersonation"
+	ReportOther         = "other"
+	// ReportAutomod is filed by automod, with reporter 0, for chirps it
+	// holds for review. Users can't choose it.
+	ReportAutomod = "automod"
+
+	ReportOpen      = "open"
+	ReportResolved  = "resolved"
+	ReportDismissed = "dismissed"
+
+	ReportTargetChirp = "chirp"
+	ReportTargetUser  = "user"
+)
+
+var ReportReasons = []string{
+	ReportSpam,
+	ReportHarassment,
+	ReportHate,
+	ReportViolence,
+	ReportSelfHarm,
+	ReportImpersonation,
+	ReportOther,
+}
+
+var ErrAlreadyReported = errors.New("you have already reported this")
+
+// Report is a user flagging a chirp or another user for moderators.
+// TargetUserId is the reported user, or the author of a reported chirp, so
+// the queue can group everything about one account.
+type Report struct {
+	Id           int       `json:"id"`
+	ReporterId   int       `json:"reporter_id"`
+	TargetType   string    `json:"target_type"`
+	TargetId     int       `json:"target_id"`
+	TargetUserId int       `json:"target_user_id"`
+	Reason       string    `json:"reason"`
+	Detail       string    `json:"detail"`
+	Status       string    `json:"status"`
+	CreatedAt    time.Time `json:"created_at"`
+	ResolvedAt   time.Time `json:"resolved_at"`
+	ResolvedBy   int       `json:"resolved_by"`
+	Resolution   string    `json:"resolution"`
+}
+
+func IsValidReportReason(reason string) bool {
+	for _, r := range ReportReasons {
+		if r == reason {
+			return true
+		}
+	}
+	return false
+}
+
+// ReportChirp files a report by reporterId against a chirp they can see.
+func (db *DB) ReportChirp(reporterId, chirpId int, reason, detail string) (Report, error) {
+	report := Report{}
+	err := db.update(func(data *DBStructure) error {
+		chirp, ok := data.Chirps[chirpId]
+		if !ok || !data.canSeeChirp(reporterId, chirp) {
+			return ErrChirpNotFound
+		}
+
+		var err error
+		report, err = data.fileReport(Report{
+			ReporterId:   reporterId,
+			TargetType:   ReportTargetChirp,
+			TargetId:     chirpId,
+			TargetUserId: chirp.AuthorId,
+			Reason:       reason,
+			Detail:       detail,
+		})
+		return err
+	})
+	if err != nil {
+		return Report{}, err
+	}
+
+	return report, nil
+}
+
+func (db *DB) ReportUser(reporterId, userId int, reason, detail string) (Report, error) {
+	if reporterId == userId {
+		return Report{}, errors.New("you can't do that to yourself")
+	}
+
+	report := Report{}
+	err := db.update(func(data *DBStructure) error {
+		if _, ok := data.Users[userId]; !ok {
+			return errors.New("unable to find user")
+		}
+
+		var err error
+		report, err = data.fileReport(Report{
+			ReporterId:   reporterId,
+			TargetType:   ReportTargetUser,
+			TargetId:     userId,
+			TargetUserId: userId,
+			Reason:       reason,
+			Detail:       detail,
+		})
+		return err
+	})
+	if err != nil {
+		return Report{}, err
+	}
+
+	return report, nil
+}
+
+func (data *DBStructure) fileReport(report Report) (Report, error) {
+	for _, r := range data.Reports {
+		if r.ReporterId == report.ReporterId && r.TargetType == report.TargetType && r.TargetId == report.TargetId && r.Status == ReportOpen {
+			return Report{}, ErrAlreadyReported
+		}
+	}
+
+	report.Id = nextId(data, "reports", data.Reports)
+	report.Status = ReportOpen
+	report.CreatedAt = time.Now().UTC()
+	data.Reports[report.Id] = report
+
+	return report, nil
+}
+
+// GetReports returns reports with status, oldest first so the queue is
+// worked in the order reports arrived.
+func (db *DB) GetReports(status string) ([]Report, error) {
+	data, err := db.loadDB()
+	if err != nil {
+		return []Report{}, err
+	}
+
+	reports := []Report{}
+	for _, report := range data.Reports {
+		if report.Status == status {
+			reports = append(reports, report)
+		}
+	}
+
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].Id < reports[j].Id
+	})
+
+	return reports, nil
+}
+
+func (db *DB) GetReport(id int) (Report, error) {
+	data, err := db.loadDB()
+	if err != nil {
+		return Report{}, err
+	}
+
+	report, ok := data.Reports[id]
+	if !ok {
+		return Report{}, errors.New("unable to find report")
+	}
+
+	return report, nil
+}
+
+// DismissReport closes a report without action.
+func (db *DB) DismissReport(id, moderatorId int) (Report, error) {
+	report := Report{}
+	err := db.update(func(data *DBStructure) error {
+		var ok bool
+		report, ok = data.Reports[id]
+		if !ok || report.Status != ReportOpen {
+			return errors.New("unable to find open report")
+		}
+
+		report.Status = ReportDismissed
+		report.ResolvedAt = time.Now().UTC()
+		report.ResolvedBy = moderatorId
+		data.Reports[id] = report
+		return nil
+	})
+	if err != nil {
+		return Report{}, err
+	}
+
+	return report, nil
+}
+
+// resolveReports closes every open report against the target with
+// resolution, the moderation action that was taken.
+func (data *DBStructure) resolveReports(targetType string, targetId, moderatorId int, resolution string) {
+	now := time.Now().UTC()
+	for id, report := range data.Reports {
+		if report.Status != ReportOpen || report.TargetType != targetType || report.TargetId != targetId {
+			continue
+		}
+		report.Status = ReportResolved
+		report.ResolvedAt = now
+		report.ResolvedBy = moderatorId
+		report.Resolution = resolution
+		data.Reports[id] = report
+	}
+}
@@ -0,0 +1,29 @@
+package database
+
+import "time"
+
+// RevokeAccessToken adds a JWT's jti to the deny list until the token would
+// have expired anyway.
+func (db *DB) RevokeAccessToken(tokenId string, expiresAt time.Time) error {
+	return db.update(func(data *DBStructure) error {
+		now := time.Now()
+		for id, exp := range data.RevokedAccessTokens {
+			if now.After(exp) {
+				delete(data.RevokedAccessTokens, id)
+			}
+		}
+
+		data.RevokedAccessTokens[tokenId] = expiresAt
+		return nil
+	})
+}
+
+func (db *DB) IsAccessTokenRevoked(tokenId string) (bool, error) {
+	data, err := db.loadDB()
+	if err != nil {
+		return false, err
+	}
+
+	_, ok := data.RevokedAccessTokens[tokenId]
+	return ok, nil
+}
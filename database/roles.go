@@ -0,0 +1,117 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+var roleRanks = map[string]int{
+	RoleUser:      1,
+	RoleModerator: 2,
+	RoleAdmin:     3,
+}
+
+func IsValidRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// HasRole reports whether u holds role or a role above it. Users created
+// before roles existed have an empty role and are treated as RoleUser.
+func (u User) HasRole(role string) bool {
+	current := u.Role
+	if current == "" {
+		current = RoleUser
+	}
+	return roleRanks[current] >= roleRanks[role]
+}
+
+// AuditEntry records one privileged action. ActorId is 0 for actions taken
+// by the server itself, such as the bootstrap command.
+type AuditEntry struct {
+	Id         int       `json:"id"`
+	ActorId    int       `json:"actor_id"`
+	Action     string    `json:"action"`
+	TargetType string    `json:"target_type"`
+	TargetId   int       `json:"target_id"`
+	Detail     string    `json:"detail"`
+	RemoteAddr string    `json:"remote_addr"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func (db *DB) SetUserRole(userId int, role string) (User, error) {
+	if !IsValidRole(role) {
+		return User{}, errors.New("invalid role")
+	}
+
+	return db.updateUser(userId, func(user *User) error {
+		user.Role = role
+		return nil
+	})
+}
+
+func (db *DB) HasAdmin() (bool, error) {
+	data, err := db.loadDB()
+	if err != nil {
+		return false, err
+	}
+
+	for _, u := range data.Users {
+		if u.Role == RoleAdmin {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (db *DB) GetUsers() ([]User, error) {
+	data, err := db.loadDB()
+	if err != nil {
+		return []User{}, err
+	}
+
+	users := make([]User, 0, len(data.Users))
+	for _, u := range data.Users {
+		users = append(users, u)
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Id < users[j].Id
+	})
+
+	return users, nil
+}
+
+func (db *DB) RecordAudit(entry AuditEntry) error {
+	return db.update(func(data *DBStructure) error {
+		entry.Id = len(data.AuditLog) + 1
+		if entry.CreatedAt.IsZero() {
+			entry.CreatedAt = time.Now().UTC()
+		}
+		data.AuditLog = append(data.AuditLog, entry)
+		return nil
+	})
+}
+
+// GetAuditLog returns up to limit entries, newest first.
+func (db *DB) GetAuditLog(limit int) ([]AuditEntry, error) {
+	data, err := db.loadDB()
+	if err != nil {
+		return []AuditEntry{}, err
+	}
+
+	entries := make([]AuditEntry, 0, limit)
+	for i := len(data.AuditLog) - 1; i >= 0 && len(entries) < limit; i-- {
+		entries = append(entries, data.AuditLog[i])
+	}
+
+	return entries, nil
+}
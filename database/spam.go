@@ -0,0 +1,99 @@
+package database
+
+import "time"
+
+// SpamLabel is a moderator's decision about whether a chirp is spam, kept so
+// the classifier can be corrected if they change their mind.
+type SpamLabel struct {
+	Spam      bool      `json:"spam"`
+	LabeledBy int       `json:"labeled_by"`
+	LabeledAt time.Time `json:"labeled_at"`
+	// Body is what the classifier was trained with. It is empty for labels
+	// recorded before it was kept.
+	Body string `json:"body,omitempty"`
+}
+
+// SetSpamScore records the classifier's score for a new chirp.
+func (db *DB) SetSpamScore(chirpId int, score float64) error {
+	return db.update(func(data *DBStructure) error {
+		if _, ok := data.Chirps[chirpId]; !ok {
+			return ErrChirpNotFound
+		}
+		data.SpamScores[chirpId] = score
+		return nil
+	})
+}
+
+// GetSpamScore returns the score chirpId was given when it was created. The
+// second result is false for chirps created before the classifier was ready.
+func (db *DB) GetSpamScore(chirpId int) (float64, bool, error) {
+	data, err := db.loadDB()
+	if err != nil {
+		return 0, false, err
+	}
+
+	score, ok := data.SpamScores[chirpId]
+	return score, ok, nil
+}
+
+// LabelChirp records a moderator deciding chirpId is spam, which hides it,
+// or isn't, which publishes it even if automod held or shadow-hid it. Open
+// reports against the chirp are resolved either way. The label it replaces,
+// if any, is returned so its training can be undone. Relabeling with the same
+// decision keeps the body that was trained with, since nothing is retrained.
+func (db *DB) LabelChirp(chirpId, moderatorId int, spam bool) (Chirp, *SpamLabel, error) {
+	chirp := Chirp{}
+	var previous *SpamLabel
+	err := db.update(func(data *DBStructure) error {
+		var ok bool
+		chirp, ok = data.Chirps[chirpId]
+		if !ok {
+			return ErrChirpNotFound
+		}
+
+		body := chirp.Body
+		if label, ok := data.SpamLabels[chirpId]; ok {
+			previous = &label
+			if label.Spam == spam && label.Body != "" {
+				body = label.Body
+			}
+		}
+
+		data.SpamLabels[chirpId] = SpamLabel{
+			Spam:      spam,
+			LabeledBy: moderatorId,
+			LabeledAt: time.Now().UTC(),
+			Body:      body,
+		}
+
+		chirp.Hidden = spam
+		data.Chirps[chirpId] = chirp
+		delete(data.ShadowHidden, chirpId)
+
+		action := ModerationNotSpam
+		if spam {
+			action = ModerationSpam
+		}
+		data.resolveReports(ReportTargetChirp, chirpId, moderatorId, action)
+		return data.publishChirp(chirpId, time.Now())
+	})
+	if err != nil {
+		return Chirp{}, nil, err
+	}
+
+	return chirp, previous, nil
+}
+
+// forgetChirp drops what automod, the spam classifier and notifications
+// recorded about a deleted chirp. Training already done with it is kept.
+func (data *DBStructure) forgetChirp(chirpId int) {
+	delete(data.ShadowHidden, chirpId)
+	delete(data.Unpublished, chirpId)
+	delete(data.SpamScores, chirpId)
+	delete(data.SpamLabels, chirpId)
+	for id, notification := range data.Notifications {
+		if notification.ChirpId == chirpId {
+			delete(data.Notifications, id)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	SubscriptionActive   = "active"
+	SubscriptionPastDue  = "past_due"
+	SubscriptionCanceled = "canceled"
+	SubscriptionEnded    = "ended"
+	SubscriptionExpired  = "expired"
+
+	SubscriptionUpgraded      = "upgraded"
+	SubscriptionRenewed       = "renewed"
+	SubscriptionCancelled     = "cancelled"
+	SubscriptionPaymentFailed = "payment_failed"
+	SubscriptionDowngraded    = "downgraded"
+	// SubscriptionMigrated records a subscription created for a user who
+	// was upgraded before subscriptions were tracked.
+	SubscriptionMigrated = "migrated"
+
+	// SubscriptionPeriod is how long a payment lasts when the event doesn't
+	// say.
+	SubscriptionPeriod = 30 * 24 * time.Hour
+)
+
+var (
+	ErrUnknownSubscriptionEvent = errors.New("unknown subscription event")
+	ErrStaleSubscriptionEvent   = errors.New("subscription event is older than the subscription")
+)
+
+// Subscription is a user's Chirpy Red subscription. Red lasts until
+// CurrentPeriodEnd unless the subscription has ended, so cancelling or a
+// failed payment only takes it away once the paid period runs out.
+type Subscription struct {
+	Status           string              `json:"status"`
+	CurrentPeriodEnd time.Time           `json:"current_period_end"`
+	History          []SubscriptionEvent `json:"history"`
+	// LastEventAt is when the newest payment event applied happened, for
+	// events that say.
+	LastEventAt time.Time `json:"last_event_at"`
+}
+
+type SubscriptionEvent struct {
+	Event     string    `json:"event"`
+	EventId   string    `json:"event_id,omitempty"`
+	Status    string    `json:"status"`
+	PeriodEnd time.Time `json:"period_end"`
+	At        time.Time `json:"at"`
+}
+
+func (s Subscription) IsActive(now time.Time) bool {
+	switch s.Status {
+	case SubscriptionActive, SubscriptionPastDue, SubscriptionCanceled:
+		return now.Before(s.CurrentPeriodEnd)
+	}
+	return false
+}
+
+// IsChirpyRed reports whether u has Chirpy Red at now.
+func (u User) IsChirpyRed(now time.Time) bool {
+	return u.LegacyChirpyRed || u.Subscription.IsActive(now)
+}
+
+// ApplySubscriptionEvent moves u's subscription on for a payment event.
+// occurredAt is when the event happened and periodEnd when the paid period
+// ends, either zero when the event doesn't say. Events that happened before
+// the last one applied, or are about a period before the current one,
+// arrived late or out of order and return ErrStaleSubscriptionEvent.
+func (u *User) ApplySubscriptionEvent(event, eventId string, occurredAt, periodEnd, now time.Time) error {
+	s := &u.Subscription
+
+	if !occurredAt.IsZero() && occurredAt.Before(s.LastEventAt) {
+		return ErrStaleSubscriptionEvent
+	}
+	if !periodEnd.IsZero() && periodEnd.Before(s.CurrentPeriodEnd) {
+		return ErrStaleSubscriptionEvent
+	}
+
+	switch event {
+	case SubscriptionUpgraded, SubscriptionMigrated:
+		if periodEnd.IsZero() {
+			periodEnd = now.Add(SubscriptionPeriod)
+		}
+		s.Status = SubscriptionActive
+		s.CurrentPeriodEnd = periodEnd
+	case SubscriptionRenewed:
+		if periodEnd.IsZero() {
+			periodEnd = s.CurrentPeriodEnd
+			if periodEnd.Before(now) {
+				periodEnd = now
+			}
+			periodEnd = periodEnd.Add(SubscriptionPeriod)
+		}
+		s.Status = SubscriptionActive
+		s.CurrentPeriodEnd = periodEnd
+	case SubscriptionPaymentFailed:
+		s.Status = SubscriptionPastDue
+		if !periodEnd.IsZero() {
+			s.CurrentPeriodEnd = periodEnd
+		}
+	case SubscriptionCancelled:
+		s.Status = SubscriptionCanceled
+		if !periodEnd.IsZero() {
+			s.CurrentPeriodEnd = periodEnd
+		}
+	case SubscriptionDowngraded:
+		s.Status = SubscriptionEnded
+		s.CurrentPeriodEnd = now
+	case SubscriptionExpired:
+		s.Status = SubscriptionExpired
+	default:
+		return ErrUnknownSubscriptionEvent
+	}
+
+	u.LegacyChirpyRed = false
+	if occurredAt.After(s.LastEventAt) {
+		s.LastEventAt = occurredAt
+	}
+	s.History = append(s.History, SubscriptionEvent{
+		Event:     event,
+		EventId:   eventId,
+		Status:    s.Status,
+		PeriodEnd: s.CurrentPeriodEnd,
+		At:        now,
+	})
+
+	return nil
+}
+
+// ExpireSubscriptions marks subscriptions whose paid period has run out as
+// expired, and gives users upgraded before subscriptions were tracked one
+// more period, so neither keeps Red for free. It returns the users it
+// changed, and publishes user.downgraded for those whose Red expired.
+func (db *DB) ExpireSubscriptions(now time.Time) ([]User, error) {
+	changed := []User{}
+	err := db.update(func(data *DBStructure) error {
+		for id, user := range data.Users {
+			switch {
+			case user.LegacyChirpyRed:
+				user.ApplySubscriptionEvent(SubscriptionMigrated, "", time.Time{}, time.Time{}, now)
+			case user.Subscription.IsActive(now) || user.Subscription.Status == "":
+				continue
+			case user.Subscription.Status != SubscriptionEnded && user.Subscription.Status != SubscriptionExpired:
+				user.ApplySubscriptionEvent(SubscriptionExpired, "", time.Time{}, time.Time{}, now)
+				err := data.publish(EventUserDowngraded, UserEvent{UserId: user.Id, Reason: SubscriptionExpired})
+				if err != nil {
+					return err
+				}
+			default:
+				continue
+			}
+			data.Users[id] = user
+			changed = append(changed, user)
+		}
+
+		if len(changed) == 0 {
+			return errUnchanged
+		}
+		return nil
+	})
+	if err != nil {
+		return []User{}, err
+	}
+
+	return changed, nil
+}
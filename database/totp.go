@@ -0,0 +1,77 @@
+package database
+
+import "errors"
+
+var ErrTOTPCodeReused = errors.New("code has already been used")
+
+// SetPendingTOTP stores a secret the user still has to confirm with a code.
+// It replaces any earlier unconfirmed secret.
+func (db *DB) SetPendingTOTP(userId int, secret string) error {
+	_, err := db.updateUser(userId, func(user *User) error {
+		if user.TOTPEnabled {
+			return errors.New("two-factor authentication is already enabled")
+		}
+
+		user.TOTPSecret = secret
+		user.TOTPLastStep = 0
+		return nil
+	})
+	return err
+}
+
+// EnableTOTP turns on two-factor login for the pending secret and replaces
+// the user's recovery codes with recoveryHashes.
+func (db *DB) EnableTOTP(userId int, step int64, recoveryHashes []string) error {
+	_, err := db.updateUser(userId, func(user *User) error {
+		if user.TOTPSecret == "" {
+			return errors.New("no pending two-factor secret")
+		}
+
+		user.TOTPEnabled = true
+		user.TOTPLastStep = step
+		user.RecoveryCodes = recoveryHashes
+		return nil
+	})
+	return err
+}
+
+func (db *DB) DisableTOTP(userId int) error {
+	_, err := db.updateUser(userId, func(user *User) error {
+		user.TOTPEnabled = false
+		user.TOTPSecret = ""
+		user.TOTPLastStep = 0
+		user.RecoveryCodes = nil
+		return nil
+	})
+	return err
+}
+
+// RecordTOTPStep remembers the last accepted time step so the same code
+// can't be replayed within its validity window. The check and the record
+// happen under one lock, so a code raced through twice is only accepted once.
+func (db *DB) RecordTOTPStep(userId int, step int64) error {
+	_, err := db.updateUser(userId, func(user *User) error {
+		if step <= user.TOTPLastStep {
+			return ErrTOTPCodeReused
+		}
+
+		user.TOTPLastStep = step
+		return nil
+	})
+	return err
+}
+
+// UseRecoveryCode consumes the recovery code with the given hash, at most
+// once even when used twice at the same moment.
+func (db *DB) UseRecoveryCode(userId int, codeHash string) error {
+	_, err := db.updateUser(userId, func(user *User) error {
+		for i, hash := range user.RecoveryCodes {
+			if hash == codeHash {
+				user.RecoveryCodes = append(user.RecoveryCodes[:i:i], user.RecoveryCodes[i+1:]...)
+				return nil
+			}
+		}
+		return errors.New("invalid recovery code")
+	})
+	return err
+}
@@ -0,0 +1,56 @@
+package database
+
+import "time"
+
+// SystemViewer sees every chirp regardless of blocks, mutes or protected
+// accounts. It is for the server's own lookups, such as moderation, never
+// for a request made on someone's behalf. A viewerId of 0 is an anonymous
+// visitor.
+const SystemViewer = -1
+
+// canSee reports whether viewerId may see chirps by authorId. A block hides
+// chirps in both directions, a protected author's chirps are only shown to
+// approved followers, and a suspension can hide an author's chirps from
+// everyone while it lasts.
+func (data DBStructure) canSee(viewerId, authorId int) bool {
+	if viewerId == SystemViewer || viewerId == authorId {
+		return true
+	}
+
+	author := data.Users[authorId]
+	if author.ChirpsHidden && author.IsSuspended(time.Now()) {
+		return false
+	}
+
+	_, blockedByAuthor := data.Blocks[authorId][viewerId]
+	_, blockedByViewer := data.Blocks[viewerId][authorId]
+	if blockedByAuthor || blockedByViewer {
+		return false
+	}
+
+	if author.Protected {
+		return data.Follows[viewerId][authorId].Status == FollowApproved
+	}
+
+	return true
+}
+
+// canSeeChirp is canSee for a particular chirp, which moderators or automod
+// may also have hidden from everyone but its author, or which may not be
+// published yet.
+func (data DBStructure) canSeeChirp(viewerId int, chirp Chirp) bool {
+	if viewerId != SystemViewer && viewerId != chirp.AuthorId {
+		if _, shadowHidden := data.ShadowHidden[chirp.Id]; chirp.Hidden || shadowHidden {
+			return false
+		}
+		if chirp.IsScheduled(time.Now()) {
+			return false
+		}
+	}
+	return data.canSee(viewerId, chirp.AuthorId)
+}
+
+func (data DBStructure) hasMuted(viewerId, authorId int) bool {
+	_, ok := data.Mutes[viewerId][authorId]
+	return ok
+}
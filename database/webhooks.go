@@ -0,0 +1,309 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+var (
+	ErrWebhookNotFound  = errors.New("unable to find webhook")
+	ErrDeliveryNotFound = errors.New("unable to find delivery")
+)
+
+// Webhook is an integrator's callback URL and the events it wants. Secret
+// signs every delivery so the receiver can check it came from us.
+type Webhook struct {
+	Id        int       `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret"`
+	CreatedBy int       `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookDelivery is one event queued for one webhook, with every attempt
+// made to deliver it.
+type WebhookDelivery struct {
+	Id            int       `json:"id"`
+	WebhookId     int       `json:"webhook_id"`
+	EventId       string    `json:"event_id"`
+	Event         string    `json:"event"`
+	Payload       string    `json:"payload"`
+	Status        string    `json:"status"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	// Failures counts failed attempts since the delivery was queued or
+	// last redelivered, for backing off.
+	Failures    int              `json:"failures"`
+	Attempts    []WebhookAttempt `json:"attempts"`
+	CreatedAt   time.Time        `json:"created_at"`
+	DeliveredAt time.Time        `json:"delivered_at"`
+}
+
+type WebhookAttempt struct {
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"status_code"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"duration_ms"`
+}
+
+func (db *DB) CreateWebhook(url string, events []string, secret string, createdBy int) (Webhook, error) {
+	webhook := Webhook{}
+	err := db.update(func(data *DBStructure) error {
+		webhook = Webhook{
+			Id:        nextId(data, "webhooks", data.Webhooks),
+			URL:       url,
+			Events:    events,
+			Secret:    secret,
+			CreatedBy: createdBy,
+			CreatedAt: time.Now().UTC(),
+		}
+		data.Webhooks[webhook.Id] = webhook
+		return nil
+	})
+	if err != nil {
+		return Webhook{}, err
+	}
+
+	return webhook, nil
+}
+
+// GetWebhooks returns every webhook, oldest first.
+func (db *DB) GetWebhooks() ([]Webhook, error) {
+	data, err := db.loadDB()
+	if err != nil {
+		return []Webhook{}, err
+	}
+
+	webhooks := make([]Webhook, 0, len(data.Webhooks))
+	for _, webhook := range data.Webhooks {
+		webhooks = append(webhooks, webhook)
+	}
+
+	sort.Slice(webhooks, func(i, j int) bool {
+		return webhooks[i].Id < webhooks[j].Id
+	})
+
+	return webhooks, nil
+}
+
+func (db *DB) GetWebhook(id int) (Webhook, error) {
+	data, err := db.loadDB()
+	if err != nil {
+		return Webhook{}, err
+	}
+
+	webhook, ok := data.Webhooks[id]
+	if !ok {
+		return Webhook{}, ErrWebhookNotFound
+	}
+
+	return webhook, nil
+}
+
+// DeleteWebhook removes a webhook along with its delivery log.
+func (db *DB) DeleteWebhook(id int) error {
+	return db.update(func(data *DBStructure) error {
+		if _, ok := data.Webhooks[id]; !ok {
+			return ErrWebhookNotFound
+		}
+
+		delete(data.Webhooks, id)
+		for deliveryId, delivery := range data.WebhookDeliveries {
+			if delivery.WebhookId == id {
+				delete(data.WebhookDeliveries, deliveryId)
+			}
+		}
+		return nil
+	})
+}
+
+// EnqueueWebhookEvent queues payload for every webhook subscribed to event
+// and returns how many deliveries it queued. Webhooks that already have a
+// delivery of eventId are skipped, so queueing an event twice is harmless.
+func (db *DB) EnqueueWebhookEvent(eventId, event, payload string) (int, error) {
+	count := 0
+	err := db.update(func(data *DBStructure) error {
+		queued := map[int]bool{}
+		for _, delivery := range data.WebhookDeliveries {
+			if delivery.EventId == eventId {
+				queued[delivery.WebhookId] = true
+			}
+		}
+
+		now := time.Now().UTC()
+		for _, webhook := range data.Webhooks {
+			if !containsEvent(webhook.Events, event) || queued[webhook.Id] {
+				continue
+			}
+
+			delivery := WebhookDelivery{
+				Id:            nextId(data, "webhook_deliveries", data.WebhookDeliveries),
+				WebhookId:     webhook.Id,
+				EventId:       eventId,
+				Event:         event,
+				Payload:       payload,
+				Status:        DeliveryPending,
+				NextAttemptAt: now,
+				Attempts:      []WebhookAttempt{},
+				CreatedAt:     now,
+			}
+			data.WebhookDeliveries[delivery.Id] = delivery
+			count++
+		}
+
+		if count == 0 {
+			return errUnchanged
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func containsEvent(events []string, event string) bool {
+	for _, e := range events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// GetDueWebhookDeliveries returns pending deliveries whose next attempt is
+// due at now, oldest first.
+func (db *DB) GetDueWebhookDeliveries(now time.Time) ([]WebhookDelivery, error) {
+	data, err := db.loadDB()
+	if err != nil {
+		return []WebhookDelivery{}, err
+	}
+
+	deliveries := []WebhookDelivery{}
+	for _, delivery := range data.WebhookDeliveries {
+		if delivery.Status == DeliveryPending && !delivery.NextAttemptAt.After(now) {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].Id < deliveries[j].Id
+	})
+
+	return deliveries, nil
+}
+
+// RecordWebhookAttempt logs an attempt at delivery id. A delivered attempt
+// completes it; otherwise it is retried at retryAt, or dead-lettered when
+// retryAt is zero.
+func (db *DB) RecordWebhookAttempt(id int, attempt WebhookAttempt, delivered bool, retryAt time.Time) (WebhookDelivery, error) {
+	delivery := WebhookDelivery{}
+	err := db.update(func(data *DBStructure) error {
+		var ok bool
+		delivery, ok = data.WebhookDeliveries[id]
+		if !ok {
+			return ErrDeliveryNotFound
+		}
+
+		delivery.Attempts = append(delivery.Attempts, attempt)
+		if !delivered {
+			delivery.Failures++
+		}
+		switch {
+		case delivered:
+			delivery.Status = DeliveryDelivered
+			delivery.DeliveredAt = attempt.At
+		case retryAt.IsZero():
+			delivery.Status = DeliveryDead
+		default:
+			delivery.NextAttemptAt = retryAt
+		}
+		data.WebhookDeliveries[id] = delivery
+		return nil
+	})
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+
+	return delivery, nil
+}
+
+// GetWebhookDeliveries returns the deliveries for webhookId with status, or
+// with any status when status is empty, newest first.
+func (db *DB) GetWebhookDeliveries(webhookId int, status string) ([]WebhookDelivery, error) {
+	data, err := db.loadDB()
+	if err != nil {
+		return []WebhookDelivery{}, err
+	}
+
+	deliveries := []WebhookDelivery{}
+	for _, delivery := range data.WebhookDeliveries {
+		if delivery.WebhookId == webhookId && (status == "" || delivery.Status == status) {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].Id > deliveries[j].Id
+	})
+
+	return deliveries, nil
+}
+
+// RedeliverWebhook queues delivery id to be sent again straight away,
+// whether it was delivered or dead-lettered. Its earlier attempts stay in
+// the log.
+func (db *DB) RedeliverWebhook(id int) (WebhookDelivery, error) {
+	delivery := WebhookDelivery{}
+	err := db.update(func(data *DBStructure) error {
+		var ok bool
+		delivery, ok = data.WebhookDeliveries[id]
+		if !ok {
+			return ErrDeliveryNotFound
+		}
+
+		delivery.Status = DeliveryPending
+		delivery.NextAttemptAt = time.Now().UTC()
+		delivery.DeliveredAt = time.Time{}
+		delivery.Failures = 0
+		data.WebhookDeliveries[id] = delivery
+		return nil
+	})
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+
+	return delivery, nil
+}
+
+// PruneWebhookDeliveries deletes finished deliveries created before before
+// and returns how many it deleted.
+func (db *DB) PruneWebhookDeliveries(before time.Time) (int, error) {
+	pruned := 0
+	err := db.update(func(data *DBStructure) error {
+		for id, delivery := range data.WebhookDeliveries {
+			if delivery.Status != DeliveryPending && delivery.CreatedAt.Before(before) {
+				delete(data.WebhookDeliveries, id)
+				pruned++
+			}
+		}
+
+		if pruned == 0 {
+			return errUnchanged
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return pruned, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/stephenoveson/chirpy/database"
+	"github.com/stephenoveson/chirpy/entitlements"
+)
+
+func planFor(u database.User) string {
+	if u.IsChirpyRed(time.Now()) {
+		return entitlements.PlanRed
+	}
+	return entitlements.PlanFree
+}
+
+func (api *apiConfig) limitsFor(u database.User) entitlements.Limits {
+	return api.plans.For(planFor(u))
+}
+
+func (api *apiConfig) handleGetEntitlements(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Plan   string              `json:"plan"`
+		Limits entitlements.Limits `json:"limits"`
+	}
+
+	user, err := api.db.GetUserById(principalFromContext(r.Context()).UserId)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Unable to find user")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, response{
+		Plan:   planFor(user),
+		Limits: api.limitsFor(user),
+	})
+}
@@ -0,0 +1,85 @@
+// Package entitlements holds what each plan allows, loaded from a JSON file
+// so limits can change without a release.
+package entitlements
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	PlanFree = "free"
+	PlanRed  = "red"
+)
+
+// Limits is what one plan allows. Zero turns a feature off, except
+// ChirpsPerHour where it means no limit.
+type Limits struct {
+	MaxChirpLength     int `json:"max_chirp_length"`
+	EditWindowSeconds  int `json:"edit_window_seconds"`
+	ChirpsPerHour      int `json:"chirps_per_hour"`
+	MaxScheduledChirps int `json:"max_scheduled_chirps"`
+}
+
+func (l Limits) EditWindow() time.Duration {
+	return time.Duration(l.EditWindowSeconds) * time.Second
+}
+
+// Plans maps each plan to its limits.
+type Plans map[string]Limits
+
+// Defaults are used when there is no entitlements file.
+var Defaults = Plans{
+	PlanFree: {
+		MaxChirpLength: 140,
+		ChirpsPerHour:  30,
+	},
+	PlanRed: {
+		MaxChirpLength:     500,
+		EditWindowSeconds:  15 * 60,
+		ChirpsPerHour:      120,
+		MaxScheduledChirps: 20,
+	},
+}
+
+// Load reads the plans at path. A missing file gives Defaults; a file must
+// define every plan.
+func Load(path string) (Plans, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return Defaults, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	plans := Plans{}
+	err = json.Unmarshal(data, &plans)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	for _, plan := range []string{PlanFree, PlanRed} {
+		limits, ok := plans[plan]
+		if !ok {
+			return nil, fmt.Errorf("%s: plan %q is missing", path, plan)
+		}
+		if limits.MaxChirpLength < 1 || limits.EditWindowSeconds < 0 || limits.ChirpsPerHour < 0 || limits.MaxScheduledChirps < 0 {
+			return nil, fmt.Errorf("%s: plan %q has a negative limit or no chirp length", path, plan)
+		}
+	}
+
+	return plans, nil
+}
+
+// For returns the limits of plan, or of the free plan for a plan that isn't
+// configured.
+func (p Plans) For(plan string) Limits {
+	if limits, ok := p[plan]; ok {
+		return limits
+	}
+	return p[PlanFree]
+}
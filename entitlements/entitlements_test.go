@@ -0,0 +1,124 @@
+package entitlements
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    Plans
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			data: `{"free": {"max_chirp_length": 200, "chirps_per_hour": 10}, "red": {"max_chirp_length": 1000, "edit_window_seconds": 60, "max_scheduled_chirps": 5}}`,
+			want: Plans{
+				PlanFree: {MaxChirpLength: 200, ChirpsPerHour: 10},
+				PlanRed:  {MaxChirpLength: 1000, EditWindowSeconds: 60, MaxScheduledChirps: 5},
+			},
+		},
+		{
+			name: "extra plan",
+			data: `{"free": {"max_chirp_length": 140}, "red": {"max_chirp_length": 500}, "staff": {"max_chirp_length": 2000}}`,
+			want: Plans{
+				PlanFree: {MaxChirpLength: 140},
+				PlanRed:  {MaxChirpLength: 500},
+				"staff":  {MaxChirpLength: 2000},
+			},
+		},
+		{name: "missing free", data: `{"red": {"max_chirp_length": 500}}`, wantErr: true},
+		{name: "missing red", data: `{"free": {"max_chirp_length": 140}}`, wantErr: true},
+		{name: "no chirp length", data: `{"free": {"chirps_per_hour": 10}, "red": {"max_chirp_length": 500}}`, wantErr: true},
+		{name: "negative edit window", data: `{"free": {"max_chirp_length": 140}, "red": {"max_chirp_length": 500, "edit_window_seconds": -1}}`, wantErr: true},
+		{name: "negative rate", data: `{"free": {"max_chirp_length": 140, "chirps_per_hour": -1}, "red": {"max_chirp_length": 500}}`, wantErr: true},
+		{name: "negative scheduled", data: `{"free": {"max_chirp_length": 140}, "red": {"max_chirp_length": 500, "max_scheduled_chirps": -1}}`, wantErr: true},
+		{name: "string limit", data: `{"free": {"max_chirp_length": "140"}, "red": {"max_chirp_length": 500}}`, wantErr: true},
+		{name: "not json", data: `free: 140`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "entitlements.json")
+			err := os.WriteFile(path, []byte(tt.data), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			plans, err := Load(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(plans, tt.want) {
+				t.Errorf("Load() = %+v, want %+v", plans, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	plans, err := Load(filepath.Join(t.TempDir(), "entitlements.json"))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if !reflect.DeepEqual(plans, Defaults) {
+		t.Errorf("Load() = %+v, want Defaults", plans)
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	free := Defaults.For(PlanFree)
+	red := Defaults.For(PlanRed)
+
+	if free.EditWindow() != 0 || free.MaxScheduledChirps != 0 {
+		t.Errorf("free plan can edit or schedule chirps: %+v", free)
+	}
+	if red.MaxChirpLength <= free.MaxChirpLength || red.ChirpsPerHour <= free.ChirpsPerHour {
+		t.Errorf("red plan %+v doesn't allow more than free %+v", red, free)
+	}
+}
+
+func TestFor(t *testing.T) {
+	plans := Plans{
+		PlanFree: {MaxChirpLength: 140, ChirpsPerHour: 30},
+		PlanRed:  {MaxChirpLength: 500, EditWindowSeconds: 900},
+	}
+
+	tests := []struct {
+		plan string
+		want Limits
+	}{
+		{PlanFree, plans[PlanFree]},
+		{PlanRed, plans[PlanRed]},
+		{"", plans[PlanFree]},
+		{"gold", plans[PlanFree]},
+	}
+
+	for _, tt := range tests {
+		if got := plans.For(tt.plan); got != tt.want {
+			t.Errorf("For(%q) = %+v, want %+v", tt.plan, got, tt.want)
+		}
+	}
+}
+
+func TestEditWindow(t *testing.T) {
+	tests := []struct {
+		seconds int
+		want    time.Duration
+	}{
+		{0, 0},
+		{1, time.Second},
+		{900, 15 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		if got := (Limits{EditWindowSeconds: tt.seconds}).EditWindow(); got != tt.want {
+			t.Errorf("EditWindow() with %d seconds = %v, want %v", tt.seconds, got, tt.want)
+		}
+	}
+}
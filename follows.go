@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/stephenoveson/chirpy/database"
+)
+
+type followResponse struct {
+	FollowerId int        `json:"follower_id"`
+	FolloweeId int        `json:"followee_id"`
+	Status     string     `json:"status"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ApprovedAt *time.Time `json:"approved_at"`
+}
+
+func newFollowResponse(follow database.Follow) followResponse {
+	return followResponse{
+		FollowerId: follow.FollowerId,
+		FolloweeId: follow.FolloweeId,
+		Status:     follow.Status,
+		CreatedAt:  follow.CreatedAt,
+		ApprovedAt: optionalTime(follow.ApprovedAt),
+	}
+}
+
+func (api *apiConfig) handleFollowUser(w http.ResponseWriter, r *http.Request) {
+	userId := principalFromContext(r.Context()).UserId
+
+	targetId, err := strconv.Atoi(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to convert parameter to integer.")
+		return
+	}
+
+	follow, err := api.db.FollowUser(userId, targetId)
+	if errors.Is(err, database.ErrFollowBlocked) {
+		respondWithError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	status := http.StatusOK
+	if follow.Status == database.FollowPending {
+		status = http.StatusAccepted
+	}
+	respondWithJson(w, status, newFollowResponse(follow))
+}
+
+func (api *apiConfig) handleUnfollowUser(w http.ResponseWriter, r *http.Request) {
+	api.changeRelation(w, r, api.db.UnfollowUser)
+}
+
+func (api *apiConfig) handleGetFollowers(w http.ResponseWriter, r *http.Request) {
+	api.listFollows(w, r, func(userId int) ([]database.Follow, error) {
+		return api.db.GetFollowers(userId, database.FollowApproved)
+	})
+}
+
+func (api *apiConfig) handleGetFollowRequests(w http.ResponseWriter, r *http.Request) {
+	api.listFollows(w, r, func(userId int) ([]database.Follow, error) {
+		return api.db.GetFollowers(userId, database.FollowPending)
+	})
+}
+
+func (api *apiConfig) handleGetFollowing(w http.ResponseWriter, r *http.Request) {
+	api.listFollows(w, r, api.db.GetFollowing)
+}
+
+func (api *apiConfig) handleApproveFollowRequest(w http.ResponseWriter, r *http.Request) {
+	userId := principalFromContext(r.Context()).UserId
+
+	followerId, err := strconv.Atoi(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to convert parameter to integer.")
+		return
+	}
+
+	follow, err := api.db.ApproveFollowRequest(userId, followerId)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, newFollowResponse(follow))
+}
+
+// handleRemoveFollower rejects a pending follow request or removes an
+// approved follower.
+func (api *apiConfig) handleRemoveFollower(w http.ResponseWriter, r *http.Request) {
+	api.changeRelation(w, r, api.db.RemoveFollower)
+}
+
+func (api *apiConfig) handleSetProtected(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Protected bool `json:"protected"`
+	}
+	userId := principalFromContext(r.Context()).UserId
+
+	params := parameters{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	user, err := api.db.SetUserProtected(userId, params.Protected)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update user")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, newUserSuccess(user))
+}
+
+func (api *apiConfig) listFollows(w http.ResponseWriter, r *http.Request, list func(userId int) ([]database.Follow, error)) {
+	userId := principalFromContext(r.Context()).UserId
+
+	follows, err := list(userId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to read from database")
+		return
+	}
+
+	resp := make([]followResponse, 0, len(follows))
+	for _, follow := range follows {
+		resp = append(resp, newFollowResponse(follow))
+	}
+
+	respondWithJson(w, http.StatusOK, resp)
+}
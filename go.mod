@@ -7,3 +7,5 @@ require (
 	github.com/joho/godotenv v1.5.1
 	golang.org/x/crypto v0.26.0
 )
+
+require golang.org/x/sys v0.23.0 // indirect
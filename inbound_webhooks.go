@@ -0,0 +1,307 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/stephenoveson/chirpy/auth"
+	"github.com/stephenoveson/chirpy/database"
+)
+
+const (
+	maxWebhookBodyBytes = 64 << 10
+	inboxPageSize       = 100
+)
+
+// errInboundPayload marks a payload that doesn't match its provider's
+// schema. Such payloads are kept in the inbox as invalid.
+var errInboundPayload = errors.New("invalid payload")
+
+// inboundAuth authenticates a request to an inbound webhook from its
+// headers and raw body.
+type inboundAuth interface {
+	verify(r *http.Request, body []byte) error
+}
+
+// apiKeyAuth expects the shared key in an `Authorization: ApiKey` header.
+type apiKeyAuth struct {
+	key string
+}
+
+func (a apiKeyAuth) verify(r *http.Request, body []byte) error {
+	apiKey, err := auth.GetApiKey(r.Header)
+	if err != nil {
+		return err
+	}
+	if a.key == "" || subtle.ConstantTimeCompare([]byte(apiKey), []byte(a.key)) != 1 {
+		return errors.New("wrong api key")
+	}
+	return nil
+}
+
+// bearerAuth expects the shared token in an `Authorization: Bearer` header.
+type bearerAuth struct {
+	token string
+}
+
+func (a bearerAuth) verify(r *http.Request, body []byte) error {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		return err
+	}
+	if a.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+		return errors.New("wrong bearer token")
+	}
+	return nil
+}
+
+// hmacAuth expects an HMAC-SHA256 signature over the timestamp and raw body,
+// as checked by auth.VerifyWebhook. Any of secrets may have signed it.
+type hmacAuth struct {
+	secrets         [][]byte
+	timestampHeader string
+	signatureHeader string
+	tolerance       time.Duration
+}
+
+func (a hmacAuth) verify(r *http.Request, body []byte) error {
+	return auth.VerifyWebhook(a.secrets, r.Header.Get(a.timestampHeader), r.Header.Get(a.signatureHeader), body, time.Now(), a.tolerance)
+}
+
+// inboundEvent is a stored payload being handed to its provider's handler.
+type inboundEvent struct {
+	InboxId  int
+	Provider string
+	Id       string
+	Event    string
+	Payload  []byte
+}
+
+type inboundHandler func(event inboundEvent) error
+
+// inboundProvider describes a source of inbound webhooks: how its requests
+// are authenticated, how the event id and type are read from a payload and
+// which events it handles. Events without a handler are acknowledged and
+// kept in the inbox as ignored.
+type inboundProvider struct {
+	name string
+	auth inboundAuth
+	// requireEventId rejects payloads without an id, which duplicate
+	// detection relies on.
+	requireEventId bool
+	parse          func(body []byte) (id, event string, err error)
+	handlers       map[string]inboundHandler
+}
+
+func (api *apiConfig) registerInboundProvider(provider inboundProvider) {
+	api.inboundProviders[provider.name] = provider
+}
+
+// jsonEnvelope parses payloads that are JSON objects carrying the event id
+// and type as top level string fields.
+func jsonEnvelope(idField, eventField string) func(body []byte) (string, string, error) {
+	return func(body []byte) (string, string, error) {
+		fields := map[string]json.RawMessage{}
+		err := json.Unmarshal(body, &fields)
+		if err != nil {
+			return "", "", fmt.Errorf("%w: %s", errInboundPayload, err)
+		}
+
+		var id, event string
+		if raw, ok := fields[idField]; ok && json.Unmarshal(raw, &id) != nil {
+			return "", "", fmt.Errorf("%w: %s must be a string", errInboundPayload, idField)
+		}
+		if raw, ok := fields[eventField]; ok && json.Unmarshal(raw, &event) != nil {
+			return "", "", fmt.Errorf("%w: %s must be a string", errInboundPayload, eventField)
+		}
+		if event == "" {
+			return "", "", fmt.Errorf("%w: %s is required", errInboundPayload, eventField)
+		}
+
+		return id, event, nil
+	}
+}
+
+func (api *apiConfig) handleInboundWebhook(w http.ResponseWriter, r *http.Request) {
+	api.receiveInboundWebhook(w, r, r.PathValue("provider"))
+}
+
+// handlePolkaWebhook keeps the route Polka was configured with before
+// providers shared one.
+func (api *apiConfig) handlePolkaWebhook(w http.ResponseWriter, r *http.Request) {
+	api.receiveInboundWebhook(w, r, "polka")
+}
+
+// receiveInboundWebhook authenticates a webhook from the named provider,
+// stores its raw payload in the inbox and hands it to the event's handler.
+// Requests that fail authentication are logged but not stored.
+func (api *apiConfig) receiveInboundWebhook(w http.ResponseWriter, r *http.Request, name string) {
+	provider, ok := api.inboundProviders[name]
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Unable to find webhook provider")
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBodyBytes))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to read body")
+		return
+	}
+
+	err = provider.auth.verify(r, body)
+	if err != nil {
+		logSecurityEvent(fmt.Sprintf("inbound_webhook_rejected provider=%s reason=%s", name, err), 0, r)
+		respondWithError(w, http.StatusUnauthorized, "Unable to access this route")
+		return
+	}
+
+	id, event, err := provider.parse(body)
+	if err == nil && provider.requireEventId && id == "" {
+		err = fmt.Errorf("%w: event id is required", errInboundPayload)
+	}
+	if err != nil {
+		inbound, recordErr := api.db.RecordInboundWebhook(name, "", "", string(body))
+		if recordErr == nil {
+			api.db.FinishInboundWebhook(inbound.Id, database.InboundInvalid, err.Error())
+		}
+		respondWithError(w, http.StatusBadRequest, "Unable to decode parameters")
+		return
+	}
+
+	inbound, err := api.db.RecordInboundWebhook(name, id, event, string(body))
+	if errors.Is(err, database.ErrInboundDuplicate) {
+		log.Printf("Ignoring duplicate %s event %s", name, id)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't store webhook")
+		return
+	}
+
+	status, message := api.dispatchInboundWebhook(provider, inbound)
+	if message != "" {
+		respondWithError(w, status, message)
+		return
+	}
+
+	w.WriteHeader(status)
+}
+
+// dispatchInboundWebhook runs the handler for a stored payload, records the
+// outcome in the inbox and returns the HTTP status to answer with, plus an
+// error message when it failed.
+func (api *apiConfig) dispatchInboundWebhook(provider inboundProvider, inbound database.InboundWebhook) (int, string) {
+	handler, ok := provider.handlers[inbound.Event]
+	if !ok {
+		api.db.FinishInboundWebhook(inbound.Id, database.InboundIgnored, "")
+		return http.StatusNoContent, ""
+	}
+
+	err := handler(inboundEvent{
+		InboxId:  inbound.Id,
+		Provider: inbound.Provider,
+		Id:       inbound.EventId,
+		Event:    inbound.Event,
+		Payload:  []byte(inbound.Payload),
+	})
+
+	switch {
+	case err == nil:
+		api.db.FinishInboundWebhook(inbound.Id, database.InboundProcessed, "")
+		return http.StatusNoContent, ""
+	case errors.Is(err, database.ErrInboundDuplicate):
+		log.Printf("Ignoring duplicate %s event %s", inbound.Provider, inbound.EventId)
+		api.db.FinishInboundWebhook(inbound.Id, database.InboundIgnored, err.Error())
+		return http.StatusNoContent, ""
+	case errors.Is(err, database.ErrStaleSubscriptionEvent):
+		log.Printf("Ignoring stale %s event %s", inbound.Provider, inbound.EventId)
+		api.db.FinishInboundWebhook(inbound.Id, database.InboundIgnored, err.Error())
+		return http.StatusNoContent, ""
+	case errors.Is(err, errInboundPayload):
+		api.db.FinishInboundWebhook(inbound.Id, database.InboundInvalid, err.Error())
+		return http.StatusBadRequest, "Unable to decode parameters"
+	case errors.Is(err, database.ErrUserNotFound):
+		api.db.FinishInboundWebhook(inbound.Id, database.InboundFailed, err.Error())
+		return http.StatusNotFound, "Unable to find user"
+	default:
+		log.Printf("Unable to handle %s event %d: %s", inbound.Provider, inbound.Id, err)
+		api.db.FinishInboundWebhook(inbound.Id, database.InboundFailed, err.Error())
+		return http.StatusInternalServerError, "Couldn't handle webhook"
+	}
+}
+
+func (api *apiConfig) handleGetInboundWebhooks(w http.ResponseWriter, r *http.Request) {
+	inbox, err := api.db.GetInboundWebhooks(r.URL.Query().Get("provider"), r.URL.Query().Get("status"), inboxPageSize)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to read inbound webhooks from database.")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, inbox)
+}
+
+func (api *apiConfig) handleGetInboundWebhook(w http.ResponseWriter, r *http.Request) {
+	inboxId, err := strconv.Atoi(r.PathValue("inboxID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to convert parameter to integer.")
+		return
+	}
+
+	inbound, err := api.db.GetInboundWebhook(inboxId)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, inbound)
+}
+
+// handleReplayInboundWebhook hands a stored payload to its handler again,
+// for events that failed or arrived before their provider handled them.
+// Processed events can't be replayed, so nothing is applied twice.
+func (api *apiConfig) handleReplayInboundWebhook(w http.ResponseWriter, r *http.Request) {
+	inboxId, err := strconv.Atoi(r.PathValue("inboxID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to convert parameter to integer.")
+		return
+	}
+
+	inbound, err := api.db.GetInboundWebhook(inboxId)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if inbound.Status == database.InboundProcessed || inbound.Status == database.InboundInvalid {
+		respondWithError(w, http.StatusConflict, "Only failed or ignored webhooks can be replayed")
+		return
+	}
+
+	provider, ok := api.inboundProviders[inbound.Provider]
+	if !ok {
+		respondWithError(w, http.StatusConflict, "Webhook provider is no longer registered")
+		return
+	}
+
+	status, message := api.dispatchInboundWebhook(provider, inbound)
+	api.audit(r, "inbound_webhook.replayed", "inbound_webhook", inbound.Id, fmt.Sprintf("provider=%s event=%s status=%d", inbound.Provider, inbound.Event, status))
+	if message != "" {
+		respondWithError(w, status, message)
+		return
+	}
+
+	inbound, err = api.db.GetInboundWebhook(inboxId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to read inbound webhook from database.")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, inbound)
+}
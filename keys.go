@@ -0,0 +1,44 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/stephenoveson/chirpy/auth"
+)
+
+func (api *apiConfig) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJson(w, http.StatusOK, api.keys.JWKS())
+}
+
+// rotateSigningKeys backs the -rotate-keys flag. The new key starts signing
+// as soon as running servers reload the key directory; keys that stopped
+// signing more than retention ago are deleted.
+func rotateSigningKeys(keys *auth.KeySet, algorithm string, retention time.Duration) {
+	key, err := keys.Rotate(algorithm)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	log.Printf("Created signing key %s (%s)", key.Id, key.Method.Alg())
+
+	removed, err := keys.Prune(retention)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	for _, id := range removed {
+		log.Printf("Removed retired signing key %s", id)
+	}
+}
+
+func reloadSigningKeys(keys *auth.KeySet, interval time.Duration) {
+	for range time.Tick(interval) {
+		err := keys.Reload()
+		if err != nil {
+			log.Printf("Unable to reload signing keys: %s", err)
+		}
+	}
+}
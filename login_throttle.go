@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/stephenoveson/chirpy/auth"
+)
+
+const errInvalidCredentials = "Incorrect email or password"
+
+// loginLockoutPolicy locks a key once it reaches its failure threshold and
+// doubles the lockout with every further failure. IP keys get a higher
+// threshold since several people can share an address.
+type loginLockoutPolicy struct {
+	accountThreshold int
+	ipThreshold      int
+	baseLockout      time.Duration
+	maxLockout       time.Duration
+	resetAfter       time.Duration
+}
+
+var defaultLockoutPolicy = loginLockoutPolicy{
+	accountThreshold: 5,
+	ipThreshold:      20,
+	baseLockout:      30 * time.Second,
+	maxLockout:       time.Hour,
+	resetAfter:       24 * time.Hour,
+}
+
+func (p loginLockoutPolicy) LockoutFor(key string, failures int) time.Duration {
+	threshold := p.accountThreshold
+	if strings.HasPrefix(key, "ip:") {
+		threshold = p.ipThreshold
+	}
+	if failures < threshold {
+		return 0
+	}
+
+	lockout := float64(p.baseLockout) * math.Pow(2, float64(failures-threshold))
+	if lockout > float64(p.maxLockout) {
+		return p.maxLockout
+	}
+	return time.Duration(lockout)
+}
+
+func (p loginLockoutPolicy) ResetAfter() time.Duration {
+	return p.resetAfter
+}
+
+func emailThrottleKey(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipThrottleKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// checkLoginLockout responds with 429 and returns false when any of keys is
+// locked. The response is the same whether or not the email exists.
+func (api *apiConfig) checkLoginLockout(w http.ResponseWriter, keys ...string) bool {
+	now := time.Now()
+	var lockedUntil time.Time
+	for _, key := range keys {
+		throttle, err := api.db.GetLoginThrottle(key)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Unable to check login attempts")
+			return false
+		}
+		if throttle.IsLocked(now) && throttle.LockedUntil.After(lockedUntil) {
+			lockedUntil = throttle.LockedUntil
+		}
+	}
+
+	if lockedUntil.IsZero() {
+		return true
+	}
+
+	retryAfter := int(math.Ceil(lockedUntil.Sub(now).Seconds()))
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", retryAfter))
+	respondWithError(w, http.StatusTooManyRequests, "Too many failed login attempts, try again later")
+	return false
+}
+
+// recordLoginFailure counts a failed attempt against keys and raises a
+// security event for any key that just became locked.
+func (api *apiConfig) recordLoginFailure(r *http.Request, userId int, keys ...string) {
+	throttles, err := api.db.RecordLoginFailure(keys, time.Now(), defaultLockoutPolicy)
+	if err != nil {
+		log.Printf("Unable to record login failure: %s", err)
+		return
+	}
+
+	for _, throttle := range throttles {
+		if defaultLockoutPolicy.LockoutFor(throttle.Key, throttle.Failures) > 0 {
+			logSecurityEvent("login_locked "+throttle.Key, userId, r)
+		}
+	}
+}
+
+func (api *apiConfig) handleGetLockouts(w http.ResponseWriter, r *http.Request) {
+	throttles, err := api.db.GetLockedLoginThrottles(time.Now())
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to read lockouts from database.")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, throttles)
+}
+
+func (api *apiConfig) handleClearLockout(w http.ResponseWriter, r *http.Request) {
+	type response struct{}
+	key := r.PathValue("key")
+
+	err := api.db.ClearLoginFailures(key)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to clear lockout")
+		return
+	}
+
+	api.audit(r, "login.lockout_cleared", "login_throttle", 0, key)
+
+	respondWithJson(w, http.StatusNoContent, response{})
+}
+
+// newUnknownUserPasswordHash creates the hash a login is checked against
+// when its email doesn't exist, so both paths spend the same time hashing.
+func newUnknownUserPasswordHash(passwords auth.PasswordHasher) string {
+	h, err := passwords.HashPassword(fmt.Sprintf("unknown-user-%d", time.Now().UnixNano()))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return h
+}
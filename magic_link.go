@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/stephenoveson/chirpy/auth"
+	"github.com/stephenoveson/chirpy/database"
+	"github.com/stephenoveson/chirpy/mailer"
+)
+
+const (
+	magicLinkLifetime   = 15 * time.Minute
+	magicLinkNonceName  = "chirpy_magic_nonce"
+	magicLinkRateWindow = 15 * time.Minute
+	magicLinkRateLimit  = 3
+)
+
+// handleRequestMagicLink emails a single-use login link. It answers the same
+// way whether or not the email belongs to an account, and sets a cookie that
+// only the browser which asked for the link can redeem it with.
+func (api *apiConfig) handleRequestMagicLink(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Email string `json:"email"`
+	}
+	type response struct{}
+
+	params := parameters{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	email := strings.TrimSpace(params.Email)
+	if email == "" {
+		respondWithError(w, http.StatusBadRequest, "Email is required")
+		return
+	}
+
+	requests, err := api.db.RecordMagicLinkRequest(emailThrottleKey(email), time.Now().UTC(), magicLinkRateWindow)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to record login request")
+		return
+	}
+	if requests > magicLinkRateLimit {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(magicLinkRateWindow.Seconds())))
+		respondWithError(w, http.StatusTooManyRequests, "Too many login links requested, try again later")
+		return
+	}
+
+	nonce, err := auth.GenerateNonce()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create login link")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     magicLinkNonceName,
+		Value:    nonce,
+		Path:     "/api/login/magic",
+		MaxAge:   int(magicLinkLifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	user, err := api.db.GetUserByEmail(email)
+	if err == nil {
+		go api.sendMagicLink(user, auth.HashToken(nonce))
+	}
+
+	respondWithJson(w, http.StatusAccepted, response{})
+}
+
+// handleRedeemMagicLink is where the emailed link points. It finishes the
+// login the same way a password does, including the second factor step for
+// accounts with TOTP enabled.
+func (api *apiConfig) handleRedeemMagicLink(w http.ResponseWriter, r *http.Request) {
+	claims, err := auth.ValidateMagicLinkJWT(r.URL.Query().Get("token"), api.keys)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid or expired login link")
+		return
+	}
+
+	cookie, err := r.Cookie(magicLinkNonceName)
+	if err != nil || subtle.ConstantTimeCompare([]byte(auth.HashToken(cookie.Value)), []byte(claims.Nonce)) != 1 {
+		respondWithError(w, http.StatusUnauthorized, "Open the login link in the browser you requested it from")
+		return
+	}
+
+	link, err := api.db.ConsumeMagicLink(claims.ID)
+	if errors.Is(err, database.ErrMagicLinkUsed) {
+		logSecurityEvent("magic_link_reuse", link.UserId, r)
+	}
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid or expired login link")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:   magicLinkNonceName,
+		Path:   "/api/login/magic",
+		MaxAge: -1,
+	})
+
+	user, err := api.db.GetUserById(link.UserId)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid or expired login link")
+		return
+	}
+
+	if user.TOTPEnabled {
+		api.respondWithTOTPChallenge(w, user)
+		return
+	}
+
+	api.respondWithSession(w, user, 0)
+}
+
+func (api *apiConfig) sendMagicLink(user database.User, nonceHash string) {
+	claims, token, err := auth.MakeMagicLinkJWT(user.Id, nonceHash, api.keys, magicLinkLifetime)
+	if err != nil {
+		log.Printf("Unable to create login link for user %d: %s", user.Id, err)
+		return
+	}
+
+	err = api.db.CreateMagicLink(database.MagicLink{
+		TokenId:   claims.ID,
+		UserId:    user.Id,
+		ExpiresAt: claims.ExpiresAt.Time,
+	})
+	if err != nil {
+		log.Printf("Unable to save login link for user %d: %s", user.Id, err)
+		return
+	}
+
+	link := api.publicURL + "/api/login/magic/verify?token=" + url.QueryEscape(token)
+	err = api.mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Your Chirpy login link",
+		Body: fmt.Sprintf(
+			"Use this link to log in to Chirpy. It works once, in the browser you requested it from, for the next %d minutes.\n\n%s\n\nIf you didn't ask to log in you can ignore this email.\n",
+			int(magicLinkLifetime.Minutes()),
+			link,
+		),
+	})
+	if err != nil {
+		log.Printf("Unable to send login link to user %d: %s", user.Id, err)
+	}
+}
@@ -1,29 +1,78 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"log"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
+	"github.com/stephenoveson/chirpy/auth"
+	"github.com/stephenoveson/chirpy/automod"
 	"github.com/stephenoveson/chirpy/database"
+	"github.com/stephenoveson/chirpy/entitlements"
+	"github.com/stephenoveson/chirpy/mailer"
+	"github.com/stephenoveson/chirpy/spam"
 )
 
 type apiConfig struct {
 	fileserverHits int
 	db             *database.DB
-	secret         string
-	polkaKey       string
+	keys           *auth.KeySet
+	passwords      auth.PasswordHasher
+	passwordPolicy auth.PasswordPolicy
+	mailer         mailer.Mailer
+	publicURL      string
+
+	accountDeletionGrace time.Duration
+	exportDir            string
+	urlSigningSecret     []byte
+
+	automod *automod.Engine
+	spam    *spam.Classifier
+	plans   entitlements.Plans
+
+	webhookClient     *http.Client
+	webhookWake       chan struct{}
+	allowHTTPWebhooks bool
+	inboundProviders  map[string]inboundProvider
+
+	outboxConsumers []outboxConsumer
+
+	apiKeyUsage     *apiKeyUsage
+	unknownUserHash string
 }
 
 func main() {
 	dbg := flag.Bool("debug", false, "Enable debug mode")
+	rotateKeys := flag.Bool("rotate-keys", false, "Generate a new JWT signing key, prune retired keys and exit")
+	adminEmail := flag.String("bootstrap-admin", "", "Make the account with this email the first admin (creating it with ADMIN_PASSWORD if needed) and exit")
+	keyRetention := flag.Duration("key-retention", 24*time.Hour, "How long a retired signing key stays valid for verification")
 	flag.Parse()
 	godotenv.Load()
 	const dbPath = "./database/db.json"
 	const port = "8080"
 
+	keyDir := os.Getenv("JWT_KEY_DIR")
+	if keyDir == "" {
+		keyDir = "./keys"
+	}
+	keyAlgorithm := os.Getenv("JWT_KEY_ALGORITHM")
+
+	keys, err := auth.LoadKeySet(keyDir, keyAlgorithm)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	if *rotateKeys {
+		rotateSigningKeys(keys, keyAlgorithm, *keyRetention)
+		return
+	}
+
 	if *dbg {
 		err := os.Remove(dbPath)
 		if err != nil {
@@ -37,34 +86,149 @@ func main() {
 		log.Fatal(err)
 		return
 	}
+	passwords, err := passwordHasherFromEnv()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	passwordPolicy, err := passwordPolicyFromEnv()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	mail, err := mailer.New(os.Getenv("MAILER"), os.Getenv("MAIL_FROM"), os.Getenv)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	publicURL := os.Getenv("PUBLIC_URL")
+	if publicURL == "" {
+		publicURL = "http://localhost:" + port
+	}
+
+	accountDeletionGrace := defaultAccountDeletionGrace
+	err = durationFromEnv("ACCOUNT_DELETION_GRACE", &accountDeletionGrace)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	exportDir := os.Getenv("EXPORT_DIR")
+	if exportDir == "" {
+		exportDir = "./exports"
+	}
+
+	urlSigningSecret, err := urlSigningSecretFromEnv()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	polkaSecrets, err := polkaSecretsFromEnv()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	polkaTolerance := defaultPolkaWebhookTolerance
+	err = durationFromEnv("POLKA_WEBHOOK_TOLERANCE", &polkaTolerance)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	automodRules := os.Getenv("AUTOMOD_RULES")
+	if automodRules == "" {
+		automodRules = "./automod/rules.json"
+	}
+	automodEngine, err := automod.NewEngine(automodRules)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("No automod rules at %s, every chirp will be allowed", automodRules)
+	} else if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	spamModel := os.Getenv("SPAM_MODEL")
+	if spamModel == "" {
+		spamModel = "./database/spam.json"
+	}
+	spamClassifier, err := spam.Load(spamModel)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	entitlementsPath := os.Getenv("ENTITLEMENTS")
+	if entitlementsPath == "" {
+		entitlementsPath = "./entitlements.json"
+	}
+	plans, err := entitlements.Load(entitlementsPath)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	if *adminEmail != "" {
+		err = bootstrapAdmin(db, passwords, passwordPolicy, *adminEmail, os.Getenv("ADMIN_PASSWORD"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	apiCfg := apiConfig{
 		fileserverHits: 0,
 		db:             db,
-		secret:         os.Getenv("JWT_SECRET"),
-		polkaKey:       os.Getenv("POLKA_KEY"),
-	}
+		keys:           keys,
+		passwords:      passwords,
+		passwordPolicy: passwordPolicy,
+		mailer:         mail,
+		publicURL:      strings.TrimSuffix(publicURL, "/"),
 
-	mux := http.NewServeMux()
-	mux.Handle("GET /app/*", apiCfg.middlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir("./public")))))
+		accountDeletionGrace: accountDeletionGrace,
+		exportDir:            exportDir,
+		urlSigningSecret:     urlSigningSecret,
 
-	mux.HandleFunc("GET /admin/metrics", apiCfg.metricHandler)
-	mux.HandleFunc("GET /api/healthz", handlerReadiness)
-	mux.HandleFunc("GET /api/reset", apiCfg.resetMetricHandler)
+		automod: automodEngine,
+		spam:    spamClassifier,
+		plans:   plans,
 
-	mux.HandleFunc("POST /api/chirps", apiCfg.handlerCreateChirps)
-	mux.HandleFunc("GET /api/chirps", apiCfg.handlerGetChirps)
-	mux.HandleFunc("GET /api/chirps/{chirpID}", apiCfg.handlerGetChirpById)
-	mux.HandleFunc("DELETE /api/chirps/{chirpID}", apiCfg.handleDeleteChrips)
+		webhookClient:     newWebhookClient(),
+		webhookWake:       make(chan struct{}, 1),
+		allowHTTPWebhooks: os.Getenv("WEBHOOKS_ALLOW_HTTP") == "true",
+		inboundProviders:  map[string]inboundProvider{},
 
-	mux.HandleFunc("POST /api/users", apiCfg.handlerCreateUsers)
-	mux.HandleFunc("PUT /api/users", apiCfg.handleUpdateUser)
+		apiKeyUsage:     newAPIKeyUsage(),
+		unknownUserHash: newUnknownUserPasswordHash(passwords),
+	}
 
-	mux.HandleFunc("POST /api/login", apiCfg.handleLogin)
+	apiCfg.registerInboundProvider(apiCfg.polkaProvider(os.Getenv("POLKA_KEY"), polkaSecrets, polkaTolerance))
+	err = apiCfg.registerOutboxConsumer("webhooks", apiCfg.queueWebhooks)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	err = apiCfg.registerOutboxConsumer("notifications", apiCfg.notify)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
 
-	mux.HandleFunc("POST /api/refresh", apiCfg.handleTokenRefresh)
-	mux.HandleFunc("POST /api/revoke", apiCfg.handleTokenRevoke)
+	mux := apiCfg.routes()
 
-	mux.HandleFunc("POST /api/polka/webhooks", apiCfg.handlePolkaWebhook)
+	go reloadSigningKeys(keys, time.Minute)
+	go purgeDeletedAccounts(db, time.Hour)
+	go apiCfg.maintainDataExports(time.Hour)
+	go apiCfg.expireSubscriptions(time.Hour)
+	go apiCfg.deliverWebhooks(30 * time.Second)
+	go apiCfg.dispatchOutbox(10 * time.Second)
+	go apiCfg.publishScheduledChirps(30 * time.Second)
+	go apiCfg.flushAPIKeyUsage(time.Minute)
+	go reloadAutomodRules(automodEngine, 10*time.Second)
 
 	server := &http.Server{
 		Addr:    ":" + port,
@@ -74,3 +238,114 @@ func main() {
 	log.Printf("Serving on port: %s\n", port)
 	log.Fatal(server.ListenAndServe())
 }
+
+// routes registers every route on a new mux.
+func (api *apiConfig) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("GET /app/*", api.middlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir("./public")))))
+
+	mux.Handle("GET /admin/metrics", api.requireStaff(database.RoleModerator, api.metricHandler))
+	mux.Handle("GET /admin/users", api.requireStaff(database.RoleModerator, api.handleGetUsers))
+	mux.Handle("PUT /admin/users/{userID}/role", api.requireStaff(database.RoleAdmin, api.handleSetUserRole))
+	mux.Handle("GET /admin/lockouts", api.requireStaff(database.RoleModerator, api.handleGetLockouts))
+	mux.Handle("DELETE /admin/lockouts/{key}", api.requireStaff(database.RoleAdmin, api.handleClearLockout))
+	mux.Handle("GET /admin/audit", api.requireStaff(database.RoleAdmin, api.handleGetAuditLog))
+
+	mux.HandleFunc("GET /admin/moderation", api.handleModerationPage)
+	mux.Handle("GET /admin/moderation/reports", api.requireStaff(database.RoleModerator, api.handleGetModerationQueue))
+	mux.Handle("POST /admin/moderation/reports/{reportID}/dismiss", api.requireStaff(database.RoleModerator, api.handleDismissReport))
+	mux.Handle("POST /admin/moderation/chirps/{chirpID}/hide", api.requireStaff(database.RoleModerator, api.handleHideChirp))
+	mux.Handle("DELETE /admin/moderation/chirps/{chirpID}/hide", api.requireStaff(database.RoleModerator, api.handleUnhideChirp))
+	mux.Handle("POST /admin/moderation/users/{userID}/warn", api.requireStaff(database.RoleModerator, api.handleWarnUser))
+	mux.Handle("POST /admin/moderation/users/{userID}/suspend", api.requireStaff(database.RoleModerator, api.handleSuspendUser))
+	mux.Handle("POST /admin/moderation/users/{userID}/ban", api.requireStaff(database.RoleAdmin, api.handleBanUser))
+	mux.Handle("POST /admin/moderation/users/{userID}/reinstate", api.requireStaff(database.RoleAdmin, api.handleReinstateUser))
+	mux.Handle("POST /admin/moderation/chirps/{chirpID}/spam", api.requireStaff(database.RoleModerator, api.handleLabelSpam))
+	mux.Handle("POST /admin/moderation/chirps/{chirpID}/not-spam", api.requireStaff(database.RoleModerator, api.handleLabelNotSpam))
+	mux.Handle("GET /admin/spam/stats", api.requireStaff(database.RoleModerator, api.handleGetSpamStats))
+	mux.Handle("POST /admin/webhooks", api.requireStaff(database.RoleAdmin, api.handleCreateWebhook))
+	mux.Handle("GET /admin/webhooks", api.requireStaff(database.RoleAdmin, api.handleGetWebhooks))
+	mux.Handle("DELETE /admin/webhooks/{webhookID}", api.requireStaff(database.RoleAdmin, api.handleDeleteWebhook))
+	mux.Handle("GET /admin/webhooks/{webhookID}/deliveries", api.requireStaff(database.RoleAdmin, api.handleGetWebhookDeliveries))
+	mux.Handle("POST /admin/webhooks/deliveries/{deliveryID}/redeliver", api.requireStaff(database.RoleAdmin, api.handleRedeliverWebhook))
+	mux.Handle("GET /admin/outbox", api.requireStaff(database.RoleAdmin, api.handleGetOutbox))
+	mux.Handle("GET /admin/inbound-webhooks", api.requireStaff(database.RoleAdmin, api.handleGetInboundWebhooks))
+	mux.Handle("GET /admin/inbound-webhooks/{inboxID}", api.requireStaff(database.RoleAdmin, api.handleGetInboundWebhook))
+	mux.Handle("POST /admin/inbound-webhooks/{inboxID}/replay", api.requireStaff(database.RoleAdmin, api.handleReplayInboundWebhook))
+	mux.Handle("GET /admin/automod/rules", api.requireStaff(database.RoleModerator, api.handleGetAutomodRules))
+	mux.Handle("PUT /admin/automod/rules", api.requireStaff(database.RoleAdmin, api.handleSetAutomodRules))
+	mux.Handle("GET /admin/automod/stats", api.requireStaff(database.RoleModerator, api.handleGetAutomodStats))
+
+	mux.HandleFunc("GET /api/healthz", handlerReadiness)
+	mux.HandleFunc("GET /.well-known/jwks.json", api.handleJWKS)
+	mux.Handle("GET /api/reset", api.requireStaff(database.RoleAdmin, api.resetMetricHandler))
+
+	mux.Handle("POST /api/chirps", api.authenticate(api.handlerCreateChirps, auth.ScopeChirpsWrite))
+	mux.Handle("GET /api/chirps", api.identify(api.handlerGetChirps))
+	mux.Handle("GET /api/chirps/{chirpID}", api.identify(api.handlerGetChirpById))
+	mux.Handle("PUT /api/chirps/{chirpID}", api.authenticate(api.handleEditChirp, auth.ScopeChirpsWrite))
+	mux.Handle("DELETE /api/chirps/{chirpID}", api.authenticate(api.handleDeleteChrips, auth.ScopeChirpsWrite))
+	mux.Handle("POST /api/chirps/{chirpID}/report", api.authenticate(api.handleReportChirp))
+
+	mux.Handle("GET /api/notifications", api.authenticate(api.handleGetNotifications))
+	mux.Handle("POST /api/notifications/read", api.authenticate(api.handleMarkNotificationsRead, auth.ScopeUsersWrite))
+
+	mux.HandleFunc("POST /api/users", api.handlerCreateUsers)
+	mux.Handle("PUT /api/users", api.authenticate(api.requireFirstParty(api.handleUpdateUser), auth.ScopeUsersWrite))
+	mux.Handle("DELETE /api/users", api.authenticate(api.requireFirstParty(api.handleDeleteUser), auth.ScopeUsersWrite))
+
+	mux.Handle("GET /api/users/me/export", api.authenticate(api.requireFirstParty(api.handleStartDataExport)))
+	mux.Handle("GET /api/users/me/exports/{exportID}", api.authenticate(api.requireFirstParty(api.handleGetDataExport)))
+	mux.HandleFunc("GET /api/exports/{exportID}/download", api.handleDownloadDataExport)
+
+	mux.Handle("POST /api/users/{userID}/report", api.authenticate(api.handleReportUser))
+	mux.Handle("POST /api/users/{userID}/block", api.authenticate(api.handleBlockUser, auth.ScopeUsersWrite))
+	mux.Handle("DELETE /api/users/{userID}/block", api.authenticate(api.handleUnblockUser, auth.ScopeUsersWrite))
+	mux.Handle("GET /api/users/me/entitlements", api.authenticate(api.handleGetEntitlements))
+	mux.Handle("GET /api/users/me/subscription", api.authenticate(api.handleGetSubscription))
+	mux.Handle("GET /api/users/me/blocks", api.authenticate(api.handleGetBlockedUsers))
+	mux.Handle("POST /api/users/{userID}/mute", api.authenticate(api.handleMuteUser, auth.ScopeUsersWrite))
+	mux.Handle("DELETE /api/users/{userID}/mute", api.authenticate(api.handleUnmuteUser, auth.ScopeUsersWrite))
+	mux.Handle("GET /api/users/me/mutes", api.authenticate(api.handleGetMutedUsers))
+
+	mux.Handle("PUT /api/users/me/protected", api.authenticate(api.handleSetProtected, auth.ScopeUsersWrite))
+	mux.Handle("POST /api/users/{userID}/follow", api.authenticate(api.handleFollowUser, auth.ScopeUsersWrite))
+	mux.Handle("DELETE /api/users/{userID}/follow", api.authenticate(api.handleUnfollowUser, auth.ScopeUsersWrite))
+	mux.Handle("GET /api/users/me/following", api.authenticate(api.handleGetFollowing))
+	mux.Handle("GET /api/users/me/followers", api.authenticate(api.handleGetFollowers))
+	mux.Handle("DELETE /api/users/me/followers/{userID}", api.authenticate(api.handleRemoveFollower, auth.ScopeUsersWrite))
+	mux.Handle("GET /api/users/me/follow-requests", api.authenticate(api.handleGetFollowRequests))
+	mux.Handle("POST /api/users/me/follow-requests/{userID}", api.authenticate(api.handleApproveFollowRequest, auth.ScopeUsersWrite))
+	mux.Handle("DELETE /api/users/me/follow-requests/{userID}", api.authenticate(api.handleRemoveFollower, auth.ScopeUsersWrite))
+
+	mux.Handle("POST /api/users/totp", api.authenticate(api.requireFirstParty(api.handleEnrollTOTP), auth.ScopeUsersWrite))
+	mux.Handle("POST /api/users/totp/confirm", api.authenticate(api.requireFirstParty(api.handleConfirmTOTP), auth.ScopeUsersWrite))
+	mux.Handle("DELETE /api/users/totp", api.authenticate(api.requireFirstParty(api.handleDisableTOTP), auth.ScopeUsersWrite))
+
+	mux.Handle("POST /api/keys", api.authenticate(api.requireFirstParty(api.handleCreateAPIKey), auth.ScopeUsersWrite))
+	mux.Handle("GET /api/keys", api.authenticate(api.requireFirstParty(api.handleGetAPIKeys)))
+	mux.Handle("DELETE /api/keys/{keyID}", api.authenticate(api.requireFirstParty(api.handleRevokeAPIKey), auth.ScopeUsersWrite))
+
+	mux.Handle("POST /api/oauth/clients", api.authenticate(api.requireFirstParty(api.handleCreateOAuthClient), auth.ScopeUsersWrite))
+	mux.Handle("GET /api/oauth/clients", api.authenticate(api.requireFirstParty(api.handleGetOAuthClients)))
+	mux.Handle("DELETE /api/oauth/clients/{clientID}", api.authenticate(api.requireFirstParty(api.handleDeleteOAuthClient), auth.ScopeUsersWrite))
+	mux.Handle("POST /api/oauth/authorize", api.authenticate(api.requireFirstParty(api.handleOAuthAuthorize)))
+
+	mux.HandleFunc("GET /oauth/authorize", api.handleOAuthAuthorizePage)
+	mux.HandleFunc("GET /oauth/clients/{clientID}", api.handleGetOAuthClientInfo)
+	mux.HandleFunc("POST /oauth/token", api.handleOAuthToken)
+	mux.HandleFunc("POST /oauth/revoke", api.handleOAuthRevoke)
+
+	mux.HandleFunc("POST /api/login", api.handleLogin)
+	mux.HandleFunc("POST /api/login/totp", api.handleLoginTOTP)
+	mux.HandleFunc("POST /api/login/magic", api.handleRequestMagicLink)
+	mux.HandleFunc("GET /api/login/magic/verify", api.handleRedeemMagicLink)
+
+	mux.HandleFunc("POST /api/refresh", api.handleTokenRefresh)
+	mux.HandleFunc("POST /api/revoke", api.handleTokenRevoke)
+
+	mux.HandleFunc("POST /api/webhooks/{provider}", api.handleInboundWebhook)
+	mux.HandleFunc("POST /api/polka/webhooks", api.handlePolkaWebhook)
+
+	return mux
+}
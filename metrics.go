@@ -27,6 +27,7 @@ func (cfg *apiConfig) metricHandler(w http.ResponseWriter, r *http.Request) {
 
 func (cfg *apiConfig) resetMetricHandler(w http.ResponseWriter, r *http.Request) {
 	cfg.fileserverHits = 0
+	cfg.audit(r, "metrics.reset", "metrics", 0, "")
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(fmt.Sprintf("Hits: %v", cfg.fileserverHits)))
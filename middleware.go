@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/stephenoveson/chirpy/auth"
+	"github.com/stephenoveson/chirpy/database"
+)
+
+type contextKey int
+
+const principalContextKey contextKey = iota
+
+// principal is whoever authenticated the current request. APIKeyId is set
+// when the request used a personal API key rather than a JWT, and ClientId
+// when the JWT was issued to an OAuth client.
+type principal struct {
+	UserId   int
+	Scopes   []string
+	TokenId  string
+	APIKeyId int
+	ClientId string
+}
+
+// isFirstParty reports whether the user is acting directly with a token
+// from logging in, rather than through an API key or third-party app.
+func (p principal) isFirstParty() bool {
+	return p.APIKeyId == 0 && p.ClientId == ""
+}
+
+func (p principal) hasScope(scope string) bool {
+	return containsString(p.Scopes, scope)
+}
+
+// authenticate validates the bearer JWT or API key once, rejects it unless
+// it carries every scope in scopes, and hands next a request whose context
+// holds the principal.
+func (api *apiConfig) authenticate(next http.HandlerFunc, scopes ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := api.principalFromRequest(r)
+		if !api.checkPrincipalError(w, err) {
+			return
+		}
+
+		for _, scope := range scopes {
+			if !p.hasScope(scope) {
+				respondWithError(w, http.StatusForbidden, "Token is missing the "+scope+" scope")
+				return
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), principalContextKey, p)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// identify is authenticate for public routes: anonymous requests are passed
+// through with an empty principal, but credentials that are present must be
+// valid so a bad token isn't silently treated as logged out.
+func (api *apiConfig) identify(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			next(w, r)
+			return
+		}
+
+		p, err := api.principalFromRequest(r)
+		if !api.checkPrincipalError(w, err) {
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), principalContextKey, p)
+		next(w, r.WithContext(ctx))
+	})
+}
+
+// checkPrincipalError responds to a failed authentication and returns false,
+// explaining suspensions rather than treating them as a bad token.
+func (api *apiConfig) checkPrincipalError(w http.ResponseWriter, err error) bool {
+	if err == nil {
+		return true
+	}
+
+	var suspended *database.SuspendedError
+	if errors.As(err, &suspended) {
+		respondWithSuspension(w, suspended)
+		return false
+	}
+
+	respondWithError(w, http.StatusUnauthorized, err.Error())
+	return false
+}
+
+func (api *apiConfig) principalFromRequest(r *http.Request) (principal, error) {
+	if strings.HasPrefix(r.Header.Get("Authorization"), "ApiKey ") {
+		return api.principalFromAPIKey(r)
+	}
+	return api.principalFromJWT(r)
+}
+
+func (api *apiConfig) principalFromJWT(r *http.Request) (principal, error) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		return principal{}, errors.New("Couldn't find JWT")
+	}
+
+	claims, err := auth.ValidateAccessJWT(token, api.keys, api.db)
+	var suspended *database.SuspendedError
+	if errors.As(err, &suspended) {
+		return principal{}, err
+	}
+	if err != nil {
+		return principal{}, errors.New("Couldn't validate JWT")
+	}
+
+	userId, err := claims.UserId()
+	if err != nil {
+		return principal{}, errors.New("Couldn't validate JWT")
+	}
+
+	revoked, err := api.db.IsAccessTokenRevoked(claims.ID)
+	if err != nil || revoked {
+		return principal{}, errors.New("JWT has been revoked")
+	}
+
+	return principal{
+		UserId:   userId,
+		Scopes:   claims.Scopes(),
+		TokenId:  claims.ID,
+		ClientId: claims.ClientId,
+	}, nil
+}
+
+func (api *apiConfig) principalFromAPIKey(r *http.Request) (principal, error) {
+	apiKey, err := auth.GetApiKey(r.Header)
+	if err != nil {
+		return principal{}, errors.New("Couldn't find API key")
+	}
+
+	key, err := api.db.GetAPIKeyByHash(auth.HashToken(apiKey))
+	if err != nil {
+		return principal{}, errors.New("Invalid API key")
+	}
+
+	err = api.db.CheckAccount(key.UserId)
+	if err != nil {
+		return principal{}, err
+	}
+
+	api.apiKeyUsage.record(key.Id, time.Now().UTC())
+
+	return principal{
+		UserId:   key.UserId,
+		Scopes:   key.Scopes,
+		APIKeyId: key.Id,
+	}, nil
+}
+
+// principalFromContext returns the principal stored by authenticate or
+// identify. Behind identify, anonymous requests get a UserId of 0.
+func principalFromContext(ctx context.Context) principal {
+	p, _ := ctx.Value(principalContextKey).(principal)
+	return p
+}
+
+// requireFirstParty keeps credentials such as API keys and OAuth client
+// tokens from managing other credentials. It must be mounted behind
+// authenticate.
+func (api *apiConfig) requireFirstParty(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !principalFromContext(r.Context()).isFirstParty() {
+			respondWithError(w, http.StatusForbidden, "This route requires logging in directly")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// requireRole loads the authenticated user and rejects the request unless
+// they hold role or higher and have two-factor authentication enabled. It
+// must be mounted behind authenticate.
+func (api *apiConfig) requireRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := principalFromContext(r.Context())
+
+		user, err := api.db.GetUserById(p.UserId)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Unable to find user")
+			return
+		}
+
+		if !user.HasRole(role) {
+			respondWithError(w, http.StatusForbidden, "Requires the "+role+" role")
+			return
+		}
+
+		if !user.TOTPEnabled {
+			respondWithError(w, http.StatusForbidden, errStaffRequiresTOTP)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// requireStaff guards admin routes: the token must carry the admin scope and
+// the user must currently hold role.
+func (api *apiConfig) requireStaff(role string, next http.HandlerFunc) http.Handler {
+	return api.authenticate(api.requireRole(role, next), auth.ScopeAdmin)
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/stephenoveson/chirpy/database"
+	"github.com/stephenoveson/chirpy/mailer"
+)
+
+const moderationPage = "./public/admin/moderation.html"
+
+var errSuspensionEnd = errors.New("a suspension needs an until time in the future")
+
+// moderationQueueItem is an open report with enough about its target for a
+// moderator to decide without looking anything else up.
+type moderationQueueItem struct {
+	database.Report
+	Chirp      *database.Chirp `json:"chirp,omitempty"`
+	SpamScore  *float64        `json:"spam_score,omitempty"`
+	TargetUser *userModeration `json:"target_user,omitempty"`
+}
+
+type userModeration struct {
+	userSuccess
+	Warnings         int        `json:"warnings"`
+	SuspendedUntil   *time.Time `json:"suspended_until"`
+	BannedAt         *time.Time `json:"banned_at"`
+	SuspensionReason string     `json:"suspension_reason"`
+	ChirpsHidden     bool       `json:"chirps_hidden"`
+}
+
+func newUserModeration(u database.User) userModeration {
+	return userModeration{
+		userSuccess:      newUserSuccess(u),
+		Warnings:         u.Warnings,
+		SuspendedUntil:   optionalTime(u.SuspendedUntil),
+		BannedAt:         optionalTime(u.BannedAt),
+		SuspensionReason: u.SuspensionReason,
+		ChirpsHidden:     u.ChirpsHidden,
+	}
+}
+
+type moderationBody struct {
+	Reason     string     `json:"reason"`
+	Until      *time.Time `json:"until"`
+	HideChirps bool       `json:"hide_chirps"`
+}
+
+// handleModerationPage serves the moderation queue UI. The page logs in and
+// calls the JSON routes itself, so it is public; the data isn't.
+func (api *apiConfig) handleModerationPage(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, moderationPage)
+}
+
+func (api *apiConfig) handleGetModerationQueue(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = database.ReportOpen
+	}
+
+	reports, err := api.db.GetReports(status)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to read reports from database.")
+		return
+	}
+
+	queue := make([]moderationQueueItem, 0, len(reports))
+	for _, report := range reports {
+		item := moderationQueueItem{Report: report}
+
+		if report.TargetType == database.ReportTargetChirp {
+			chirp, err := api.db.GetChirpById(database.SystemViewer, report.TargetId)
+			if err == nil {
+				item.Chirp = &chirp
+			}
+			score, ok, err := api.db.GetSpamScore(report.TargetId)
+			if err == nil && ok {
+				item.SpamScore = &score
+			}
+		}
+
+		user, err := api.db.GetUserById(report.TargetUserId)
+		if err == nil {
+			target := newUserModeration(user)
+			item.TargetUser = &target
+		}
+
+		queue = append(queue, item)
+	}
+
+	respondWithJson(w, http.StatusOK, queue)
+}
+
+func (api *apiConfig) handleDismissReport(w http.ResponseWriter, r *http.Request) {
+	moderatorId := principalFromContext(r.Context()).UserId
+
+	reportId, err := strconv.Atoi(r.PathValue("reportID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to convert parameter to integer.")
+		return
+	}
+
+	report, err := api.db.DismissReport(reportId, moderatorId)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	api.audit(r, "report.dismissed", "report", report.Id, fmt.Sprintf("%s=%d", report.TargetType, report.TargetId))
+
+	respondWithJson(w, http.StatusOK, report)
+}
+
+func (api *apiConfig) handleHideChirp(w http.ResponseWriter, r *http.Request) {
+	api.setChirpHidden(w, r, true)
+}
+
+func (api *apiConfig) handleUnhideChirp(w http.ResponseWriter, r *http.Request) {
+	api.setChirpHidden(w, r, false)
+}
+
+func (api *apiConfig) setChirpHidden(w http.ResponseWriter, r *http.Request, hidden bool) {
+	moderatorId := principalFromContext(r.Context()).UserId
+
+	chirpId, err := strconv.Atoi(r.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to convert parameter to integer.")
+		return
+	}
+
+	chirp, err := api.db.SetChirpHidden(chirpId, moderatorId, hidden)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Unable to find chirp")
+		return
+	}
+
+	action := "chirp.unhidden"
+	if hidden {
+		action = "chirp.hidden"
+	}
+	api.audit(r, action, "chirp", chirp.Id, fmt.Sprintf("author_id=%d", chirp.AuthorId))
+
+	respondWithJson(w, http.StatusOK, chirp)
+}
+
+func (api *apiConfig) handleWarnUser(w http.ResponseWriter, r *http.Request) {
+	api.moderateUser(w, r, func(userId, moderatorId int, params moderationBody) (database.User, string, error) {
+		user, err := api.db.WarnUser(userId, moderatorId)
+		return user, "user.warned", err
+	})
+}
+
+func (api *apiConfig) handleSuspendUser(w http.ResponseWriter, r *http.Request) {
+	api.moderateUser(w, r, func(userId, moderatorId int, params moderationBody) (database.User, string, error) {
+		if params.Until == nil || !params.Until.After(time.Now()) {
+			return database.User{}, "", errSuspensionEnd
+		}
+		user, err := api.db.SuspendUser(userId, moderatorId, params.Until.UTC(), params.Reason, params.HideChirps)
+		return user, "user.suspended", err
+	})
+}
+
+func (api *apiConfig) handleBanUser(w http.ResponseWriter, r *http.Request) {
+	api.moderateUser(w, r, func(userId, moderatorId int, params moderationBody) (database.User, string, error) {
+		user, err := api.db.BanUser(userId, moderatorId, params.Reason, params.HideChirps)
+		return user, "user.banned", err
+	})
+}
+
+func (api *apiConfig) handleReinstateUser(w http.ResponseWriter, r *http.Request) {
+	api.moderateUser(w, r, func(userId, moderatorId int, params moderationBody) (database.User, string, error) {
+		user, err := api.db.ReinstateUser(userId, moderatorId)
+		return user, "user.reinstated", err
+	})
+}
+
+// moderateUser applies a moderation action to the user in the path, records
+// it in the audit trail and tells the user by email. Staff accounts can't be
+// moderated; demote them first.
+func (api *apiConfig) moderateUser(w http.ResponseWriter, r *http.Request, apply func(userId, moderatorId int, params moderationBody) (database.User, string, error)) {
+	moderatorId := principalFromContext(r.Context()).UserId
+
+	userId, err := strconv.Atoi(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to convert parameter to integer.")
+		return
+	}
+
+	params := moderationBody{}
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	target, err := api.db.GetUserById(userId)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Unable to find user")
+		return
+	}
+	if target.HasRole(database.RoleModerator) {
+		respondWithError(w, http.StatusForbidden, "Staff accounts can't be moderated")
+		return
+	}
+
+	user, action, err := apply(userId, moderatorId, params)
+	if errors.Is(err, errSuspensionEnd) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update user")
+		return
+	}
+
+	detail := "reason=" + params.Reason
+	if action == "user.suspended" {
+		detail = fmt.Sprintf("until=%s %s", user.SuspendedUntil.Format(time.RFC3339), detail)
+	}
+	if user.ChirpsHidden {
+		detail += " chirps_hidden"
+	}
+	api.audit(r, action, "user", user.Id, detail)
+
+	go api.sendModerationNotice(user, action, params.Reason)
+
+	respondWithJson(w, http.StatusOK, newUserModeration(user))
+}
+
+func (api *apiConfig) sendModerationNotice(user database.User, action, reason string) {
+	var subject, body string
+	switch action {
+	case "user.warned":
+		subject = "A warning about your Chirpy account"
+		body = "A moderator has warned you about activity on your account."
+	case "user.suspended":
+		subject = "Your Chirpy account has been suspended"
+		body = fmt.Sprintf("Your account is suspended until %s.", user.SuspendedUntil.Format(time.RFC1123))
+	case "user.banned":
+		subject = "Your Chirpy account has been banned"
+		body = "Your account has been permanently banned."
+	case "user.reinstated":
+		subject = "Your Chirpy account has been reinstated"
+		body = "Your account is no longer suspended."
+	default:
+		return
+	}
+	if reason != "" {
+		body += "\n\nReason: " + reason
+	}
+
+	err := api.mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: subject,
+		Body:    body + "\n",
+	})
+	if err != nil {
+		log.Printf("Unable to send moderation notice to user %d: %s", user.Id, err)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/stephenoveson/chirpy/database"
+)
+
+const (
+	defaultNotificationPage = 20
+	maxNotificationPage     = 100
+)
+
+type notificationResponse struct {
+	Id         int       `json:"id"`
+	Type       string    `json:"type"`
+	ChirpId    int       `json:"chirp_id,omitempty"`
+	ActorIds   []int     `json:"actor_ids"`
+	ActorCount int       `json:"actor_count"`
+	Message    string    `json:"message"`
+	Read       bool      `json:"read"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+func newNotificationResponse(n database.Notification) notificationResponse {
+	people := "1 person"
+	if len(n.ActorIds) != 1 {
+		people = fmt.Sprintf("%d people", len(n.ActorIds))
+	}
+
+	message := ""
+	switch n.Type {
+	case database.NotificationReply:
+		message = people + " replied to your chirp"
+	case database.NotificationFollow:
+		message = people + " followed you"
+	case database.NotificationFollowRequest:
+		message = people + " asked to follow you"
+	}
+
+	return notificationResponse{
+		Id:         n.Id,
+		Type:       n.Type,
+		ChirpId:    n.ChirpId,
+		ActorIds:   n.ActorIds,
+		ActorCount: len(n.ActorIds),
+		Message:    message,
+		Read:       n.Read,
+		CreatedAt:  n.CreatedAt,
+		UpdatedAt:  n.UpdatedAt,
+	}
+}
+
+// notify is the outbox consumer for notifications. Replies notify the
+// author of the chirp replied to once the reply is published, as long as
+// they can see it, and follows notify whoever was followed.
+func (api *apiConfig) notify(event database.OutboxEvent) error {
+	switch event.Type {
+	case database.EventChirpPublished:
+		chirp := database.Chirp{}
+		err := json.Unmarshal(event.Payload, &chirp)
+		if err != nil || chirp.ReplyToId == 0 {
+			return err
+		}
+
+		parent, err := api.db.GetChirpById(database.SystemViewer, chirp.ReplyToId)
+		if errors.Is(err, database.ErrChirpNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = api.db.GetChirpById(parent.AuthorId, chirp.Id)
+		if errors.Is(err, database.ErrChirpNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		return api.db.Notify(parent.AuthorId, database.NotificationReply, parent.Id, chirp.AuthorId, event.Id)
+
+	case database.EventUserFollowed:
+		follow := database.Follow{}
+		err := json.Unmarshal(event.Payload, &follow)
+		if err != nil {
+			return err
+		}
+
+		notificationType := database.NotificationFollow
+		if follow.Status == database.FollowPending {
+			notificationType = database.NotificationFollowRequest
+		}
+
+		return api.db.Notify(follow.FolloweeId, notificationType, 0, follow.FollowerId, event.Id)
+	}
+
+	return nil
+}
+
+// handleGetNotifications pages through the user's notifications, most
+// recently updated first. Pass the updated_at and id of the last one as
+// before and before_id to get the next page; notifications updated at the
+// same moment are ordered by id.
+func (api *apiConfig) handleGetNotifications(w http.ResponseWriter, r *http.Request) {
+	userId := principalFromContext(r.Context()).UserId
+	query := r.URL.Query()
+
+	limit := defaultNotificationPage
+	if query.Get("limit") != "" {
+		n, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || n < 1 || n > maxNotificationPage {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxNotificationPage))
+			return
+		}
+		limit = n
+	}
+
+	before := time.Now().Add(time.Minute)
+	if query.Get("before") != "" {
+		t, err := time.Parse(time.RFC3339Nano, query.Get("before"))
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "before must be an RFC 3339 time")
+			return
+		}
+		before = t
+	}
+
+	beforeId := 0
+	if query.Get("before_id") != "" {
+		n, err := strconv.Atoi(query.Get("before_id"))
+		if err != nil || n < 1 {
+			respondWithError(w, http.StatusBadRequest, "before_id must be a notification id")
+			return
+		}
+		beforeId = n
+	}
+
+	notifications, err := api.db.GetNotifications(userId, before, beforeId, query.Get("unread") == "true", limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to read notifications from database.")
+		return
+	}
+
+	resp := make([]notificationResponse, 0, len(notifications))
+	for _, notification := range notifications {
+		resp = append(resp, newNotificationResponse(notification))
+	}
+
+	respondWithJson(w, http.StatusOK, resp)
+}
+
+func (api *apiConfig) handleMarkNotificationsRead(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Ids []int `json:"ids"`
+	}
+	type response struct {
+		Marked int `json:"marked"`
+	}
+
+	userId := principalFromContext(r.Context()).UserId
+
+	params := parameters{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	marked, err := api.db.MarkNotificationsRead(userId, params.Ids)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update notifications")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, response{Marked: marked})
+}
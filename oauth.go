@@ -0,0 +1,592 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/stephenoveson/chirpy/auth"
+	"github.com/stephenoveson/chirpy/database"
+)
+
+const (
+	authorizationCodeLifetime = 10 * time.Minute
+	oauthAccessTokenLifetime  = time.Hour
+	oauthConsentPage          = "./public/oauth/consent.html"
+)
+
+// oauthScopes are the scopes a third-party app can ask a user for. They map
+// directly onto the scopes of the JWTs auth.MakeClientJWT issues. Routes that
+// change credentials also require a first-party token, so users:write never
+// lets an app change the user's email or password.
+var oauthScopes = []string{auth.ScopeChirpsWrite, auth.ScopeUsersWrite}
+
+// Errors returned while checking an authorization code, before it is used up.
+var (
+	errOAuthCodeMismatch = errors.New("authorization code was issued to another client or redirect URI")
+	errOAuthCodeVerifier = errors.New("invalid code_verifier")
+)
+
+// authorizationRequest holds the parameters of an authorization code request
+// as sent to GET /oauth/authorize and echoed back by the consent page.
+type authorizationRequest struct {
+	ResponseType        string `json:"response_type"`
+	ClientId            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
+type oauthClientResponse struct {
+	ClientId     string    `json:"client_id"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Scopes       []string  `json:"scopes"`
+	Confidential bool      `json:"confidential"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func newOAuthClientResponse(c database.OAuthClient) oauthClientResponse {
+	return oauthClientResponse{
+		ClientId:     c.ClientId,
+		Name:         c.Name,
+		RedirectURIs: c.RedirectURIs,
+		Scopes:       c.Scopes,
+		Confidential: c.IsConfidential(),
+		CreatedAt:    c.CreatedAt,
+	}
+}
+
+func (api *apiConfig) handleCreateOAuthClient(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Scopes       []string `json:"scopes"`
+		Confidential bool     `json:"confidential"`
+	}
+	type response struct {
+		oauthClientResponse
+		ClientSecret string `json:"client_secret,omitempty"`
+	}
+
+	params := parameters{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	params.Name = strings.TrimSpace(params.Name)
+	if params.Name == "" || len(params.Name) > 64 {
+		respondWithError(w, http.StatusBadRequest, "Name must be between 1 and 64 characters")
+		return
+	}
+
+	if len(params.RedirectURIs) == 0 {
+		respondWithError(w, http.StatusBadRequest, "At least one redirect URI is required")
+		return
+	}
+	for _, uri := range params.RedirectURIs {
+		err = validateRedirectURI(uri)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	if len(params.Scopes) == 0 {
+		respondWithError(w, http.StatusBadRequest, "At least one scope is required")
+		return
+	}
+	for _, scope := range params.Scopes {
+		if !containsString(oauthScopes, scope) {
+			respondWithError(w, http.StatusBadRequest, "Scope "+scope+" can't be granted to an OAuth client")
+			return
+		}
+	}
+
+	clientId, secret, err := auth.GenerateOAuthClientCredentials()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create client credentials")
+		return
+	}
+
+	client := database.OAuthClient{
+		ClientId:     clientId,
+		Name:         params.Name,
+		OwnerId:      principalFromContext(r.Context()).UserId,
+		RedirectURIs: params.RedirectURIs,
+		Scopes:       params.Scopes,
+	}
+	if params.Confidential {
+		client.SecretHash = auth.HashToken(secret)
+	} else {
+		secret = ""
+	}
+
+	saved, err := api.db.CreateOAuthClient(client)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create client")
+		return
+	}
+
+	respondWithJson(w, http.StatusCreated, response{
+		oauthClientResponse: newOAuthClientResponse(saved),
+		ClientSecret:        secret,
+	})
+}
+
+func (api *apiConfig) handleGetOAuthClients(w http.ResponseWriter, r *http.Request) {
+	clients, err := api.db.GetOAuthClientsForOwner(principalFromContext(r.Context()).UserId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to read clients from database.")
+		return
+	}
+
+	response := make([]oauthClientResponse, 0, len(clients))
+	for _, c := range clients {
+		response = append(response, newOAuthClientResponse(c))
+	}
+
+	respondWithJson(w, http.StatusOK, response)
+}
+
+func (api *apiConfig) handleDeleteOAuthClient(w http.ResponseWriter, r *http.Request) {
+	type response struct{}
+
+	err := api.db.DeleteOAuthClient(principalFromContext(r.Context()).UserId, r.PathValue("clientID"))
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Unable to find client")
+		return
+	}
+
+	respondWithJson(w, http.StatusNoContent, response{})
+}
+
+// handleGetOAuthClientInfo tells the consent page who is asking for access.
+func (api *apiConfig) handleGetOAuthClientInfo(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		ClientId string   `json:"client_id"`
+		Name     string   `json:"name"`
+		Scopes   []string `json:"scopes"`
+	}
+
+	client, err := api.db.GetOAuthClient(r.PathValue("clientID"))
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Unable to find client")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, response{
+		ClientId: client.ClientId,
+		Name:     client.Name,
+		Scopes:   client.Scopes,
+	})
+}
+
+// handleOAuthAuthorizePage validates an authorization request and serves the
+// consent page. Errors that make the redirect URI untrustworthy are shown
+// here; everything else is reported back to the client's redirect URI.
+func (api *apiConfig) handleOAuthAuthorizePage(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	req := authorizationRequest{
+		ResponseType:        query.Get("response_type"),
+		ClientId:            query.Get("client_id"),
+		RedirectURI:         query.Get("redirect_uri"),
+		Scope:               query.Get("scope"),
+		State:               query.Get("state"),
+		CodeChallenge:       query.Get("code_challenge"),
+		CodeChallengeMethod: query.Get("code_challenge_method"),
+	}
+
+	client, err := api.authorizationClient(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, errCode, err := validateAuthorizationRequest(client, req)
+	if err != nil {
+		http.Redirect(w, r, oauthRedirect(req.RedirectURI, map[string]string{
+			"error":             errCode,
+			"error_description": err.Error(),
+			"state":             req.State,
+		}), http.StatusFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	http.ServeFile(w, r, oauthConsentPage)
+}
+
+// handleOAuthAuthorize records the signed-in user's decision from the
+// consent page and tells it where to send the browser next.
+func (api *apiConfig) handleOAuthAuthorize(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		authorizationRequest
+		Approve bool `json:"approve"`
+	}
+	type response struct {
+		RedirectTo string `json:"redirect_to"`
+	}
+
+	params := parameters{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+	req := params.authorizationRequest
+
+	client, err := api.authorizationClient(req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	scopes, errCode, err := validateAuthorizationRequest(client, req)
+	if err != nil {
+		respondWithJson(w, http.StatusOK, response{
+			RedirectTo: oauthRedirect(req.RedirectURI, map[string]string{
+				"error":             errCode,
+				"error_description": err.Error(),
+				"state":             req.State,
+			}),
+		})
+		return
+	}
+
+	if !params.Approve {
+		respondWithJson(w, http.StatusOK, response{
+			RedirectTo: oauthRedirect(req.RedirectURI, map[string]string{
+				"error": "access_denied",
+				"state": req.State,
+			}),
+		})
+		return
+	}
+
+	code, err := auth.GenerateAuthorizationCode()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create authorization code")
+		return
+	}
+
+	err = api.db.CreateOAuthCode(database.OAuthCode{
+		CodeHash:      auth.HashToken(code),
+		ClientId:      client.ClientId,
+		UserId:        principalFromContext(r.Context()).UserId,
+		RedirectURI:   req.RedirectURI,
+		Scopes:        scopes,
+		CodeChallenge: req.CodeChallenge,
+		ExpiresAt:     time.Now().Add(authorizationCodeLifetime).UTC(),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save authorization code")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, response{
+		RedirectTo: oauthRedirect(req.RedirectURI, map[string]string{
+			"code":  code,
+			"state": req.State,
+		}),
+	})
+}
+
+// handleOAuthToken is the RFC 6749 token endpoint. It accepts form encoded
+// authorization_code and refresh_token grants.
+func (api *apiConfig) handleOAuthToken(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		respondWithOAuthError(w, http.StatusBadRequest, "invalid_request", "Couldn't parse form")
+		return
+	}
+
+	client, err := api.authenticateOAuthClient(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="chirpy"`)
+		respondWithOAuthError(w, http.StatusUnauthorized, "invalid_client", err.Error())
+		return
+	}
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		api.exchangeAuthorizationCode(w, r, client)
+	case "refresh_token":
+		api.exchangeClientRefreshToken(w, r, client)
+	default:
+		respondWithOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "Only authorization_code and refresh_token are supported")
+	}
+}
+
+func (api *apiConfig) exchangeAuthorizationCode(w http.ResponseWriter, r *http.Request, client database.OAuthClient) {
+	refreshToken, err := auth.GetRefreshToken()
+	if err != nil {
+		respondWithOAuthError(w, http.StatusInternalServerError, "server_error", "Couldn't create refresh token")
+		return
+	}
+
+	check := func(code database.OAuthCode) error {
+		if code.ClientId != client.ClientId || code.RedirectURI != r.PostForm.Get("redirect_uri") {
+			return errOAuthCodeMismatch
+		}
+		if !auth.VerifyPKCE(r.PostForm.Get("code_verifier"), code.CodeChallenge) {
+			return errOAuthCodeVerifier
+		}
+		return nil
+	}
+
+	code, _, err := api.db.ExchangeOAuthCode(auth.HashToken(r.PostForm.Get("code")), check, auth.HashToken(refreshToken), time.Now().Add(refreshTokenLifetime).UTC())
+	switch {
+	case errors.Is(err, database.ErrOAuthCodeReused):
+		logSecurityEvent("oauth_code_reuse client="+client.ClientId, code.UserId, r)
+		respondWithOAuthError(w, http.StatusBadRequest, "invalid_grant", "Authorization code has already been used")
+		return
+	case errors.Is(err, errOAuthCodeMismatch):
+		respondWithOAuthError(w, http.StatusBadRequest, "invalid_grant", "Authorization code was issued to another client or redirect URI")
+		return
+	case errors.Is(err, errOAuthCodeVerifier):
+		respondWithOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid code_verifier")
+		return
+	case errors.Is(err, database.ErrUserNotFound):
+		respondWithOAuthError(w, http.StatusInternalServerError, "server_error", "Couldn't save refresh token")
+		return
+	case err != nil:
+		respondWithOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid or expired authorization code")
+		return
+	}
+
+	api.respondWithClientTokens(w, code.UserId, client.ClientId, code.Scopes, refreshToken)
+}
+
+func (api *apiConfig) exchangeClientRefreshToken(w http.ResponseWriter, r *http.Request, client database.OAuthClient) {
+	newRefreshToken, err := auth.GetRefreshToken()
+	if err != nil {
+		respondWithOAuthError(w, http.StatusInternalServerError, "server_error", "Couldn't create refresh token")
+		return
+	}
+
+	rotated, err := api.db.RotateRefreshToken(
+		auth.HashToken(r.PostForm.Get("refresh_token")),
+		auth.HashToken(newRefreshToken),
+		client.ClientId,
+		time.Now().Add(refreshTokenLifetime).UTC(),
+	)
+	if errors.Is(err, database.ErrRefreshTokenReused) {
+		logSecurityEvent("refresh_token_reuse client="+client.ClientId, rotated.UserId, r)
+		respondWithOAuthError(w, http.StatusBadRequest, "invalid_grant", err.Error())
+		return
+	}
+	if err != nil {
+		respondWithOAuthError(w, http.StatusBadRequest, "invalid_grant", err.Error())
+		return
+	}
+
+	scopes := rotated.Scopes
+	if requested := r.PostForm.Get("scope"); requested != "" {
+		scopes = strings.Fields(requested)
+		for _, scope := range scopes {
+			if !containsString(rotated.Scopes, scope) {
+				respondWithOAuthError(w, http.StatusBadRequest, "invalid_scope", "Scope "+scope+" wasn't granted")
+				return
+			}
+		}
+	}
+
+	api.respondWithClientTokens(w, rotated.UserId, client.ClientId, scopes, newRefreshToken)
+}
+
+func (api *apiConfig) respondWithClientTokens(w http.ResponseWriter, userId int, clientId string, scopes []string, refreshToken string) {
+	type response struct {
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		ExpiresIn    int    `json:"expires_in"`
+		RefreshToken string `json:"refresh_token"`
+		Scope        string `json:"scope"`
+	}
+
+	err := api.db.CheckAccount(userId)
+	if err != nil {
+		respondWithOAuthError(w, http.StatusBadRequest, "invalid_grant", err.Error())
+		return
+	}
+
+	accessToken, err := auth.MakeClientJWT(userId, clientId, scopes, api.keys, oauthAccessTokenLifetime)
+	if err != nil {
+		respondWithOAuthError(w, http.StatusInternalServerError, "server_error", "Couldn't create access token")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJson(w, http.StatusOK, response{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(oauthAccessTokenLifetime.Seconds()),
+		RefreshToken: refreshToken,
+		Scope:        strings.Join(scopes, " "),
+	})
+}
+
+// handleOAuthRevoke is the RFC 7009 revocation endpoint. Refresh tokens
+// revoke their whole family; access tokens are deny-listed by jti until they
+// expire. Unknown tokens still get a 200 as the RFC requires.
+func (api *apiConfig) handleOAuthRevoke(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		respondWithOAuthError(w, http.StatusBadRequest, "invalid_request", "Couldn't parse form")
+		return
+	}
+
+	client, err := api.authenticateOAuthClient(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="chirpy"`)
+		respondWithOAuthError(w, http.StatusUnauthorized, "invalid_client", err.Error())
+		return
+	}
+
+	token := r.PostForm.Get("token")
+	err = api.db.RevokeRefreshToken(auth.HashToken(token), client.ClientId)
+	if err != nil {
+		claims, err := auth.ValidateJWT(token, api.keys)
+		if err == nil && claims.ClientId == client.ClientId {
+			err = api.db.RevokeAccessToken(claims.ID, claims.ExpiresAt.Time)
+			if err != nil {
+				respondWithOAuthError(w, http.StatusServiceUnavailable, "server_error", "Couldn't revoke token")
+				return
+			}
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// authenticateOAuthClient identifies the client calling the token or
+// revocation endpoint. Confidential clients must send their secret with HTTP
+// Basic auth or in the form; public clients only send client_id.
+func (api *apiConfig) authenticateOAuthClient(r *http.Request) (database.OAuthClient, error) {
+	clientId, secret, hasBasic := r.BasicAuth()
+	if hasBasic {
+		var err error
+		clientId, err = url.QueryUnescape(clientId)
+		if err != nil {
+			return database.OAuthClient{}, errors.New("malformed client credentials")
+		}
+		secret, err = url.QueryUnescape(secret)
+		if err != nil {
+			return database.OAuthClient{}, errors.New("malformed client credentials")
+		}
+	} else {
+		clientId = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+
+	client, err := api.db.GetOAuthClient(clientId)
+	if err != nil {
+		return database.OAuthClient{}, errors.New("unknown client")
+	}
+
+	if client.IsConfidential() && !auth.CheckSecretHash(secret, client.SecretHash) {
+		return database.OAuthClient{}, errors.New("invalid client credentials")
+	}
+
+	return client, nil
+}
+
+// authorizationClient looks up the client of an authorization request and
+// checks the redirect URI is one it registered. Until both pass, errors
+// must not be sent to the redirect URI.
+func (api *apiConfig) authorizationClient(req authorizationRequest) (database.OAuthClient, error) {
+	client, err := api.db.GetOAuthClient(req.ClientId)
+	if err != nil {
+		return database.OAuthClient{}, errors.New("unknown client_id")
+	}
+
+	if !containsString(client.RedirectURIs, req.RedirectURI) {
+		return database.OAuthClient{}, errors.New("redirect_uri is not registered for this client")
+	}
+
+	return client, nil
+}
+
+// validateAuthorizationRequest checks the rest of an authorization request
+// and returns the scopes to grant, or an OAuth error code.
+func validateAuthorizationRequest(client database.OAuthClient, req authorizationRequest) ([]string, string, error) {
+	if req.ResponseType != "code" {
+		return nil, "unsupported_response_type", errors.New("response_type must be code")
+	}
+
+	if req.CodeChallenge == "" || req.CodeChallengeMethod != "S256" {
+		return nil, "invalid_request", errors.New("PKCE with code_challenge_method S256 is required")
+	}
+
+	scopes := strings.Fields(req.Scope)
+	if len(scopes) == 0 {
+		scopes = client.Scopes
+	}
+	for _, scope := range scopes {
+		if !containsString(client.Scopes, scope) {
+			return nil, "invalid_scope", errors.New("scope " + scope + " is not allowed for this client")
+		}
+	}
+
+	return scopes, "", nil
+}
+
+// validateRedirectURI requires https, except for loopback addresses used by
+// native apps and local development.
+func validateRedirectURI(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return errors.New("redirect URI " + raw + " is not an absolute URL")
+	}
+	if u.Fragment != "" {
+		return errors.New("redirect URI " + raw + " must not contain a fragment")
+	}
+
+	host := u.Hostname()
+	isLoopback := host == "localhost" || host == "127.0.0.1" || host == "::1"
+	if u.Scheme != "https" && !(u.Scheme == "http" && isLoopback) {
+		return errors.New("redirect URI " + raw + " must use https")
+	}
+
+	return nil
+}
+
+func oauthRedirect(redirectURI string, params map[string]string) string {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		return redirectURI
+	}
+
+	query := u.Query()
+	for key, value := range params {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+func respondWithOAuthError(w http.ResponseWriter, code int, errCode, description string) {
+	type errorResponse struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description,omitempty"`
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJson(w, code, errorResponse{
+		Error:            errCode,
+		ErrorDescription: description,
+	})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/stephenoveson/chirpy/database"
+)
+
+const (
+	outboxBatchSize = 100
+	outboxRetention = 7 * 24 * time.Hour
+
+	// A failed event is retried after outboxRetryDelay, doubling each time
+	// up to outboxMaxRetryDelay, and skipped after outboxMaxFailures.
+	outboxRetryDelay    = 10 * time.Second
+	outboxMaxRetryDelay = time.Hour
+	outboxMaxFailures   = 10
+)
+
+// outboxConsumer handles events from the outbox in order. Each event is
+// handled at least once: one that was handled but not yet checkpointed when
+// the server stopped is handled again, so handlers must tolerate repeats.
+// A handler that returns an error is retried from that event with a growing
+// delay, holding up the events after it, until it has failed
+// outboxMaxFailures times in a row and the event is skipped.
+type outboxConsumer struct {
+	name   string
+	handle func(event database.OutboxEvent) error
+}
+
+// registerOutboxConsumer adds a consumer, creating its checkpoint at the end
+// of the outbox if it is new. It must run before the server starts, so a new
+// consumer doesn't miss events published while the dispatcher starts up.
+func (api *apiConfig) registerOutboxConsumer(name string, handle func(event database.OutboxEvent) error) error {
+	_, err := api.db.StartOutboxConsumer(name)
+	if err != nil {
+		return err
+	}
+
+	api.outboxConsumers = append(api.outboxConsumers, outboxConsumer{name: name, handle: handle})
+	return nil
+}
+
+// dispatchOutbox hands new outbox events to every consumer whenever events
+// are published and at least every interval, so failed events are retried.
+// Events every consumer has handled are pruned once a day.
+func (api *apiConfig) dispatchOutbox(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	names := make([]string, 0, len(api.outboxConsumers))
+	for _, consumer := range api.outboxConsumers {
+		names = append(names, consumer.name)
+	}
+
+	lastPrune := time.Time{}
+	for {
+		for _, consumer := range api.outboxConsumers {
+			api.drainOutbox(consumer)
+		}
+
+		if time.Since(lastPrune) > 24*time.Hour {
+			lastPrune = time.Now()
+			_, err := api.db.PruneOutbox(names, lastPrune.Add(-outboxRetention))
+			if err != nil {
+				log.Printf("Unable to prune outbox: %s", err)
+			}
+		}
+
+		select {
+		case <-api.db.Published():
+		case <-ticker.C:
+		}
+	}
+}
+
+// drainOutbox hands consumer every event after its checkpoint, moving the
+// checkpoint past each one it handles, until it catches up or fails. A
+// consumer that failed waits out its retry delay first.
+func (api *apiConfig) drainOutbox(consumer outboxConsumer) {
+	for {
+		checkpoint, err := api.db.StartOutboxConsumer(consumer.name)
+		if err != nil {
+			log.Printf("Unable to load outbox checkpoint for %s: %s", consumer.name, err)
+			return
+		}
+		if checkpoint.Failures > 0 && time.Since(checkpoint.UpdatedAt) < outboxBackoff(checkpoint.Failures) {
+			return
+		}
+
+		events, err := api.db.GetOutboxEvents(checkpoint.LastEventId, outboxBatchSize)
+		if err != nil {
+			log.Printf("Unable to load outbox events: %s", err)
+			return
+		}
+
+		for _, event := range events {
+			err = consumer.handle(event)
+			if err != nil {
+				log.Printf("Outbox consumer %s failed on event %d: %s", consumer.name, event.Id, err)
+				checkpoint, failErr := api.db.FailOutboxCheckpoint(consumer.name, err.Error())
+				if failErr != nil || checkpoint.Failures < outboxMaxFailures {
+					return
+				}
+
+				log.Printf("Outbox consumer %s skipped event %d after %d failures", consumer.name, event.Id, checkpoint.Failures)
+				err = api.db.SkipOutboxEvent(consumer.name, event.Id, err.Error())
+				if err != nil {
+					log.Printf("Unable to skip outbox event %d for %s: %s", event.Id, consumer.name, err)
+					return
+				}
+				continue
+			}
+
+			err = api.db.AdvanceOutboxCheckpoint(consumer.name, event.Id)
+			if err != nil {
+				log.Printf("Unable to checkpoint outbox consumer %s: %s", consumer.name, err)
+				return
+			}
+		}
+
+		if len(events) < outboxBatchSize {
+			return
+		}
+	}
+}
+
+// outboxBackoff is how long a consumer waits after its nth failure in a row.
+func outboxBackoff(failures int) time.Duration {
+	delay := outboxRetryDelay
+	for i := 1; i < failures && delay < outboxMaxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, outboxMaxRetryDelay)
+}
+
+func (api *apiConfig) handleGetOutbox(w http.ResponseWriter, r *http.Request) {
+	type consumerResponse struct {
+		database.OutboxCheckpoint
+		Pending int `json:"pending"`
+	}
+
+	checkpoints, pending, err := api.db.GetOutboxCheckpoints()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to read outbox from database.")
+		return
+	}
+
+	resp := make([]consumerResponse, 0, len(checkpoints))
+	for _, checkpoint := range checkpoints {
+		if checkpoint.Skipped == nil {
+			checkpoint.Skipped = []int{}
+		}
+		resp = append(resp, consumerResponse{OutboxCheckpoint: checkpoint, Pending: pending[checkpoint.Consumer]})
+	}
+
+	respondWithJson(w, http.StatusOK, resp)
+}
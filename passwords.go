@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/stephenoveson/chirpy/auth"
+)
+
+// passwordHasherFromEnv builds the hasher new passwords are hashed with.
+// Existing hashes made with other settings keep working and are upgraded
+// the next time their owner logs in.
+func passwordHasherFromEnv() (auth.PasswordHasher, error) {
+	hasher := auth.DefaultPasswordHasher
+
+	if algorithm := os.Getenv("PASSWORD_HASH_ALGORITHM"); algorithm != "" {
+		hasher.Algorithm = algorithm
+	}
+
+	err := errors.Join(
+		uintFromEnv("ARGON2_MEMORY_KIB", &hasher.Argon2.Memory, 32),
+		uintFromEnv("ARGON2_ITERATIONS", &hasher.Argon2.Iterations, 32),
+		uintFromEnv("ARGON2_PARALLELISM", &hasher.Argon2.Parallelism, 8),
+		intFromEnv("BCRYPT_COST", &hasher.BcryptCost),
+	)
+	if err != nil {
+		return auth.PasswordHasher{}, err
+	}
+
+	return hasher, hasher.Validate()
+}
+
+func passwordPolicyFromEnv() (auth.PasswordPolicy, error) {
+	policy := auth.PasswordPolicy{
+		MinLength: 8,
+		MaxLength: 128,
+	}
+
+	err := errors.Join(
+		intFromEnv("PASSWORD_MIN_LENGTH", &policy.MinLength),
+		intFromEnv("PASSWORD_MAX_LENGTH", &policy.MaxLength),
+	)
+	if err != nil {
+		return auth.PasswordPolicy{}, err
+	}
+
+	path := os.Getenv("BREACHED_PASSWORDS_FILE")
+	if path == "" {
+		path = "./auth/breached_passwords.txt"
+	}
+
+	err = policy.LoadBreachedPasswords(path)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("No breached password list at %s, only checking length", path)
+		return policy, nil
+	}
+
+	return policy, err
+}
+
+func intFromEnv(name string, dst *int) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return errors.New(name + " must be an integer")
+	}
+	*dst = parsed
+	return nil
+}
+
+func uintFromEnv[T uint8 | uint32](name string, dst *T, bitSize int) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+
+	parsed, err := strconv.ParseUint(value, 10, bitSize)
+	if err != nil {
+		return errors.New(name + " must be a positive integer")
+	}
+	*dst = T(parsed)
+	return nil
+}
+
+func durationFromEnv(name string, dst *time.Duration) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed < 0 {
+		return errors.New(name + " must be a positive duration such as 720h")
+	}
+	*dst = parsed
+	return nil
+}
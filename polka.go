@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/stephenoveson/chirpy/database"
+)
+
+const defaultPolkaWebhookTolerance = 5 * time.Minute
+
+// polkaSecretsFromEnv reads the comma separated POLKA_WEBHOOK_SECRETS. List
+// the new secret alongside the old one while rotating.
+func polkaSecretsFromEnv() ([][]byte, error) {
+	secrets := [][]byte{}
+	for _, secret := range strings.Split(os.Getenv("POLKA_WEBHOOK_SECRETS"), ",") {
+		secret = strings.TrimSpace(secret)
+		if secret == "" {
+			continue
+		}
+		if len(secret) < 32 {
+			return nil, errors.New("POLKA_WEBHOOK_SECRETS must each be at least 32 characters")
+		}
+		secrets = append(secrets, []byte(secret))
+	}
+	return secrets, nil
+}
+
+// polkaProvider verifies the Polka-Timestamp and Polka-Signature headers
+// when webhook secrets are configured. Without them it falls back to the
+// static ApiKey from before webhooks were signed, and events need no id.
+func (api *apiConfig) polkaProvider(apiKey string, secrets [][]byte, tolerance time.Duration) inboundProvider {
+	provider := inboundProvider{
+		name:     "polka",
+		auth:     apiKeyAuth{key: apiKey},
+		parse:    jsonEnvelope("id", "event"),
+		handlers: map[string]inboundHandler{},
+	}
+	if len(secrets) > 0 {
+		provider.auth = hmacAuth{
+			secrets:         secrets,
+			timestampHeader: "Polka-Timestamp",
+			signatureHeader: "Polka-Signature",
+			tolerance:       tolerance,
+		}
+		provider.requireEventId = true
+	}
+
+	for event := range polkaSubscriptionEvents {
+		provider.handlers[event] = api.handlePolkaSubscriptionEvent
+	}
+
+	return provider
+}
+
+func (api *apiConfig) handlePolkaSubscriptionEvent(event inboundEvent) error {
+	type parameters struct {
+		CreatedAt *time.Time `json:"created_at"`
+		Data      struct {
+			UserID           int        `json:"user_id"`
+			CurrentPeriodEnd *time.Time `json:"current_period_end"`
+		} `json:"data"`
+	}
+
+	params := parameters{}
+	err := json.Unmarshal(event.Payload, &params)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errInboundPayload, err)
+	}
+
+	subscriptionEvent := polkaSubscriptionEvents[event.Event]
+	periodEnd := time.Time{}
+	if params.Data.CurrentPeriodEnd != nil {
+		periodEnd = params.Data.CurrentPeriodEnd.UTC()
+	}
+	occurredAt := time.Time{}
+	if params.CreatedAt != nil {
+		occurredAt = params.CreatedAt.UTC()
+	}
+
+	return api.db.ApplyInboundWebhookToUser(event.InboxId, params.Data.UserID, func(user *database.User, outbox database.Outbox) error {
+		err := user.ApplySubscriptionEvent(subscriptionEvent, event.Id, occurredAt, periodEnd, time.Now().UTC())
+		if err != nil {
+			return err
+		}
+
+		switch subscriptionEvent {
+		case database.SubscriptionUpgraded:
+			return outbox.Publish(database.EventUserUpgraded, database.UserEvent{UserId: user.Id})
+		case database.SubscriptionDowngraded:
+			return outbox.Publish(database.EventUserDowngraded, database.UserEvent{UserId: user.Id, Reason: database.SubscriptionDowngraded})
+		}
+		return nil
+	})
+}
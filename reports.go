@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stephenoveson/chirpy/database"
+)
+
+const maxReportDetailLength = 500
+
+type reportResponse struct {
+	Id         int       `json:"id"`
+	TargetType string    `json:"target_type"`
+	TargetId   int       `json:"target_id"`
+	Reason     string    `json:"reason"`
+	Detail     string    `json:"detail"`
+	Status     string    `json:"status"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func newReportResponse(report database.Report) reportResponse {
+	return reportResponse{
+		Id:         report.Id,
+		TargetType: report.TargetType,
+		TargetId:   report.TargetId,
+		Reason:     report.Reason,
+		Detail:     report.Detail,
+		Status:     report.Status,
+		CreatedAt:  report.CreatedAt,
+	}
+}
+
+type reportBody struct {
+	Reason string `json:"reason"`
+	Detail string `json:"detail"`
+}
+
+func (api *apiConfig) handleReportChirp(w http.ResponseWriter, r *http.Request) {
+	api.fileReport(w, r, "chirpID", api.db.ReportChirp)
+}
+
+func (api *apiConfig) handleReportUser(w http.ResponseWriter, r *http.Request) {
+	api.fileReport(w, r, "userID", api.db.ReportUser)
+}
+
+// fileReport validates a report from the caller against the chirp or user
+// named by the pathParam and hands it to file.
+func (api *apiConfig) fileReport(w http.ResponseWriter, r *http.Request, pathParam string, file func(reporterId, targetId int, reason, detail string) (database.Report, error)) {
+	userId := principalFromContext(r.Context()).UserId
+
+	targetId, err := strconv.Atoi(r.PathValue(pathParam))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to convert parameter to integer.")
+		return
+	}
+
+	params := reportBody{}
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	if !database.IsValidReportReason(params.Reason) {
+		respondWithError(w, http.StatusBadRequest, "Reason must be one of "+strings.Join(database.ReportReasons, ", "))
+		return
+	}
+	params.Detail = strings.TrimSpace(params.Detail)
+	if len(params.Detail) > maxReportDetailLength {
+		respondWithError(w, http.StatusBadRequest, "Detail is too long")
+		return
+	}
+
+	report, err := file(userId, targetId, params.Reason, params.Detail)
+	if errors.Is(err, database.ErrAlreadyReported) {
+		respondWithError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if errors.Is(err, database.ErrChirpNotFound) {
+		respondWithError(w, http.StatusNotFound, "Unable to find chirp")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	respondWithJson(w, http.StatusCreated, newReportResponse(report))
+}
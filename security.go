@@ -0,0 +1,12 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+// logSecurityEvent records something an operator should look at, such as a
+// replayed refresh token, along with where the request came from.
+func logSecurityEvent(event string, userId int, r *http.Request) {
+	log.Printf("Security event: %s user=%d remote=%s user_agent=%q", event, userId, r.RemoteAddr, r.UserAgent())
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+func (api *apiConfig) handleLabelSpam(w http.ResponseWriter, r *http.Request) {
+	api.labelChirp(w, r, true)
+}
+
+func (api *apiConfig) handleLabelNotSpam(w http.ResponseWriter, r *http.Request) {
+	api.labelChirp(w, r, false)
+}
+
+// labelChirp records a moderator's spam decision and trains the classifier
+// with it. Relabeling a chirp undoes the training from its earlier label,
+// using the body that label was trained with.
+func (api *apiConfig) labelChirp(w http.ResponseWriter, r *http.Request, isSpam bool) {
+	moderatorId := principalFromContext(r.Context()).UserId
+
+	chirpId, err := strconv.Atoi(r.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to convert parameter to integer.")
+		return
+	}
+
+	chirp, previous, err := api.db.LabelChirp(chirpId, moderatorId, isSpam)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Unable to find chirp")
+		return
+	}
+
+	if previous == nil || previous.Spam != isSpam {
+		if previous != nil {
+			trained := previous.Body
+			if trained == "" {
+				trained = chirp.Body
+			}
+			err = api.spam.Untrain(trained, previous.Spam)
+		}
+		if err == nil {
+			err = api.spam.Train(chirp.Body, isSpam)
+		}
+		if err != nil {
+			log.Printf("Unable to train spam classifier with chirp %d: %s", chirp.Id, err)
+		}
+	}
+
+	action := "chirp.not_spam"
+	if isSpam {
+		action = "chirp.spam"
+	}
+	api.audit(r, action, "chirp", chirp.Id, fmt.Sprintf("author_id=%d", chirp.AuthorId))
+
+	respondWithJson(w, http.StatusOK, chirp)
+}
+
+func (api *apiConfig) handleGetSpamStats(w http.ResponseWriter, r *http.Request) {
+	respondWithJson(w, http.StatusOK, api.spam.Stats())
+}
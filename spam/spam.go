@@ -0,0 +1,204 @@
+// Package spam is a naive Bayes classifier for chirp bodies, trained one
+// chirp at a time from moderator decisions and saved to a JSON file.
+package spam
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// MinDocuments is how many chirps of each kind the classifier must have seen
+// before it will score anything.
+const MinDocuments = 5
+
+// model is what gets saved. Token counts are the number of documents of each
+// kind a token appeared in.
+type model struct {
+	SpamDocuments int            `json:"spam_documents"`
+	HamDocuments  int            `json:"ham_documents"`
+	SpamTokens    map[string]int `json:"spam_tokens"`
+	HamTokens     map[string]int `json:"ham_tokens"`
+}
+
+type Stats struct {
+	SpamDocuments int  `json:"spam_documents"`
+	HamDocuments  int  `json:"ham_documents"`
+	Vocabulary    int  `json:"vocabulary"`
+	Ready         bool `json:"ready"`
+}
+
+type Classifier struct {
+	path  string
+	mux   sync.RWMutex
+	model model
+}
+
+// Load reads the classifier saved at path, starting untrained if there is
+// nothing there yet.
+func Load(path string) (*Classifier, error) {
+	c := &Classifier{
+		path: path,
+		model: model{
+			SpamTokens: map[string]int{},
+			HamTokens:  map[string]int{},
+		},
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &c.model)
+	if err != nil {
+		return nil, err
+	}
+	if c.model.SpamTokens == nil {
+		c.model.SpamTokens = map[string]int{}
+	}
+	if c.model.HamTokens == nil {
+		c.model.HamTokens = map[string]int{}
+	}
+
+	return c, nil
+}
+
+// Ready reports whether the classifier has seen enough of both kinds of
+// chirp for its scores to mean anything.
+func (c *Classifier) Ready() bool {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.ready()
+}
+
+func (c *Classifier) ready() bool {
+	return c.model.SpamDocuments >= MinDocuments && c.model.HamDocuments >= MinDocuments
+}
+
+// Score is the probability, from 0 to 1, that body is spam. The second
+// result is false while the classifier isn't Ready.
+func (c *Classifier) Score(body string) (float64, bool) {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+
+	if !c.ready() {
+		return 0, false
+	}
+
+	spamDocs := float64(c.model.SpamDocuments)
+	hamDocs := float64(c.model.HamDocuments)
+
+	// Work in log odds so long chirps don't underflow. Each token's
+	// likelihood is Laplace smoothed so unseen tokens don't zero a class.
+	logOdds := math.Log(spamDocs) - math.Log(hamDocs)
+	for token := range tokenize(body) {
+		spamCount, inSpam := c.model.SpamTokens[token]
+		hamCount, inHam := c.model.HamTokens[token]
+		if !inSpam && !inHam {
+			continue
+		}
+		logOdds += math.Log((float64(spamCount)+1)/(spamDocs+2)) - math.Log((float64(hamCount)+1)/(hamDocs+2))
+	}
+
+	return 1 / (1 + math.Exp(-logOdds)), true
+}
+
+// Train adds body as an example of spam or not spam and saves the
+// classifier.
+func (c *Classifier) Train(body string, isSpam bool) error {
+	return c.update(body, isSpam, 1)
+}
+
+// Untrain takes back an earlier Train with the same arguments, for when a
+// moderator changes their mind.
+func (c *Classifier) Untrain(body string, isSpam bool) error {
+	return c.update(body, isSpam, -1)
+}
+
+func (c *Classifier) update(body string, isSpam bool, delta int) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	docs, tokens := &c.model.HamDocuments, c.model.HamTokens
+	if isSpam {
+		docs, tokens = &c.model.SpamDocuments, c.model.SpamTokens
+	}
+
+	*docs = max(*docs+delta, 0)
+	for token := range tokenize(body) {
+		tokens[token] += delta
+		if tokens[token] <= 0 {
+			delete(tokens, token)
+		}
+	}
+
+	return c.save()
+}
+
+func (c *Classifier) Stats() Stats {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+
+	vocabulary := len(c.model.SpamTokens)
+	for token := range c.model.HamTokens {
+		if _, ok := c.model.SpamTokens[token]; !ok {
+			vocabulary++
+		}
+	}
+
+	return Stats{
+		SpamDocuments: c.model.SpamDocuments,
+		HamDocuments:  c.model.HamDocuments,
+		Vocabulary:    vocabulary,
+		Ready:         c.ready(),
+	}
+}
+
+func (c *Classifier) save() error {
+	data, err := json.Marshal(c.model)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(c.path), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp := c.path + ".tmp"
+	err = os.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// tokenize splits body into its distinct lowercase words, keeping the host
+// of each link whole so domains can be learned too.
+func tokenize(body string) map[string]bool {
+	tokens := map[string]bool{}
+	for _, field := range strings.Fields(strings.ToLower(body)) {
+		if rest, ok := strings.CutPrefix(field, "https://"); ok {
+			field = "link:" + strings.SplitN(rest, "/", 2)[0]
+		} else if rest, ok := strings.CutPrefix(field, "http://"); ok {
+			field = "link:" + strings.SplitN(rest, "/", 2)[0]
+		}
+
+		token := strings.TrimFunc(field, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+		})
+		if token != "" {
+			tokens[token] = true
+		}
+	}
+	return tokens
+}
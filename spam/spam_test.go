@@ -0,0 +1,191 @@
+package spam
+
+import (
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		body string
+		want []string
+	}{
+		{"Hello, World!", []string{"hello", "world"}},
+		{"hello hello HELLO", []string{"hello"}},
+		{"see https://Spam.Example/offer?id=1", []string{"see", "link:spam.example"}},
+		{"see http://spam.example", []string{"see", "link:spam.example"}},
+		{"café 2024 ... --", []string{"café", "2024"}},
+		{"", []string{}},
+	}
+
+	for _, tt := range tests {
+		want := map[string]bool{}
+		for _, token := range tt.want {
+			want[token] = true
+		}
+		if got := tokenize(tt.body); !reflect.DeepEqual(got, want) {
+			t.Errorf("tokenize(%q) = %v, want %v", tt.body, got, want)
+		}
+	}
+}
+
+var (
+	spamBodies = []string{
+		"buy cheap pills now https://pills.example",
+		"cheap pills limited offer https://pills.example/deal",
+		"win free money now click https://prize.example",
+		"free money claim your prize now",
+		"cheap watches buy now limited offer",
+	}
+	hamBodies = []string{
+		"had a great walk in the park today",
+		"reading a good book about gardening",
+		"the park was busy this morning",
+		"anyone have book recommendations",
+		"made soup for dinner tonight",
+	}
+)
+
+func trained(t *testing.T, path string) *Classifier {
+	t.Helper()
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range spamBodies {
+		if err := c.Train(body, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, body := range hamBodies {
+		if err := c.Train(body, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return c
+}
+
+// sameScore allows for scores summing their terms in a different order.
+func sameScore(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestScoreNeedsTraining(t *testing.T) {
+	c, err := Load(filepath.Join(t.TempDir(), "spam.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < MinDocuments; i++ {
+		if err := c.Train(spamBodies[i], true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < MinDocuments-1; i++ {
+		if err := c.Train(hamBodies[i], false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := c.Score("cheap pills"); ok || c.Ready() {
+		t.Fatalf("classifier scored with %d ham chirps, want at least %d", MinDocuments-1, MinDocuments)
+	}
+
+	if err := c.Train(hamBodies[MinDocuments-1], false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Score("cheap pills"); !ok || !c.Ready() {
+		t.Errorf("classifier didn't score after %d chirps of each kind", MinDocuments)
+	}
+}
+
+func TestScore(t *testing.T) {
+	c := trained(t, filepath.Join(t.TempDir(), "spam.json"))
+
+	tests := []struct {
+		body     string
+		wantSpam bool
+	}{
+		{"cheap pills now", true},
+		{"free money at https://prize.example", true},
+		{"limited offer, buy now", true},
+		{"a walk in the park", false},
+		{"any good gardening book recommendations?", false},
+		{"soup tonight", false},
+	}
+
+	for _, tt := range tests {
+		score, ok := c.Score(tt.body)
+		if !ok {
+			t.Fatalf("Score(%q) isn't ready", tt.body)
+		}
+		if score < 0 || score > 1 {
+			t.Errorf("Score(%q) = %v, want a probability", tt.body, score)
+		}
+		if (score > 0.5) != tt.wantSpam {
+			t.Errorf("Score(%q) = %v, want spam %v", tt.body, score, tt.wantSpam)
+		}
+	}
+
+	// Words the classifier has never seen only leave the prior, which is
+	// even here.
+	if score, _ := c.Score("zebra xylophone"); score != 0.5 {
+		t.Errorf("Score() of unseen words = %v, want 0.5", score)
+	}
+}
+
+func TestUntrain(t *testing.T) {
+	c := trained(t, filepath.Join(t.TempDir(), "spam.json"))
+	before, _ := c.Score("made soup for dinner")
+	stats := c.Stats()
+
+	// A moderator marks a chirp as spam, then changes their mind.
+	if err := c.Train("made soup for dinner", true); err != nil {
+		t.Fatal(err)
+	}
+	if during, _ := c.Score("made soup for dinner"); during <= before {
+		t.Errorf("Score() after training as spam = %v, want more than %v", during, before)
+	}
+	if err := c.Untrain("made soup for dinner", true); err != nil {
+		t.Fatal(err)
+	}
+
+	if after, _ := c.Score("made soup for dinner"); !sameScore(after, before) {
+		t.Errorf("Score() after Untrain = %v, want %v", after, before)
+	}
+	if c.Stats() != stats {
+		t.Errorf("Stats() after Untrain = %+v, want %+v", c.Stats(), stats)
+	}
+}
+
+func TestUntrainNeverGoesNegative(t *testing.T) {
+	c, err := Load(filepath.Join(t.TempDir(), "spam.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Untrain("never trained", true); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Stats(); got != (Stats{}) {
+		t.Errorf("Stats() = %+v, want nothing learned", got)
+	}
+}
+
+func TestLoadSaved(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "models", "spam.json")
+	c := trained(t, path)
+	want, _ := c.Score("cheap pills now")
+
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Stats() != c.Stats() {
+		t.Errorf("Stats() after Load = %+v, want %+v", loaded.Stats(), c.Stats())
+	}
+	if got, _ := loaded.Score("cheap pills now"); !sameScore(got, want) {
+		t.Errorf("Score() after Load = %v, want %v", got, want)
+	}
+}
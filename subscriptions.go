@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/stephenoveson/chirpy/database"
+)
+
+// polkaSubscriptionEvents maps Polka's event names to subscription events.
+var polkaSubscriptionEvents = map[string]string{
+	"user.upgraded":       database.SubscriptionUpgraded,
+	"user.renewed":        database.SubscriptionRenewed,
+	"user.cancelled":      database.SubscriptionCancelled,
+	"user.payment_failed": database.SubscriptionPaymentFailed,
+	"user.downgraded":     database.SubscriptionDowngraded,
+}
+
+type subscriptionResponse struct {
+	IsChirpyRed      bool                         `json:"is_chirpy_red"`
+	Status           string                       `json:"status"`
+	CurrentPeriodEnd *time.Time                   `json:"current_period_end"`
+	History          []database.SubscriptionEvent `json:"history"`
+}
+
+func newSubscriptionResponse(u database.User) subscriptionResponse {
+	resp := subscriptionResponse{
+		IsChirpyRed:      u.IsChirpyRed(time.Now()),
+		Status:           u.Subscription.Status,
+		CurrentPeriodEnd: optionalTime(u.Subscription.CurrentPeriodEnd),
+		History:          u.Subscription.History,
+	}
+	if resp.Status == "" {
+		resp.Status = "none"
+	}
+	if resp.History == nil {
+		resp.History = []database.SubscriptionEvent{}
+	}
+	return resp
+}
+
+func (api *apiConfig) handleGetSubscription(w http.ResponseWriter, r *http.Request) {
+	user, err := api.db.GetUserById(principalFromContext(r.Context()).UserId)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Unable to find user")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, newSubscriptionResponse(user))
+}
+
+// expireSubscriptions records lapsed subscriptions at startup and every
+// interval. Red is already withheld the moment a period ends; this keeps the
+// stored status and history in step.
+func (api *apiConfig) expireSubscriptions(interval time.Duration) {
+	for ; ; time.Sleep(interval) {
+		users, err := api.db.ExpireSubscriptions(time.Now().UTC())
+		if err != nil {
+			log.Printf("Unable to expire subscriptions: %s", err)
+			continue
+		}
+		for _, user := range users {
+			log.Printf("Subscription for user %d is now %s", user.Id, user.Subscription.Status)
+		}
+	}
+}
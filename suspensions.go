@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/stephenoveson/chirpy/database"
+)
+
+// respondWithSuspension tells a suspended or banned user why their request
+// was refused and, for a suspension, when they can come back.
+func respondWithSuspension(w http.ResponseWriter, suspended *database.SuspendedError) {
+	type response struct {
+		Error          string     `json:"error"`
+		Code           string     `json:"code"`
+		Reason         string     `json:"reason"`
+		SuspendedUntil *time.Time `json:"suspended_until"`
+		Banned         bool       `json:"banned"`
+	}
+
+	resp := response{
+		Error:  "Your account is suspended",
+		Code:   "account_suspended",
+		Reason: suspended.Reason,
+		Banned: suspended.Banned,
+	}
+	if suspended.Banned {
+		resp.Error = "Your account is banned"
+		resp.Code = "account_banned"
+	} else {
+		resp.SuspendedUntil = &suspended.Until
+	}
+
+	respondWithJson(w, http.StatusForbidden, resp)
+}
+
+// checkAccountStanding responds with the suspension and returns false when
+// u may not log in or refresh their session right now.
+func (api *apiConfig) checkAccountStanding(w http.ResponseWriter, u database.User) bool {
+	err := u.SuspensionError(time.Now())
+	if err == nil {
+		return true
+	}
+
+	respondWithSuspension(w, err.(*database.SuspendedError))
+	return false
+}
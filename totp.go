@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/stephenoveson/chirpy/auth"
+	"github.com/stephenoveson/chirpy/database"
+)
+
+const (
+	totpIssuer            = "Chirpy"
+	totpChallengeLifetime = 5 * time.Minute
+	recoveryCodeCount     = 10
+)
+
+const (
+	errStaffRequiresTOTP   = "Two-factor authentication is required for staff accounts"
+	errInvalidTOTPResponse = "Invalid two-factor code"
+)
+
+type totpCodeBody struct {
+	Code string `json:"code"`
+}
+
+func (api *apiConfig) handleEnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Secret     string `json:"secret"`
+		OtpauthURI string `json:"otpauth_uri"`
+	}
+	userId := principalFromContext(r.Context()).UserId
+
+	user, err := api.db.GetUserById(userId)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Unable to find user")
+		return
+	}
+	if user.TOTPEnabled {
+		respondWithError(w, http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create two-factor secret")
+		return
+	}
+
+	err = api.db.SetPendingTOTP(userId, secret)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save two-factor secret")
+		return
+	}
+
+	respondWithJson(w, http.StatusCreated, response{
+		Secret:     secret,
+		OtpauthURI: auth.TOTPURI(totpIssuer, user.Email, secret),
+	})
+}
+
+func (api *apiConfig) handleConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	userId := principalFromContext(r.Context()).UserId
+
+	params := totpCodeBody{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	user, err := api.db.GetUserById(userId)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Unable to find user")
+		return
+	}
+	if user.TOTPEnabled {
+		respondWithError(w, http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	}
+	if user.TOTPSecret == "" {
+		respondWithError(w, http.StatusBadRequest, "Start enrollment before confirming a code")
+		return
+	}
+
+	step, ok := auth.ValidateTOTP(user.TOTPSecret, params.Code, time.Now(), user.TOTPLastStep)
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, errInvalidTOTPResponse)
+		return
+	}
+
+	codes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create recovery codes")
+		return
+	}
+
+	err = api.db.EnableTOTP(userId, step, hashRecoveryCodes(codes))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't enable two-factor authentication")
+		return
+	}
+
+	logSecurityEvent("totp_enabled", userId, r)
+
+	respondWithJson(w, http.StatusOK, response{
+		RecoveryCodes: codes,
+	})
+}
+
+func (api *apiConfig) handleDisableTOTP(w http.ResponseWriter, r *http.Request) {
+	type response struct{}
+	userId := principalFromContext(r.Context()).UserId
+
+	params := totpCodeBody{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	user, err := api.db.GetUserById(userId)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Unable to find user")
+		return
+	}
+	if !user.TOTPEnabled {
+		respondWithError(w, http.StatusBadRequest, "Two-factor authentication is not enabled")
+		return
+	}
+
+	err = api.verifySecondFactor(user, params.Code, "")
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errInvalidTOTPResponse)
+		return
+	}
+
+	err = api.db.DisableTOTP(userId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't disable two-factor authentication")
+		return
+	}
+
+	logSecurityEvent("totp_disabled", userId, r)
+
+	respondWithJson(w, http.StatusNoContent, response{})
+}
+
+// handleLoginTOTP is the second step of a two-factor login. It exchanges the
+// challenge token from handleLogin plus a TOTP or recovery code for the
+// usual JWT and refresh token.
+func (api *apiConfig) handleLoginTOTP(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		ChallengeToken   string `json:"challenge_token"`
+		Code             string `json:"code"`
+		RecoveryCode     string `json:"recovery_code"`
+		ExpiresInSeconds int    `json:"expires_in_seconds"`
+	}
+
+	params := parameters{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	claims, err := auth.ValidateChallengeJWT(params.ChallengeToken, api.keys)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid or expired challenge token")
+		return
+	}
+
+	userId, err := claims.UserId()
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid or expired challenge token")
+		return
+	}
+
+	user, err := api.db.GetUserById(userId)
+	if err != nil || !user.TOTPEnabled {
+		respondWithError(w, http.StatusUnauthorized, "Invalid or expired challenge token")
+		return
+	}
+
+	emailKey := emailThrottleKey(user.Email)
+	ipKey := ipThrottleKey(r)
+	if !api.checkLoginLockout(w, emailKey, ipKey) {
+		return
+	}
+
+	err = api.verifySecondFactor(user, params.Code, params.RecoveryCode)
+	if err != nil {
+		logSecurityEvent("totp_failed", user.Id, r)
+		api.recordLoginFailure(r, user.Id, emailKey, ipKey)
+		respondWithError(w, http.StatusUnauthorized, errInvalidTOTPResponse)
+		return
+	}
+
+	err = api.db.ClearLoginFailures(emailKey)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to update login attempts")
+		return
+	}
+
+	api.respondWithSession(w, user, params.ExpiresInSeconds)
+}
+
+func (api *apiConfig) respondWithTOTPChallenge(w http.ResponseWriter, u database.User) {
+	type response struct {
+		TOTPRequired   bool   `json:"totp_required"`
+		ChallengeToken string `json:"challenge_token"`
+	}
+
+	if !api.checkAccountStanding(w, u) {
+		return
+	}
+
+	challenge, err := auth.MakeChallengeJWT(u.Id, api.keys, totpChallengeLifetime)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create challenge token")
+		return
+	}
+
+	respondWithJson(w, http.StatusAccepted, response{
+		TOTPRequired:   true,
+		ChallengeToken: challenge,
+	})
+}
+
+// verifySecondFactor accepts either a current TOTP code or one of the user's
+// unused recovery codes, and consumes whichever was used.
+func (api *apiConfig) verifySecondFactor(user database.User, code, recoveryCode string) error {
+	if recoveryCode != "" {
+		return api.db.UseRecoveryCode(user.Id, auth.HashToken(auth.NormalizeRecoveryCode(recoveryCode)))
+	}
+
+	step, ok := auth.ValidateTOTP(user.TOTPSecret, code, time.Now(), user.TOTPLastStep)
+	if !ok {
+		return errors.New("invalid code")
+	}
+
+	return api.db.RecordTOTPStep(user.Id, step)
+}
+
+func hashRecoveryCodes(codes []string) []string {
+	hashes := make([]string, 0, len(codes))
+	for _, code := range codes {
+		hashes = append(hashes, auth.HashToken(auth.NormalizeRecoveryCode(code)))
+	}
+	return hashes
+}
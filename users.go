@@ -2,14 +2,17 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
-	"strconv"
 	"time"
 
 	"github.com/stephenoveson/chirpy/auth"
 	"github.com/stephenoveson/chirpy/database"
 )
 
+const refreshTokenLifetime = 60 * 24 * time.Hour
+
 type userBody struct {
 	Email            string `json:"email"`
 	Password         string `json:"password"`
@@ -20,6 +23,18 @@ type userSuccess struct {
 	Email       string `json:"email"`
 	Id          int    `json:"id"`
 	IsChirpyRed bool   `json:"is_chirpy_red"`
+	Role        string `json:"role"`
+	Protected   bool   `json:"protected"`
+}
+
+func newUserSuccess(u database.User) userSuccess {
+	return userSuccess{
+		Id:          u.Id,
+		Email:       u.Email,
+		IsChirpyRed: u.IsChirpyRed(time.Now()),
+		Role:        u.Role,
+		Protected:   u.Protected,
+	}
 }
 
 func (api *apiConfig) handlerCreateUsers(w http.ResponseWriter, r *http.Request) {
@@ -32,7 +47,13 @@ func (api *apiConfig) handlerCreateUsers(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	password, err := auth.HashPassword(user.Password)
+	err = api.passwordPolicy.Validate(user.Password)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	password, err := api.passwords.HashPassword(user.Password)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Issue hashing password")
 		return
@@ -44,17 +65,10 @@ func (api *apiConfig) handlerCreateUsers(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	respondWithJson(w, http.StatusCreated, savedEmail)
+	respondWithJson(w, http.StatusCreated, newUserSuccess(savedEmail))
 }
 
 func (api *apiConfig) handleLogin(w http.ResponseWriter, r *http.Request) {
-	type response struct {
-		Email        string `json:"email"`
-		Id           int    `json:"id"`
-		Token        string `json:"token"`
-		RefreshToken string `json:"refresh_token"`
-		IsChirpyRed  bool   `json:"is_chirpy_red"`
-	}
 	decoder := json.NewDecoder(r.Body)
 	user := userBody{}
 	err := decoder.Decode(&user)
@@ -63,109 +77,138 @@ func (api *apiConfig) handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	u, err := api.db.GetUserByEmail(user.Email)
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, err.Error())
+	emailKey := emailThrottleKey(user.Email)
+	ipKey := ipThrottleKey(r)
+	if !api.checkLoginLockout(w, emailKey, ipKey) {
 		return
 	}
 
-	err = auth.CheckPasswordHash(user.Password, u.Password)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Invalid password")
+	u, lookupErr := api.db.GetUserByEmail(user.Email)
+	hash := u.Password
+	if lookupErr != nil {
+		hash = api.unknownUserHash
+	}
+
+	needsRehash, err := api.passwords.CheckPasswordHash(user.Password, hash)
+	if lookupErr != nil || err != nil {
+		api.recordLoginFailure(r, u.Id, emailKey, ipKey)
+		respondWithError(w, http.StatusUnauthorized, errInvalidCredentials)
 		return
 	}
 
-	refreshToken, err := auth.GetRefreshToken()
+	if needsRehash {
+		api.rehashPassword(u.Id, user.Password)
+	}
+
+	err = api.db.ClearLoginFailures(emailKey)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create refresh token")
+		respondWithError(w, http.StatusInternalServerError, "Unable to update login attempts")
+		return
+	}
+
+	if u.TOTPEnabled {
+		api.respondWithTOTPChallenge(w, u)
 		return
 	}
 
-	additionalTime := time.Duration(((60*60)*24)*60) * time.Second
-	expiresAt := time.Now().Add(additionalTime)
-	u.ExpiresAt = expiresAt
-	u.RefreshToken = refreshToken
+	api.respondWithSession(w, u, user.ExpiresInSeconds)
+}
 
-	dbUser, err := api.db.UpdateUser(u.Id, u)
+// respondWithSession finishes a successful login by issuing a JWT and a new
+// refresh token family for u, unless u is suspended, cancelling any pending
+// account deletion.
+// expiresInSeconds is capped at one hour and defaults to it when zero.
+func (api *apiConfig) respondWithSession(w http.ResponseWriter, u database.User, expiresInSeconds int) {
+	type response struct {
+		Email        string `json:"email"`
+		Id           int    `json:"id"`
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+		IsChirpyRed  bool   `json:"is_chirpy_red"`
+		Role         string `json:"role"`
+	}
+
+	if !api.checkAccountStanding(w, u) {
+		return
+	}
+
+	if u.IsPendingDeletion() {
+		err := api.db.CancelUserDeletion(u.Id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't cancel account deletion")
+			return
+		}
+		log.Printf("Cancelled deletion of account %d after login", u.Id)
+	}
+
+	refreshToken, err := api.issueRefreshToken(u.Id)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't update user")
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create refresh token")
 		return
 	}
 
 	defaultExpiration := 60 * 60 * 1
-	if user.ExpiresInSeconds == 0 {
-		user.ExpiresInSeconds = defaultExpiration
-	} else if user.ExpiresInSeconds > defaultExpiration {
-		user.ExpiresInSeconds = defaultExpiration
+	if expiresInSeconds == 0 {
+		expiresInSeconds = defaultExpiration
+	} else if expiresInSeconds > defaultExpiration {
+		expiresInSeconds = defaultExpiration
 	}
 
-	token, err := auth.MakeJWT(u.Id, api.secret, time.Duration(user.ExpiresInSeconds)*time.Second)
+	token, err := auth.MakeJWT(u.Id, api.scopesForUser(u), api.keys, time.Duration(expiresInSeconds)*time.Second)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create JWT")
 		return
 	}
 
 	respondWithJson(w, http.StatusOK, response{
-		Email:        dbUser.Email,
-		Id:           dbUser.Id,
+		Email:        u.Email,
+		Id:           u.Id,
 		Token:        token,
 		RefreshToken: refreshToken,
-		IsChirpyRed:  dbUser.IsChirpyRed,
+		IsChirpyRed:  u.IsChirpyRed(time.Now()),
+		Role:         u.Role,
 	})
 }
 
 func (api *apiConfig) handleUpdateUser(w http.ResponseWriter, r *http.Request) {
-	token, err := auth.GetBearerToken(r.Header)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT")
-		return
-	}
-
-	userId, err := auth.ValidateJWT(token, api.secret)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't Validate JWT")
-		return
-	}
+	userId := principalFromContext(r.Context()).UserId
 
 	decoder := json.NewDecoder(r.Body)
 	user := database.User{}
-	err = decoder.Decode(&user)
+	err := decoder.Decode(&user)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
 		return
 	}
 
-	hash, err := auth.HashPassword(user.Password)
+	err = api.passwordPolicy.Validate(user.Password)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Unable to properly handle password")
+		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	userIdInt, err := strconv.Atoi(userId)
+	hash, err := api.passwords.HashPassword(user.Password)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't parse user ID")
+		respondWithError(w, http.StatusInternalServerError, "Unable to properly handle password")
 		return
 	}
 
 	user.Password = hash
-	user.Id = userIdInt
+	user.Id = userId
 
-	u, err := api.db.UpdateUser(userIdInt, user)
+	u, err := api.db.UpdateUser(userId, user)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create user")
 		return
 	}
 
-	respondWithJson(w, http.StatusOK, userSuccess{
-		Id:          u.Id,
-		Email:       u.Email,
-		IsChirpyRed: u.IsChirpyRed,
-	})
+	respondWithJson(w, http.StatusOK, newUserSuccess(u))
 }
 
 func (api *apiConfig) handleTokenRefresh(w http.ResponseWriter, r *http.Request) {
 	type response struct {
-		Token string `json:"token"`
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
 	}
 	refreshToken, err := auth.GetBearerToken(r.Header)
 	if err != nil {
@@ -173,20 +216,48 @@ func (api *apiConfig) handleTokenRefresh(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	user, err := api.db.ConfirmUserToken(refreshToken)
+	newRefreshToken, err := auth.GetRefreshToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create refresh token")
+		return
+	}
+
+	rotated, err := api.db.RotateRefreshToken(
+		auth.HashToken(refreshToken),
+		auth.HashToken(newRefreshToken),
+		"",
+		time.Now().Add(refreshTokenLifetime).UTC(),
+	)
+	var suspended *database.SuspendedError
+	if errors.As(err, &suspended) {
+		respondWithSuspension(w, suspended)
+		return
+	}
+	if errors.Is(err, database.ErrRefreshTokenReused) {
+		logSecurityEvent("refresh_token_reuse", rotated.UserId, r)
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, err.Error())
 		return
 	}
 
-	token, err := auth.MakeJWT(user.Id, api.secret, time.Duration(60*60)*time.Second)
+	user, err := api.db.GetUserById(rotated.UserId)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unable to find user")
+		return
+	}
+
+	token, err := auth.MakeJWT(user.Id, api.scopesForUser(user), api.keys, time.Duration(60*60)*time.Second)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create JWT")
 		return
 	}
 
 	respondWithJson(w, http.StatusOK, response{
-		Token: token,
+		Token:        token,
+		RefreshToken: newRefreshToken,
 	})
 }
 
@@ -198,7 +269,7 @@ func (api *apiConfig) handleTokenRevoke(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	err = api.db.RevokeUserToken(refreshToken)
+	err = api.db.RevokeRefreshToken(auth.HashToken(refreshToken), "")
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "No token to revoke")
 		return
@@ -206,3 +277,44 @@ func (api *apiConfig) handleTokenRevoke(w http.ResponseWriter, r *http.Request)
 
 	respondWithJson(w, http.StatusNoContent, response{})
 }
+
+// rehashPassword upgrades a stored hash to the current algorithm and
+// parameters while the plaintext is available after a successful login.
+// Failing to upgrade doesn't fail the login.
+func (api *apiConfig) rehashPassword(userId int, password string) {
+	hash, err := api.passwords.HashPassword(password)
+	if err == nil {
+		err = api.db.UpdatePasswordHash(userId, hash)
+	}
+	if err != nil {
+		log.Printf("Unable to rehash password for user %d: %s", userId, err)
+	}
+}
+
+// issueRefreshToken starts a new refresh token family for userId and returns
+// the plaintext token, which is only ever shown to the client.
+func (api *apiConfig) issueRefreshToken(userId int) (string, error) {
+	refreshToken, err := auth.GetRefreshToken()
+	if err != nil {
+		return "", err
+	}
+
+	expiresAt := time.Now().Add(refreshTokenLifetime).UTC()
+	_, err = api.db.CreateRefreshToken(userId, auth.HashToken(refreshToken), expiresAt)
+	if err != nil {
+		return "", err
+	}
+
+	return refreshToken, nil
+}
+
+// scopesForUser decides what a token issued to u after a password login or
+// refresh is allowed to do. Staff also get the admin scope; the role itself
+// is still checked on every admin request.
+func (api *apiConfig) scopesForUser(u database.User) []string {
+	scopes := append([]string{}, auth.DefaultUserScopes...)
+	if u.HasRole(database.RoleModerator) {
+		scopes = append(scopes, auth.ScopeAdmin)
+	}
+	return scopes
+}
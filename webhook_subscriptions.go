@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/stephenoveson/chirpy/auth"
+	"github.com/stephenoveson/chirpy/database"
+)
+
+const (
+	webhookTimeout       = 10 * time.Second
+	webhookMaxAttempts   = 10
+	webhookFirstBackoff  = time.Minute
+	webhookMaxBackoff    = 6 * time.Hour
+	webhookConcurrency   = 4
+	webhookLogRetention  = 30 * 24 * time.Hour
+	maxWebhookReplyBytes = 64 << 10
+)
+
+var webhookEvents = []string{database.EventChirpCreated, database.EventChirpDeleted, database.EventUserUpgraded, database.EventUserDowngraded}
+
+type webhookResponse struct {
+	Id        int       `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"created_at"`
+	// Secret is only shown when the webhook is created.
+	Secret string `json:"secret,omitempty"`
+}
+
+func newWebhookResponse(w database.Webhook) webhookResponse {
+	return webhookResponse{
+		Id:        w.Id,
+		URL:       w.URL,
+		Events:    w.Events,
+		CreatedAt: w.CreatedAt,
+	}
+}
+
+type webhookDeliveryResponse struct {
+	database.WebhookDelivery
+	Payload json.RawMessage `json:"payload"`
+}
+
+func newWebhookDeliveryResponse(d database.WebhookDelivery) webhookDeliveryResponse {
+	return webhookDeliveryResponse{
+		WebhookDelivery: d,
+		Payload:         json.RawMessage(d.Payload),
+	}
+}
+
+func (api *apiConfig) handleCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+	}
+
+	params := parameters{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	err = api.validateWebhookURL(params.URL)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(params.Events) == 0 {
+		respondWithError(w, http.StatusBadRequest, "events is required")
+		return
+	}
+	for _, event := range params.Events {
+		if !containsString(webhookEvents, event) {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("unknown event %q", event))
+			return
+		}
+	}
+
+	secret, err := auth.GenerateNonce()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create webhook")
+		return
+	}
+	secret = "whsec_" + secret
+
+	webhook, err := api.db.CreateWebhook(params.URL, params.Events, secret, principalFromContext(r.Context()).UserId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create webhook")
+		return
+	}
+
+	api.audit(r, "webhook.created", "webhook", webhook.Id, "url="+webhook.URL)
+
+	resp := newWebhookResponse(webhook)
+	resp.Secret = webhook.Secret
+	respondWithJson(w, http.StatusCreated, resp)
+}
+
+// validateWebhookURL requires https, or allows http when WEBHOOKS_ALLOW_HTTP
+// is set for local development.
+func (api *apiConfig) validateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return errors.New("url must be an absolute URL")
+	}
+	if u.Scheme != "https" && !(u.Scheme == "http" && api.allowHTTPWebhooks) {
+		return errors.New("url must use https")
+	}
+	return nil
+}
+
+func (api *apiConfig) handleGetWebhooks(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := api.db.GetWebhooks()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to read webhooks from database.")
+		return
+	}
+
+	resp := make([]webhookResponse, 0, len(webhooks))
+	for _, webhook := range webhooks {
+		resp = append(resp, newWebhookResponse(webhook))
+	}
+
+	respondWithJson(w, http.StatusOK, resp)
+}
+
+func (api *apiConfig) handleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	webhookId, err := strconv.Atoi(r.PathValue("webhookID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to convert parameter to integer.")
+		return
+	}
+
+	err = api.db.DeleteWebhook(webhookId)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	api.audit(r, "webhook.deleted", "webhook", webhookId, "")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (api *apiConfig) handleGetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	webhookId, err := strconv.Atoi(r.PathValue("webhookID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to convert parameter to integer.")
+		return
+	}
+
+	_, err = api.db.GetWebhook(webhookId)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	deliveries, err := api.db.GetWebhookDeliveries(webhookId, r.URL.Query().Get("status"))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to read deliveries from database.")
+		return
+	}
+
+	resp := make([]webhookDeliveryResponse, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		resp = append(resp, newWebhookDeliveryResponse(delivery))
+	}
+
+	respondWithJson(w, http.StatusOK, resp)
+}
+
+func (api *apiConfig) handleRedeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	deliveryId, err := strconv.Atoi(r.PathValue("deliveryID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to convert parameter to integer.")
+		return
+	}
+
+	delivery, err := api.db.RedeliverWebhook(deliveryId)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	api.audit(r, "webhook.redelivered", "webhook", delivery.WebhookId, fmt.Sprintf("delivery_id=%d", delivery.Id))
+	api.wakeWebhookDeliveries()
+
+	respondWithJson(w, http.StatusAccepted, newWebhookDeliveryResponse(delivery))
+}
+
+// queueWebhooks is the outbox consumer for webhooks. It queues a delivery
+// of event for every webhook subscribed to it, named after the outbox event
+// so receivers can tell a repeat from a new event.
+func (api *apiConfig) queueWebhooks(event database.OutboxEvent) error {
+	type envelope struct {
+		Id        string          `json:"id"`
+		Type      string          `json:"type"`
+		CreatedAt time.Time       `json:"created_at"`
+		Data      json.RawMessage `json:"data"`
+	}
+
+	// Integrators hear about a chirp as chirp.created once it is published,
+	// and only if anyone can see it.
+	eventType := event.Type
+	switch event.Type {
+	case database.EventChirpCreated:
+		return nil
+	case database.EventChirpPublished:
+		chirp := database.Chirp{}
+		err := json.Unmarshal(event.Payload, &chirp)
+		if err != nil {
+			return err
+		}
+		if _, err := api.db.GetChirpById(0, chirp.Id); err != nil {
+			return nil
+		}
+		eventType = database.EventChirpCreated
+	}
+	if !containsString(webhookEvents, eventType) {
+		return nil
+	}
+
+	eventId := fmt.Sprintf("evt_%d", event.Id)
+	payload, err := json.Marshal(envelope{
+		Id:        eventId,
+		Type:      eventType,
+		CreatedAt: event.CreatedAt,
+		Data:      event.Payload,
+	})
+	if err != nil {
+		return err
+	}
+
+	queued, err := api.db.EnqueueWebhookEvent(eventId, eventType, string(payload))
+	if err != nil {
+		return err
+	}
+	if queued > 0 {
+		api.wakeWebhookDeliveries()
+	}
+
+	return nil
+}
+
+func (api *apiConfig) wakeWebhookDeliveries() {
+	select {
+	case api.webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+// deliverWebhooks sends due deliveries whenever an event is queued and at
+// least every interval, so retries and deliveries queued before a restart
+// go out. Finished deliveries are pruned from the log once a day.
+func (api *apiConfig) deliverWebhooks(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastPrune := time.Time{}
+	for {
+		api.sendDueWebhooks()
+
+		if time.Since(lastPrune) > 24*time.Hour {
+			lastPrune = time.Now()
+			_, err := api.db.PruneWebhookDeliveries(lastPrune.Add(-webhookLogRetention))
+			if err != nil {
+				log.Printf("Unable to prune webhook deliveries: %s", err)
+			}
+		}
+
+		select {
+		case <-api.webhookWake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (api *apiConfig) sendDueWebhooks() {
+	deliveries, err := api.db.GetDueWebhookDeliveries(time.Now())
+	if err != nil {
+		log.Printf("Unable to load webhook deliveries: %s", err)
+		return
+	}
+	if len(deliveries) == 0 {
+		return
+	}
+
+	webhooks, err := api.db.GetWebhooks()
+	if err != nil {
+		log.Printf("Unable to load webhooks: %s", err)
+		return
+	}
+	byId := map[int]database.Webhook{}
+	for _, webhook := range webhooks {
+		byId[webhook.Id] = webhook
+	}
+
+	wg := sync.WaitGroup{}
+	slots := make(chan struct{}, webhookConcurrency)
+	for _, delivery := range deliveries {
+		webhook, ok := byId[delivery.WebhookId]
+		if !ok {
+			continue
+		}
+
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(delivery database.WebhookDelivery) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			api.sendWebhook(webhook, delivery)
+		}(delivery)
+	}
+	wg.Wait()
+}
+
+// sendWebhook makes one attempt at delivery. Any 2xx response delivers it;
+// anything else is retried with exponential backoff until it has failed
+// webhookMaxAttempts times in a row, then dead-lettered.
+func (api *apiConfig) sendWebhook(webhook database.Webhook, delivery database.WebhookDelivery) {
+	start := time.Now()
+	attempt := database.WebhookAttempt{At: start.UTC()}
+
+	statusCode, err := api.postWebhook(webhook, delivery, start)
+	attempt.StatusCode = statusCode
+	attempt.DurationMs = time.Since(start).Milliseconds()
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+
+	delivered := err == nil
+	retryAt := time.Time{}
+	if !delivered && delivery.Failures+1 < webhookMaxAttempts {
+		backoff := webhookFirstBackoff << delivery.Failures
+		if backoff > webhookMaxBackoff {
+			backoff = webhookMaxBackoff
+		}
+		retryAt = start.Add(backoff).UTC()
+	}
+
+	saved, err := api.db.RecordWebhookAttempt(delivery.Id, attempt, delivered, retryAt)
+	if err != nil {
+		log.Printf("Unable to record webhook delivery %d: %s", delivery.Id, err)
+		return
+	}
+	if saved.Status == database.DeliveryDead {
+		log.Printf("Webhook delivery %d to %s dead-lettered after %d failures: %s", saved.Id, webhook.URL, saved.Failures, attempt.Error)
+	}
+}
+
+func (api *apiConfig) postWebhook(webhook database.Webhook, delivery database.WebhookDelivery, now time.Time) (int, error) {
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Chirpy-Webhooks/1")
+	req.Header.Set("Chirpy-Event", delivery.Event)
+	req.Header.Set("Chirpy-Event-Id", delivery.EventId)
+	req.Header.Set("Chirpy-Delivery", strconv.Itoa(delivery.Id))
+	req.Header.Set("Chirpy-Timestamp", strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set("Chirpy-Signature", auth.SignWebhook([]byte(webhook.Secret), now, body))
+
+	res, err := api.webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, maxWebhookReplyBytes))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("receiver responded %s", res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+// newWebhookClient doesn't follow redirects, so a receiver has to answer at
+// the registered URL.
+func newWebhookClient() *http.Client {
+	return &http.Client{
+		Timeout: webhookTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}